@@ -0,0 +1,180 @@
+// rulecheck 检查规则表达式：报告解析错误及可疑写法，可输出规范形式或按 JSON 数据源求值。
+//
+// 表达式来自 -e、命令行指定的文件或标准输入，文件中每个非空且不以 # 开头的行为一个表达式：
+//
+//	rulecheck rules.txt
+//	rulecheck -fmt < rules.txt
+//	rulecheck -data order.json -e 'order.amount > 100 && "vip" in tags'
+//
+// 有解析错误、求值错误或 lint 警告时退出码为 1。
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/carmel/go-util/rule"
+)
+
+var (
+	expr   = flag.String("e", "", "Expression to check instead of files or stdin")
+	format = flag.Bool("fmt", false, "Print expressions in canonical form")
+	lint   = flag.Bool("lint", true, "Report suspicious constructs such as float equality, constant conditions and unknown functions")
+	data   = flag.String("data", "", "JSON file used as the datasource to evaluate expressions against")
+)
+
+// checker 检查表达式并记录是否有问题
+type checker struct {
+	out    io.Writer
+	data   interface{}
+	eval   bool
+	failed bool
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: rulecheck [flags] [file ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	c := &checker{out: os.Stdout}
+	if *data != "" {
+		ds, err := readData(*data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		c.data, c.eval = ds, true
+	}
+
+	switch {
+	case *expr != "":
+		c.check("<expr>", 1, *expr)
+	case flag.NArg() == 0:
+		if err := c.checkFile("<stdin>", os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	default:
+		for _, name := range flag.Args() {
+			f, err := os.Open(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			err = c.checkFile(name, f)
+			f.Close()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+	}
+	if c.failed {
+		os.Exit(1)
+	}
+}
+
+// readData 读取 JSON 数据源，作为 json.RawMessage 交给 Rule 解码以保留数值精度
+func readData(name string) (interface{}, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("%s: invalid JSON", name)
+	}
+	return json.RawMessage(b), nil
+}
+
+// checkFile 逐行检查表达式
+func (c *checker) checkFile(name string, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimRight(sc.Text(), "\r")
+		if trimmed := strings.TrimSpace(text); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		c.check(name, line, text)
+	}
+	return sc.Err()
+}
+
+// check 检查一个表达式，line 为其在文件中的行号
+func (c *checker) check(name string, line int, src string) {
+	warnings, err := rule.Lint(src, nil)
+	if err != nil {
+		c.failed = true
+		var list scanner.ErrorList
+		if !errors.As(err, &list) {
+			fmt.Fprintf(c.out, "%s:%d: %v\n", name, line, err)
+			return
+		}
+		for _, e := range list {
+			c.report(name, line, src, e.Pos, e.Msg)
+		}
+		return
+	}
+	if *format {
+		formatted, _ := rule.Format(src)
+		fmt.Fprintln(c.out, formatted)
+	}
+	if *lint {
+		for _, w := range warnings {
+			c.failed = true
+			c.report(name, line, src, w.Pos, w.Msg)
+		}
+	}
+	if !c.eval {
+		return
+	}
+	var v interface{}
+	r := &rule.Rule{}
+	if err = r.SetExpr(src); err == nil {
+		v, err = r.Eval(c.data)
+	}
+	if err != nil {
+		c.failed = true
+		fmt.Fprintf(c.out, "%s:%d: %v\n", name, line, err)
+		return
+	}
+	fmt.Fprintf(c.out, "%s:%d: %s\n", name, line, formatValue(v))
+}
+
+// report 输出问题及指向其位置的 ^
+func (c *checker) report(name string, line int, src string, pos token.Position, msg string) {
+	col := pos.Column
+	if col < 1 || col > len(src)+1 {
+		col = len(src) + 1
+	}
+	fmt.Fprintf(c.out, "%s:%d:%d: %s\n", name, line, col, msg)
+	// 按字符对齐，保留制表符
+	indent := []rune(src[:col-1])
+	for i, r := range indent {
+		if r != '\t' {
+			indent[i] = ' '
+		}
+	}
+	fmt.Fprintf(c.out, "\t%s\n\t%s^\n", src, string(indent))
+}
+
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(t)
+	}
+	return fmt.Sprint(v)
+}
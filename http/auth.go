@@ -0,0 +1,338 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthProvider authorizes outgoing requests, see SetAuth.
+type AuthProvider interface {
+	Authorize(req *http.Request) error
+}
+
+// Invalidator is implemented by an AuthProvider whose credentials can be
+// renewed. After a 401 response the request is sent once more with fresh credentials.
+type Invalidator interface {
+	// Invalidate drops the credentials req was authorized with.
+	Invalidate(req *http.Request)
+}
+
+// SetAuth sets the provider authorizing the request.
+func (b *HTTPRequest) SetAuth(auth AuthProvider) *HTTPRequest {
+	b.setting.Auth = auth
+	return b
+}
+
+// do sends b.req, authorizing it and retrying once with fresh credentials after a 401.
+func (b *HTTPRequest) do(client *http.Client) (*http.Response, error) {
+	auth := b.setting.Auth
+	if auth == nil {
+		return client.Do(b.req)
+	}
+	if err := auth.Authorize(b.req); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(b.req)
+	inv, ok := auth.(Invalidator)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !ok || !b.rewindBody() {
+		return resp, err
+	}
+	resp.Body.Close()
+	inv.Invalidate(b.req)
+	if err = auth.Authorize(b.req); err != nil {
+		return nil, err
+	}
+	return client.Do(b.req)
+}
+
+// Token is an OAuth2 access token.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Type returns the token type used in the Authorization header, Bearer by default.
+func (t *Token) Type() string {
+	switch strings.ToLower(t.TokenType) {
+	case "", "bearer":
+		return "Bearer"
+	case "mac":
+		return "MAC"
+	case "basic":
+		return "Basic"
+	}
+	return t.TokenType
+}
+
+// ErrNoAccessToken is returned when the token endpoint answers without access_token.
+var ErrNoAccessToken = errors.New("http: token response has no access_token")
+
+// OAuth2 fetches tokens from a token endpoint with the client credentials grant,
+// or the refresh token grant when RefreshToken is set, and caches them until
+// shortly before they expire. Concurrent requests share a single token fetch.
+type OAuth2 struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RefreshToken string
+	// Params are extra form parameters of the token request, e.g. audience.
+	Params map[string]string
+	// AuthInParams sends the client credentials in the form body
+	// instead of the Authorization header.
+	AuthInParams bool
+	// Leeway is how long before expiry a token is renewed, 30s by default.
+	Leeway time.Duration
+	// Setting is used for the token requests, the default setting when nil.
+	Setting *HTTPSettings
+
+	mu      sync.Mutex
+	token   *Token
+	pending *tokenCall
+}
+
+type tokenCall struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// Authorize implements AuthProvider.
+func (o *OAuth2) Authorize(req *http.Request) error {
+	token, err := o.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token.Type()+" "+token.AccessToken)
+	return nil
+}
+
+// Invalidate implements Invalidator. The cached token is only dropped when
+// req carries it, so concurrent 401s cause a single refresh.
+func (o *OAuth2) Invalidate(req *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != nil && req.Header.Get("Authorization") == o.token.Type()+" "+o.token.AccessToken {
+		o.token = nil
+	}
+}
+
+// Token returns a valid token, fetching one when the cached token expires.
+func (o *OAuth2) Token() (*Token, error) {
+	o.mu.Lock()
+	if o.token != nil && o.valid(o.token) {
+		token := o.token
+		o.mu.Unlock()
+		return token, nil
+	}
+	if c := o.pending; c != nil {
+		o.mu.Unlock()
+		<-c.done
+		return c.token, c.err
+	}
+	c := &tokenCall{done: make(chan struct{})}
+	o.pending = c
+	refresh := o.RefreshToken
+	o.mu.Unlock()
+
+	c.token, c.err = o.fetch(refresh)
+
+	o.mu.Lock()
+	o.pending = nil
+	if c.err == nil {
+		o.token = c.token
+		if c.token.RefreshToken != "" {
+			o.RefreshToken = c.token.RefreshToken
+		}
+	}
+	o.mu.Unlock()
+	close(c.done)
+	return c.token, c.err
+}
+
+func (o *OAuth2) valid(t *Token) bool {
+	if t.Expiry.IsZero() {
+		return true
+	}
+	leeway := o.Leeway
+	if leeway == 0 {
+		leeway = 30 * time.Second
+	}
+	return time.Now().Add(leeway).Before(t.Expiry)
+}
+
+func (o *OAuth2) fetch(refresh string) (*Token, error) {
+	req := HttpPost(o.TokenURL).ExpectStatus()
+	if o.Setting != nil {
+		req.Setting(*o.Setting)
+	}
+	// the settings may carry o itself as Auth, which would wait for the token being fetched
+	req.setting.Auth = nil
+	req.Header("Accept", "application/json")
+	if refresh != "" {
+		req.Param("grant_type", "refresh_token")
+		req.Param("refresh_token", refresh)
+	} else {
+		req.Param("grant_type", "client_credentials")
+	}
+	if len(o.Scopes) > 0 {
+		req.Param("scope", strings.Join(o.Scopes, " "))
+	}
+	for k, v := range o.Params {
+		req.Param(k, v)
+	}
+	if o.AuthInParams {
+		req.Param("client_id", o.ClientID)
+		req.Param("client_secret", o.ClientSecret)
+	} else {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+
+	var resp struct {
+		AccessToken  string          `json:"access_token"`
+		TokenType    string          `json:"token_type"`
+		RefreshToken string          `json:"refresh_token"`
+		ExpiresIn    json.RawMessage `json:"expires_in"`
+	}
+	if err := req.ToJSON(&resp); err != nil {
+		return nil, err
+	}
+	if resp.AccessToken == "" {
+		return nil, ErrNoAccessToken
+	}
+	token := &Token{
+		AccessToken:  resp.AccessToken,
+		TokenType:    resp.TokenType,
+		RefreshToken: resp.RefreshToken,
+	}
+	// some servers send expires_in as a string
+	if n, err := strconv.ParseInt(strings.Trim(string(resp.ExpiresIn), `"`), 10, 64); err == nil && n > 0 {
+		token.Expiry = time.Now().Add(time.Duration(n) * time.Second)
+	}
+	return token, nil
+}
+
+// HMACSigner signs requests with a shared secret. The signature covers the
+// method, the request uri, the X-Date header, the body sha256 and SignedHeaders:
+//
+//	METHOD \n /path?query \n X-Date \n hex(sha256(body)) \n name:value \n ...
+//
+// and is sent as
+//
+//	Authorization: HMAC-SHA256 Credential=KeyID, SignedHeaders=x-date;host, Signature=hex
+type HMACSigner struct {
+	KeyID  string
+	Secret []byte
+	// Hash is sha256.New by default, Algorithm names it in the Authorization header.
+	Hash      func() hash.Hash
+	Algorithm string
+	// SignedHeaders are the header names signed besides X-Date, "host" signs the request host.
+	SignedHeaders []string
+	Now           func() time.Time
+}
+
+// Authorize implements AuthProvider.
+func (s *HMACSigner) Authorize(req *http.Request) error {
+	body, err := peekBody(req)
+	if err != nil {
+		return err
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	req.Header.Set("X-Date", now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Content-Sha256", hashHex(body))
+
+	algorithm := s.Algorithm
+	if algorithm == "" {
+		algorithm = "HMAC-SHA256"
+	}
+	req.Header.Set("Authorization", algorithm+
+		" Credential="+s.KeyID+
+		", SignedHeaders="+strings.Join(s.headerNames(), ";")+
+		", Signature="+s.Signature(req, body))
+	return nil
+}
+
+// Signature returns the hex signature of req with body, servers use it to
+// verify the Authorization header of a received request.
+func (s *HMACSigner) Signature(req *http.Request, body []byte) string {
+	h := s.Hash
+	if h == nil {
+		h = sha256.New
+	}
+	mac := hmac.New(h, s.Secret)
+	mac.Write([]byte(s.stringToSign(req, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *HMACSigner) headerNames() []string {
+	names := []string{"x-date"}
+	for _, name := range s.SignedHeaders {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+func (s *HMACSigner) stringToSign(req *http.Request, body []byte) string {
+	var buf strings.Builder
+	buf.WriteString(req.Method + "\n")
+	buf.WriteString(req.URL.RequestURI() + "\n")
+	buf.WriteString(req.Header.Get("X-Date") + "\n")
+	buf.WriteString(hashHex(body) + "\n")
+	for _, name := range s.headerNames()[1:] {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		buf.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	return buf.String()
+}
+
+func hashHex(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// peekBody returns the request body without consuming it.
+func peekBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return ioutil.ReadAll(body)
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
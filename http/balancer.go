@@ -0,0 +1,274 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects the endpoint of a service a request is sent to.
+type Strategy int
+
+const (
+	// RoundRobin cycles through the endpoints.
+	RoundRobin Strategy = iota
+	// LeastInFlight picks the endpoint with the fewest requests in progress.
+	LeastInFlight
+	// ConsistentHash maps the request hash key (SetHashKey, the url path by default)
+	// to the same endpoint as long as it is healthy.
+	ConsistentHash
+)
+
+// Errors returned for svc:// urls.
+var (
+	ErrServiceNotFound = errors.New("http: service not registered")
+	ErrNoEndpoint      = errors.New("http: no healthy endpoint")
+)
+
+// ServiceOptions configures a registered service.
+type ServiceOptions struct {
+	Strategy Strategy
+	// MaxFails is the number of consecutive failures (transport errors or 5xx
+	// responses) after which an endpoint is ejected, 3 by default.
+	MaxFails int
+	// EjectTime is how long an ejected endpoint is left out, 30s by default.
+	EjectTime time.Duration
+}
+
+// Service is a logical service name with a list of endpoints, requests to
+// svc://name/path are sent to one of them.
+type Service struct {
+	name string
+	opt  ServiceOptions
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	ring      []ringNode
+	next      int
+}
+
+type endpoint struct {
+	url          *url.URL
+	inFlight     int64
+	fails        int
+	ejectedUntil time.Time
+}
+
+type ringNode struct {
+	hash uint32
+	ep   *endpoint
+}
+
+const ringReplicas = 100
+
+var (
+	services   = map[string]*Service{}
+	servicesMu sync.RWMutex
+)
+
+// RegisterService registers or replaces the service name with endpoints
+// such as "http://10.0.0.1:8080".
+func RegisterService(name string, endpoints []string, opt ServiceOptions) (*Service, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	if opt.MaxFails <= 0 {
+		opt.MaxFails = 3
+	}
+	if opt.EjectTime <= 0 {
+		opt.EjectTime = 30 * time.Second
+	}
+	s := &Service{name: name, opt: opt}
+	for _, raw := range endpoints {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("http: invalid endpoint " + raw)
+		}
+		ep := &endpoint{url: u}
+		s.endpoints = append(s.endpoints, ep)
+		for i := 0; i < ringReplicas; i++ {
+			s.ring = append(s.ring, ringNode{hash: crc32.ChecksumIEEE([]byte(raw + "#" + strconv.Itoa(i))), ep: ep})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+
+	servicesMu.Lock()
+	services[name] = s
+	servicesMu.Unlock()
+	return s, nil
+}
+
+// RemoveService unregisters the service name.
+func RemoveService(name string) {
+	servicesMu.Lock()
+	delete(services, name)
+	servicesMu.Unlock()
+}
+
+// LookupService returns the registered service name.
+func LookupService(name string) (*Service, bool) {
+	servicesMu.RLock()
+	defer servicesMu.RUnlock()
+	s, ok := services[name]
+	return s, ok
+}
+
+// Endpoints returns the endpoints currently not ejected.
+func (s *Service) Endpoints() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var list []string
+	for _, ep := range s.endpoints {
+		if ep.healthy(now) {
+			list = append(list, ep.url.String())
+		}
+	}
+	return list
+}
+
+func (ep *endpoint) healthy(now time.Time) bool {
+	return !now.Before(ep.ejectedUntil)
+}
+
+// pick selects an endpoint and counts the request as in flight.
+func (s *Service) pick(key string) (*endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+
+	var ep *endpoint
+	switch s.opt.Strategy {
+	case ConsistentHash:
+		h := crc32.ChecksumIEEE([]byte(key))
+		i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+		for n := 0; n < len(s.ring); n++ {
+			node := s.ring[(i+n)%len(s.ring)]
+			if node.ep.healthy(now) {
+				ep = node.ep
+				break
+			}
+		}
+	case LeastInFlight:
+		for n := range s.endpoints {
+			// start at the round robin position so ties are spread
+			e := s.endpoints[(s.next+n)%len(s.endpoints)]
+			if e.healthy(now) && (ep == nil || atomic.LoadInt64(&e.inFlight) < atomic.LoadInt64(&ep.inFlight)) {
+				ep = e
+			}
+		}
+		s.next++
+	default:
+		for n := 0; n < len(s.endpoints); n++ {
+			e := s.endpoints[s.next%len(s.endpoints)]
+			s.next++
+			if e.healthy(now) {
+				ep = e
+				break
+			}
+		}
+	}
+	if ep == nil {
+		return nil, ErrNoEndpoint
+	}
+	atomic.AddInt64(&ep.inFlight, 1)
+	return ep, nil
+}
+
+// report records the outcome of a request for passive health checking.
+func (s *Service) report(ep *endpoint, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !failed {
+		ep.fails = 0
+		return
+	}
+	ep.fails++
+	if ep.fails >= s.opt.MaxFails {
+		// re-admitted after EjectTime with a clean count
+		ep.fails = 0
+		ep.ejectedUntil = time.Now().Add(s.opt.EjectTime)
+	}
+}
+
+// SetHashKey sets the key used by ConsistentHash services.
+func (b *HTTPRequest) SetHashKey(key string) *HTTPRequest {
+	b.hashKey = key
+	return b
+}
+
+// resolveServiceURL looks up the service of a svc://name/path url.
+func (b *HTTPRequest) resolveServiceURL(u *url.URL) error {
+	if u.Scheme != "svc" {
+		b.service = nil
+		return nil
+	}
+	s, ok := LookupService(u.Host)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrServiceNotFound, u.Host)
+	}
+	b.service = s
+	b.serviceURL = u
+	return nil
+}
+
+// pickEndpoint selects the endpoint of b.service for the request and points
+// the request url to it.
+func (b *HTTPRequest) pickEndpoint() (*endpoint, error) {
+	key := b.hashKey
+	if key == "" {
+		key = b.serviceURL.Path
+	}
+	ep, err := b.service.pick(key)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *ep.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + b.serviceURL.Path
+	u.RawPath = ""
+	u.RawQuery = b.serviceURL.RawQuery
+	b.req.URL = &u
+	return ep, nil
+}
+
+// doService sends the request to an endpoint of b.service.
+func (b *HTTPRequest) doService(client *http.Client) (*http.Response, error) {
+	ep, err := b.pickEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(client)
+	b.service.report(ep, err != nil || resp.StatusCode >= 500)
+	if err != nil {
+		atomic.AddInt64(&ep.inFlight, -1)
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, ep: ep}
+	return resp, nil
+}
+
+// inFlightBody ends the in flight request of an endpoint once closed.
+type inFlightBody struct {
+	io.ReadCloser
+	ep   *endpoint
+	once sync.Once
+}
+
+func (r *inFlightBody) Close() error {
+	r.once.Do(func() { atomic.AddInt64(&r.ep.inFlight, -1) })
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,426 @@
+// Package cassette records http interactions to a file and replays them,
+// so code built on the http package can be tested without network.
+//
+//	rec, err := cassette.New("testdata/github.yml", cassette.ModeReplayOrRecord)
+//	defer rec.Stop()
+//	http.HttpGet("https://api.github.com/").SetTransport(rec).String()
+package cassette
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Mode decides whether a Recorder talks to the network.
+type Mode int
+
+const (
+	// ModeReplay only serves recorded interactions.
+	ModeReplay Mode = iota
+	// ModeRecord sends every request and records the interaction.
+	ModeRecord
+	// ModeReplayOrRecord replays when an interaction matches and records otherwise.
+	ModeReplayOrRecord
+)
+
+// Redacted replaces the value of redacted headers.
+const Redacted = "[REDACTED]"
+
+// ErrCassetteNotFound is returned by New in replay mode when the file does not exist.
+var ErrCassetteNotFound = errors.New("cassette: file not found")
+
+// ErrInteractionNotFound is returned in replay mode when no interaction matches a request.
+type ErrInteractionNotFound struct {
+	Method string
+	URL    string
+	Path   string
+}
+
+func (e *ErrInteractionNotFound) Error() string {
+	return fmt.Sprintf("cassette: no interaction recorded in %s for %s %s", e.Path, e.Method, e.URL)
+}
+
+// Request is the recorded part of a http.Request.
+type Request struct {
+	Method       string      `yaml:"method" json:"method"`
+	URL          string      `yaml:"url" json:"url"`
+	Header       http.Header `yaml:"header,omitempty" json:"header,omitempty"`
+	Body         string      `yaml:"body,omitempty" json:"body,omitempty"`
+	BodyEncoding string      `yaml:"body_encoding,omitempty" json:"body_encoding,omitempty"`
+	BodyHash     string      `yaml:"body_hash,omitempty" json:"body_hash,omitempty"`
+}
+
+// Response is the recorded part of a http.Response.
+type Response struct {
+	StatusCode   int         `yaml:"status_code" json:"status_code"`
+	Status       string      `yaml:"status" json:"status"`
+	Proto        string      `yaml:"proto,omitempty" json:"proto,omitempty"`
+	Header       http.Header `yaml:"header,omitempty" json:"header,omitempty"`
+	Body         string      `yaml:"body,omitempty" json:"body,omitempty"`
+	BodyEncoding string      `yaml:"body_encoding,omitempty" json:"body_encoding,omitempty"`
+}
+
+// Interaction is one recorded request and its response.
+type Interaction struct {
+	Request  Request  `yaml:"request" json:"request"`
+	Response Response `yaml:"response" json:"response"`
+}
+
+// Cassette is the content of a cassette file.
+type Cassette struct {
+	Interactions []*Interaction `yaml:"interactions" json:"interactions"`
+}
+
+// Matcher reports whether a recorded interaction answers req.
+// body is the complete request body.
+type Matcher func(req *http.Request, body []byte, i *Interaction) bool
+
+// MatchMethod matches the request method.
+func MatchMethod(req *http.Request, body []byte, i *Interaction) bool {
+	return req.Method == i.Request.Method
+}
+
+// MatchURL matches the complete request url.
+func MatchURL(req *http.Request, body []byte, i *Interaction) bool {
+	return req.URL.String() == i.Request.URL
+}
+
+// MatchBodyHash matches the sha256 of the request body.
+func MatchBodyHash(req *http.Request, body []byte, i *Interaction) bool {
+	return bodyHash(body) == i.Request.BodyHash
+}
+
+// MatchHeaders returns a Matcher comparing the given request headers.
+func MatchHeaders(names ...string) Matcher {
+	return func(req *http.Request, body []byte, i *Interaction) bool {
+		for _, name := range names {
+			if strings.Join(req.Header.Values(name), ",") != strings.Join(i.Request.Header.Values(name), ",") {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DefaultMatchers are used when SetMatchers was not called.
+var DefaultMatchers = []Matcher{MatchMethod, MatchURL}
+
+// Recorder is a http.RoundTripper recording to or replaying from a cassette file.
+type Recorder struct {
+	path      string
+	mode      Mode
+	transport http.RoundTripper
+	matchers  []Matcher
+	redact    []string
+	filters   []func(*Interaction)
+
+	mu       sync.Mutex
+	cassette *Cassette
+	used     map[*Interaction]bool
+	dirty    bool
+}
+
+// New opens the cassette at path, the file format is json for a .json extension
+// and yaml otherwise. In ModeReplay the file must exist.
+func New(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{
+		path:      path,
+		mode:      mode,
+		transport: http.DefaultTransport,
+		matchers:  DefaultMatchers,
+		redact:    []string{"Authorization", "Proxy-Authorization"},
+		cassette:  &Cassette{},
+		used:      map[*Interaction]bool{},
+	}
+	if mode == ModeRecord {
+		return r, nil
+	}
+	c, err := Load(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if mode == ModeReplay {
+				return nil, ErrCassetteNotFound
+			}
+			return r, nil
+		}
+		return nil, err
+	}
+	r.cassette = c
+	return r, nil
+}
+
+// Load reads a cassette file.
+func Load(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if isJSON(path) {
+		err = json.Unmarshal(data, c)
+	} else {
+		err = yaml.Unmarshal(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cassette: %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cassette to path.
+func (c *Cassette) Save(path string) error {
+	var data []byte
+	var err error
+	if isJSON(path) {
+		data, err = json.MarshalIndent(c, "", "  ")
+	} else {
+		data, err = yaml.Marshal(c)
+	}
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func isJSON(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+// SetTransport sets the transport used to record, http.DefaultTransport by default.
+func (r *Recorder) SetTransport(transport http.RoundTripper) *Recorder {
+	r.transport = transport
+	return r
+}
+
+// SetMatchers replaces the matchers an interaction must satisfy to be replayed.
+func (r *Recorder) SetMatchers(matchers ...Matcher) *Recorder {
+	r.matchers = matchers
+	return r
+}
+
+// Redact sets the request and response headers whose values are not written
+// to the cassette. Authorization and Proxy-Authorization are redacted by default.
+func (r *Recorder) Redact(headers ...string) *Recorder {
+	r.redact = headers
+	return r
+}
+
+// AddFilter adds a function that may rewrite an interaction before it is saved,
+// e.g. to scrub tokens from bodies or urls.
+func (r *Recorder) AddFilter(f func(*Interaction)) *Recorder {
+	r.filters = append(r.filters, f)
+	return r
+}
+
+// Cassette returns a copy of the interactions loaded or recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: append([]*Interaction(nil), r.cassette.Interactions...)}
+}
+
+// Stop saves the recorded interactions.
+func (r *Recorder) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	r.dirty = false
+	return r.cassette.Save(r.path)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// the transport gets a clone, req is not modified
+		out := req.Clone(req.Context())
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		out.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		out.ContentLength = int64(len(body))
+		req = out
+	}
+
+	if r.mode != ModeRecord {
+		if i := r.find(req, body); i != nil {
+			return i.Response.toHTTP(req)
+		}
+		if r.mode == ModeReplay {
+			return nil, &ErrInteractionNotFound{Method: req.Method, URL: req.URL.String(), Path: r.path}
+		}
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	i := &Interaction{
+		Request: Request{
+			Method:   req.Method,
+			URL:      req.URL.String(),
+			Header:   r.redactHeader(req.Header),
+			BodyHash: bodyHash(body),
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Proto:      resp.Proto,
+			Header:     r.redactHeader(resp.Header),
+		},
+	}
+	i.Request.Body, i.Request.BodyEncoding = encodeBody(body)
+	i.Response.Body, i.Response.BodyEncoding = encodeBody(respBody)
+	for _, f := range r.filters {
+		f(i)
+	}
+
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+	r.used[i] = true
+	r.dirty = true
+	r.mu.Unlock()
+	return resp, nil
+}
+
+// find returns the first matching interaction not replayed yet, falling back
+// to the last matching one so repeated requests can be served.
+func (r *Recorder) find(req *http.Request, body []byte) *Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last *Interaction
+	for _, i := range r.cassette.Interactions {
+		if !r.match(req, body, i) {
+			continue
+		}
+		if !r.used[i] {
+			r.used[i] = true
+			return i
+		}
+		last = i
+	}
+	return last
+}
+
+func (r *Recorder) match(req *http.Request, body []byte, i *Interaction) bool {
+	for _, m := range r.matchers {
+		if !m(req, body, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Recorder) redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range r.redact {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, Redacted)
+		}
+	}
+	return h
+}
+
+func (resp *Response) toHTTP(req *http.Request) (*http.Response, error) {
+	body, err := decodeBody(resp.Body, resp.BodyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, _ := http.ParseHTTPVersion(proto)
+	return &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        resp.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// readBody returns the request body, read from GetBody when set. req.Body is
+// closed as a RoundTripper must do but left in place.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	rc := req.Body
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer b.Close()
+		rc = b
+	}
+	body, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func bodyHash(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(body), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(body)
+	default:
+		return nil, fmt.Errorf("cassette: unknown body encoding %q", encoding)
+	}
+}
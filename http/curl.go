@@ -0,0 +1,597 @@
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// ToCurl returns a curl command sending the same request, with the headers,
+// body, basic auth, cookies, insecure tls and proxy settings. The arguments
+// are quoted for POSIX shells, bytes that are not printable use $'...'.
+// A svc:// url is replaced by the url of the endpoint the service picks.
+// The request is not modified and can still be changed and sent afterwards.
+func (b *HTTPRequest) ToCurl() (string, error) {
+	c := *b
+	c.req = b.req.Clone(b.req.Context())
+	if b.req.GetBody == nil {
+		// a body readable only once is put back into both requests
+		data, err := peekBody(b.req)
+		if err != nil {
+			return "", err
+		}
+		if data != nil {
+			c.req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		}
+	}
+	return c.curl()
+}
+
+// curl builds the curl command, it prepares b.
+func (b *HTTPRequest) curl() (string, error) {
+	var args []string
+	add := func(a ...string) { args = append(args, a...) }
+
+	rawurl := b.url
+	var body []byte
+	if len(b.files) > 0 {
+		// preparing would start streaming the files
+		for _, name := range sortedKeys(b.params) {
+			for _, v := range b.params[name] {
+				add("-F", name+"="+v)
+			}
+		}
+		names := make([]string, 0, len(b.files))
+		for name := range b.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add("-F", name+"=@"+b.files[name])
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", err
+		}
+		if err = b.resolveServiceURL(u); err != nil {
+			return "", err
+		}
+	} else {
+		if err := b.prepare(); err != nil {
+			return "", err
+		}
+		rawurl = b.req.URL.String()
+		data, err := peekBody(b.req)
+		if err != nil {
+			return "", err
+		}
+		if bytes.IndexByte(data, 0) >= 0 {
+			return "", errors.New("http: curl can not send a body with NUL bytes in an argument")
+		}
+		body = data
+	}
+	if b.service != nil {
+		ep, err := b.pickEndpoint()
+		if err != nil {
+			return "", err
+		}
+		// the command is not a request in flight
+		atomic.AddInt64(&ep.inFlight, -1)
+		rawurl = b.req.URL.String()
+	}
+
+	switch method := b.req.Method; {
+	case method == "HEAD":
+		add("-I")
+	case method == "GET" && body == nil, method == "POST" && (body != nil || len(b.files) > 0):
+	default:
+		add("-X", method)
+	}
+
+	header := b.req.Header.Clone()
+	if b.req.Host != "" {
+		header.Set("Host", b.req.Host)
+	}
+	if user, pass, ok := b.req.BasicAuth(); ok {
+		add("-u", user+":"+pass)
+		header.Del("Authorization")
+	}
+	ua := header.Get("User-Agent")
+	if ua == "" {
+		ua = b.setting.UserAgent
+	}
+	if ua != "" {
+		add("-A", ua)
+		header.Del("User-Agent")
+	}
+	cookies := header.Values("Cookie")
+	header.Del("Cookie")
+	if b.setting.EnableCookie && defaultCookieJar != nil && b.req.URL != nil {
+		for _, c := range defaultCookieJar.Cookies(b.req.URL) {
+			cookies = append(cookies, c.String())
+		}
+	}
+	if len(cookies) > 0 {
+		add("-b", strings.Join(cookies, "; "))
+	}
+	for _, name := range sortedKeys(header) {
+		for _, v := range header[name] {
+			add("-H", name+": "+v)
+		}
+	}
+	if body != nil {
+		add("--data-binary", string(body))
+	}
+
+	host := ""
+	if b.req.URL != nil {
+		host = b.req.URL.Hostname()
+	}
+	if config := b.tlsConfig(host); config != nil && config.InsecureSkipVerify {
+		add("-k")
+	}
+	if b.setting.Proxy != nil && b.req.URL != nil {
+		proxy, err := b.setting.Proxy(b.req)
+		if err != nil {
+			return "", err
+		}
+		if proxy != nil {
+			add("-x", proxy.String())
+		}
+	}
+	if b.setting.UnixSocket != "" {
+		add("--unix-socket", b.setting.UnixSocket)
+	}
+	add(rawurl)
+
+	var buf strings.Builder
+	buf.WriteString("curl")
+	for _, a := range args {
+		buf.WriteByte(' ')
+		buf.WriteString(shellQuote(a))
+	}
+	return buf.String(), nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe, printable := true, utf8.ValidString(s)
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("@%+=:,./-_", r):
+		case r < ' ' || r == 0x7f:
+			safe, printable = false, false
+		default:
+			safe = false
+		}
+	}
+	if safe {
+		return s
+	}
+	if printable {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	var buf strings.Builder
+	buf.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c == '\'' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
+
+// FromCurl parses a curl command line into a request. It understands -X, -H,
+// -d/--data/--data-raw/--data-binary/--data-urlencode, -F, -G, -u, -b, -k,
+// -x, -A, -e, -I, --url and --unix-socket, and ignores flags that only change
+// curl's output such as -s, -v, -L and --compressed. Other flags are an error.
+func FromCurl(cmd string) (*HTTPRequest, error) {
+	args, err := splitShell(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 && (args[0] == "curl" || strings.HasSuffix(args[0], "/curl")) {
+		args = args[1:]
+	}
+
+	var (
+		method, rawurl, user, proxy, socket string
+		header                              = http.Header{}
+		data, forms                         []string
+		dataSet, get, head, insecure        bool
+	)
+	setURL := func(u string) error {
+		if rawurl != "" {
+			return errors.New("http: curl command with more than one url")
+		}
+		rawurl = u
+		return nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "" || arg[0] != '-' || arg == "-" {
+			if err = setURL(arg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// split the option and its value: --name=value, -Xvalue, -sSL
+		var names []string
+		var attached string
+		hasAttached := false
+		if strings.HasPrefix(arg, "--") {
+			name := arg
+			if j := strings.IndexByte(arg, '='); j > 0 {
+				name, attached, hasAttached = arg[:j], arg[j+1:], true
+			}
+			names = []string{name}
+		} else {
+			for j := 1; j < len(arg); j++ {
+				name := "-" + arg[j:j+1]
+				names = append(names, name)
+				if curlValueFlags[name] && j+1 < len(arg) {
+					attached, hasAttached = arg[j+1:], true
+					break
+				}
+			}
+		}
+
+		for _, name := range names {
+			if name == "--" {
+				continue
+			}
+			var value string
+			if curlValueFlags[name] {
+				switch {
+				case hasAttached:
+					value = attached
+				case i+1 < len(args):
+					i++
+					value = args[i]
+				default:
+					return nil, fmt.Errorf("http: curl option %s needs a value", name)
+				}
+			} else if hasAttached {
+				return nil, fmt.Errorf("http: curl option %s takes no value", name)
+			}
+
+			switch name {
+			case "-X", "--request":
+				method = strings.ToUpper(value)
+			case "-H", "--header":
+				k, v, ok := strings.Cut(value, ":")
+				if !ok {
+					return nil, fmt.Errorf("http: invalid curl header %q", value)
+				}
+				header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+			case "-d", "--data", "--data-ascii", "--data-raw", "--data-binary", "--data-urlencode":
+				d, err := curlData(name, value)
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, d)
+				dataSet = true
+			case "-F", "--form":
+				forms = append(forms, value)
+			case "-G", "--get":
+				get = true
+			case "-I", "--head":
+				head = true
+			case "-u", "--user":
+				user = value
+			case "-b", "--cookie":
+				if !strings.Contains(value, "=") {
+					return nil, fmt.Errorf("http: curl cookie files are not supported: %s", value)
+				}
+				header.Add("Cookie", value)
+			case "-k", "--insecure":
+				insecure = true
+			case "-x", "--proxy":
+				proxy = value
+			case "-A", "--user-agent":
+				header.Set("User-Agent", value)
+			case "-e", "--referer":
+				header.Set("Referer", value)
+			case "--url":
+				if err = setURL(value); err != nil {
+					return nil, err
+				}
+			case "--unix-socket":
+				socket = value
+			case "-L", "--location", "-s", "--silent", "-S", "--show-error", "-v", "--verbose",
+				"-i", "--include", "--compressed", "-f", "--fail", "-N", "--no-buffer":
+			default:
+				return nil, fmt.Errorf("http: unsupported curl option %s", name)
+			}
+		}
+	}
+
+	if rawurl == "" {
+		return nil, errors.New("http: curl command without url")
+	}
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "http://" + rawurl
+	}
+	body := strings.Join(data, "&")
+	if get && dataSet {
+		if strings.Contains(rawurl, "?") {
+			rawurl += "&" + body
+		} else {
+			rawurl += "?" + body
+		}
+		dataSet = false
+	}
+	switch {
+	case method != "":
+	case head:
+		method = "HEAD"
+	case dataSet || len(forms) > 0:
+		method = "POST"
+	default:
+		method = "GET"
+	}
+
+	b := NewRequest(rawurl, method)
+	for k, v := range header {
+		b.req.Header[k] = v
+	}
+	if host := header.Get("Host"); host != "" {
+		b.SetHost(host)
+		b.req.Header.Del("Host")
+	}
+	if dataSet {
+		if b.req.Header.Get("Content-Type") == "" {
+			b.req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		b.Body(body)
+	}
+	for _, f := range forms {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("http: invalid curl form %q", f)
+		}
+		if strings.HasPrefix(v, "@") {
+			b.PostFile(k, v[1:])
+		} else {
+			b.Param(k, v)
+		}
+	}
+	if user != "" {
+		name, pass, _ := strings.Cut(user, ":")
+		b.req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(name+":"+pass)))
+	}
+	if insecure {
+		b.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	}
+	if proxy != "" {
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		b.SetProxy(http.ProxyURL(u))
+	}
+	if socket != "" {
+		b.SetUnixSocket(socket)
+	}
+	return b, nil
+}
+
+// curlValueFlags are the curl options followed by a value.
+var curlValueFlags = map[string]bool{
+	"-X": true, "--request": true,
+	"-H": true, "--header": true,
+	"-d": true, "--data": true, "--data-ascii": true, "--data-raw": true, "--data-binary": true, "--data-urlencode": true,
+	"-F": true, "--form": true,
+	"-u": true, "--user": true,
+	"-b": true, "--cookie": true,
+	"-x": true, "--proxy": true,
+	"-A": true, "--user-agent": true,
+	"-e": true, "--referer": true,
+	"--url": true, "--unix-socket": true,
+}
+
+// curlData returns the data sent by one of the curl data options.
+func curlData(name, value string) (string, error) {
+	switch name {
+	case "--data-raw":
+		return value, nil
+	case "--data-urlencode":
+		if k, v, ok := strings.Cut(value, "="); ok {
+			if k == "" {
+				return url.QueryEscape(v), nil
+			}
+			return k + "=" + url.QueryEscape(v), nil
+		}
+		if k, file, ok := strings.Cut(value, "@"); ok {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			if k == "" {
+				return url.QueryEscape(string(content)), nil
+			}
+			return k + "=" + url.QueryEscape(string(content)), nil
+		}
+		return url.QueryEscape(value), nil
+	}
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	content, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", err
+	}
+	if name == "--data-binary" {
+		return string(content), nil
+	}
+	// -d strips the newlines of files
+	return strings.NewReplacer("\r", "", "\n", "").Replace(string(content)), nil
+}
+
+// splitShell splits a command line like a POSIX shell, with single and double
+// quotes, backslash escapes, $'...' strings and line continuations.
+func splitShell(s string) ([]string, error) {
+	var (
+		args  []string
+		cur   strings.Builder
+		inArg bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		case c == '\\':
+			i++
+			if i >= len(s) {
+				return nil, errors.New("http: trailing backslash in command")
+			}
+			if s[i] == '\n' {
+				continue
+			}
+			if s[i] == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+				i++
+				continue
+			}
+			cur.WriteByte(s[i])
+			inArg = true
+		case c == '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, errors.New("http: unterminated quote in command")
+			}
+			cur.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+			inArg = true
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			n, err := ansiQuoted(s[i+2:], &cur)
+			if err != nil {
+				return nil, err
+			}
+			i += n + 2
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				cur.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("http: unterminated quote in command")
+			}
+			inArg = true
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// ansiQuoted decodes the body of a $'...' string into buf and returns the
+// index of its closing quote.
+func ansiQuoted(s string, buf *strings.Builder) (int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' {
+			return i, nil
+		}
+		if c != '\\' || i+1 >= len(s) {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch e := s[i]; e {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'e', 'E':
+			buf.WriteByte(0x1b)
+		case 'x':
+			var v byte
+			n := 0
+			for ; n < 2 && i+1 < len(s); n++ {
+				d := unhex(s[i+1])
+				if d < 0 {
+					break
+				}
+				v = v<<4 | byte(d)
+				i++
+			}
+			if n == 0 {
+				buf.WriteString(`\x`)
+				continue
+			}
+			buf.WriteByte(v)
+		default:
+			buf.WriteByte(e)
+		}
+	}
+	return 0, errors.New("http: unterminated quote in command")
+}
+
+func unhex(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+)
+
+// MaxErrorBodySize is the number of body bytes kept in HTTPError.Body.
+var MaxErrorBodySize = 512
+
+// HTTPError is returned when a response status is not accepted by ExpectStatus.
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte // truncated to MaxErrorBodySize
+
+	raw []byte
+}
+
+func newHTTPError(req *http.Request, resp *http.Response, body []byte) *HTTPError {
+	e := &HTTPError{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Body:       body,
+		raw:        body,
+	}
+	if len(body) > MaxErrorBodySize {
+		e.Body = body[:MaxErrorBodySize]
+	}
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	status := e.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.URL, status)
+	}
+	body := string(e.Body)
+	if len(e.raw) > len(e.Body) {
+		body += "..."
+	}
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.URL, status, body)
+}
+
+// JSON decodes the complete error payload as json into v.
+func (e *HTTPError) JSON(v interface{}) error {
+	return json.Unmarshal(e.raw, v)
+}
+
+// XML decodes the complete error payload as xml into v.
+func (e *HTTPError) XML(v interface{}) error {
+	return xml.Unmarshal(e.raw, v)
+}
+
+// ExpectStatus makes String, Bytes, ToFile and the To* decoders return an
+// *HTTPError when the response status is not one of codes.
+// Without codes every 2xx status is accepted.
+func (b *HTTPRequest) ExpectStatus(codes ...int) *HTTPRequest {
+	b.expect = codes
+	b.expectStatus = true
+	return b
+}
+
+// ErrorResult sets the value the payload of a rejected response is decoded into as json.
+// It implies ExpectStatus() when no status expectation was set.
+func (b *HTTPRequest) ErrorResult(v interface{}) *HTTPRequest {
+	b.errorResult = v
+	if !b.expectStatus {
+		b.ExpectStatus()
+	}
+	return b
+}
+
+func (b *HTTPRequest) statusAccepted(code int) bool {
+	if !b.expectStatus {
+		return true
+	}
+	if len(b.expect) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range b.expect {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStatus returns an *HTTPError when the response status is rejected.
+func (b *HTTPRequest) checkStatus(body []byte) error {
+	if b.statusAccepted(b.resp.StatusCode) {
+		return nil
+	}
+	if b.errorResult != nil && len(body) > 0 {
+		// the payload is best effort, the status is what failed
+		_ = json.Unmarshal(body, b.errorResult)
+	}
+	return newHTTPError(b.req, b.resp, body)
+}
@@ -3,6 +3,7 @@ package http
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
@@ -105,13 +106,19 @@ type HTTPSettings struct {
 	ConnectTimeout   time.Duration
 	ReadWriteTimeout time.Duration
 	TLSClientConfig  *tls.Config
+	TLSHostConfig    map[string]*tls.Config // tls settings by host, overriding TLSClientConfig
 	Proxy            func(*http.Request) (*url.URL, error)
 	Transport        http.RoundTripper
+	DialContext      func(ctx context.Context, network, addr string) (net.Conn, error)
+	UnixSocket       string          // path of a unix domain socket to send requests over
+	Protocols        *http.Protocols // nil negotiates HTTP/1.1 or HTTP/2
 	CheckRedirect    func(req *http.Request, via []*http.Request) error
 	EnableCookie     bool
 	Gzip             bool
 	DumpBody         bool
 	Retries          int // if set to -1 means will retry forever
+	Auth             AuthProvider
+	Tracer           Tracer
 }
 
 // HTTPRequest provides more useful methods for requesting one url than http.Request.
@@ -124,6 +131,18 @@ type HTTPRequest struct {
 	resp    *http.Response
 	body    []byte
 	dump    []byte
+
+	prepared bool
+
+	expect       []int
+	expectStatus bool
+	errorResult  interface{}
+
+	service    *Service
+	serviceURL *url.URL
+	hashKey    string
+
+	timer *reqTimer
 }
 
 // GetRequest return the request object
@@ -206,19 +225,34 @@ func (b *HTTPRequest) SetHost(host string) *HTTPRequest {
 	return b
 }
 
-// SetProtocolVersion Set the protocol version for incoming requests.
-// Client requests always use HTTP/1.1.
+// SetProtocolVersion Set the protocol version used by the request.
+// "HTTP/2" (or "h2") forces HTTP/2 over tls, "h2c" forces HTTP/2 over cleartext
+// with prior knowledge and "HTTP/1.1" disables HTTP/2.
+// By default HTTP/2 is negotiated over tls when the server supports it.
 func (b *HTTPRequest) SetProtocolVersion(vers string) *HTTPRequest {
 	if len(vers) == 0 {
 		vers = "HTTP/1.1"
 	}
 
-	major, minor, ok := http.ParseHTTPVersion(vers)
-	if ok {
+	var protocols http.Protocols
+	switch strings.ToLower(vers) {
+	case "http/2", "http/2.0", "h2":
+		protocols.SetHTTP2(true)
+		b.req.Proto, b.req.ProtoMajor, b.req.ProtoMinor = "HTTP/2.0", 2, 0
+	case "h2c":
+		protocols.SetUnencryptedHTTP2(true)
+		b.req.Proto, b.req.ProtoMajor, b.req.ProtoMinor = "HTTP/2.0", 2, 0
+	default:
+		major, minor, ok := http.ParseHTTPVersion(vers)
+		if !ok {
+			return b
+		}
+		protocols.SetHTTP1(true)
 		b.req.Proto = vers
 		b.req.ProtoMajor = major
 		b.req.ProtoMinor = minor
 	}
+	b.setting.Protocols = &protocols
 
 	return b
 }
@@ -278,17 +312,39 @@ func (b *HTTPRequest) PostFile(formname, filename string) *HTTPRequest {
 func (b *HTTPRequest) Body(data interface{}) *HTTPRequest {
 	switch t := data.(type) {
 	case string:
-		bf := bytes.NewBufferString(t)
-		b.req.Body = ioutil.NopCloser(bf)
-		b.req.ContentLength = int64(len(t))
+		b.setBody([]byte(t))
 	case []byte:
-		bf := bytes.NewBuffer(t)
-		b.req.Body = ioutil.NopCloser(bf)
-		b.req.ContentLength = int64(len(t))
+		b.setBody(t)
 	}
 	return b
 }
 
+// setBody sets a body that can be sent again on retries.
+func (b *HTTPRequest) setBody(data []byte) {
+	b.req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	b.req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	b.req.ContentLength = int64(len(data))
+}
+
+// rewindBody restores the request body before sending it again.
+// It reports false when the body can not be restored.
+func (b *HTTPRequest) rewindBody() bool {
+	if b.req.Body == nil || b.req.Body == http.NoBody {
+		return true
+	}
+	if b.req.GetBody == nil {
+		return false
+	}
+	body, err := b.req.GetBody()
+	if err != nil {
+		return false
+	}
+	b.req.Body = body
+	return true
+}
+
 // XMLBody adds request raw body encoding by XML.
 func (b *HTTPRequest) XMLBody(obj interface{}) (*HTTPRequest, error) {
 	if b.req.Body == nil && obj != nil {
@@ -296,8 +352,7 @@ func (b *HTTPRequest) XMLBody(obj interface{}) (*HTTPRequest, error) {
 		if err != nil {
 			return b, err
 		}
-		b.req.Body = ioutil.NopCloser(bytes.NewReader(byts))
-		b.req.ContentLength = int64(len(byts))
+		b.setBody(byts)
 		b.req.Header.Set("Content-Type", "application/xml")
 	}
 	return b, nil
@@ -310,8 +365,7 @@ func (b *HTTPRequest) YAMLBody(obj interface{}) (*HTTPRequest, error) {
 		if err != nil {
 			return b, err
 		}
-		b.req.Body = ioutil.NopCloser(bytes.NewReader(byts))
-		b.req.ContentLength = int64(len(byts))
+		b.setBody(byts)
 		b.req.Header.Set("Content-Type", "application/x+yaml")
 	}
 	return b, nil
@@ -324,8 +378,7 @@ func (b *HTTPRequest) JSONBody(obj interface{}) (*HTTPRequest, error) {
 		if err != nil {
 			return b, err
 		}
-		b.req.Body = ioutil.NopCloser(bytes.NewReader(byts))
-		b.req.ContentLength = int64(len(byts))
+		b.setBody(byts)
 		b.req.Header.Set("Content-Type", "application/json")
 	}
 	return b, nil
@@ -400,6 +453,48 @@ func (b *HTTPRequest) getResponse() (*http.Response, error) {
 
 // DoRequest will do the client.Do
 func (b *HTTPRequest) DoRequest() (resp *http.Response, err error) {
+	if err = b.prepare(); err != nil {
+		return nil, err
+	}
+	client, oneOff := b.client()
+	if oneOff != nil {
+		defer func() { closeOneOff(oneOff, resp, err) }()
+	}
+
+	if b.setting.ShowDebug {
+		dump, err := httputil.DumpRequest(b.req, b.setting.DumpBody)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		b.dump = dump
+	}
+	// retries default value is 0, it will run once.
+	// retries equal to -1, it will run forever until success
+	// retries is setted, it will retries fixed times.
+	for i := 0; b.setting.Retries == -1 || i <= b.setting.Retries; i++ {
+		if i > 0 && !b.rewindBody() {
+			break
+		}
+		timer := b.startTimer()
+		if b.service != nil {
+			// every attempt picks an endpoint again
+			resp, err = b.doService(client)
+		} else {
+			resp, err = b.do(client)
+		}
+		timer.finish(resp, err)
+		if err == nil {
+			break
+		}
+	}
+	return resp, err
+}
+
+// prepare builds the url and the body from the params once.
+func (b *HTTPRequest) prepare() error {
+	if b.prepared {
+		return nil
+	}
 	var paramBody string
 	if len(b.params) > 0 {
 		var buf bytes.Buffer
@@ -418,33 +513,33 @@ func (b *HTTPRequest) DoRequest() (resp *http.Response, err error) {
 	b.buildURL(paramBody)
 	urlParsed, err := url.Parse(b.url)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	b.req.URL = urlParsed
+	b.req.URL = b.resolveUnixURL(urlParsed)
+	if err = b.resolveServiceURL(b.req.URL); err != nil {
+		return err
+	}
+	b.prepared = true
+	return nil
+}
 
+// client creates the http.Client for the request settings, oneOff is the
+// transport whose connections are closed after the response.
+func (b *HTTPRequest) client() (_ *http.Client, oneOff *http.Transport) {
 	trans := b.setting.Transport
 
 	if trans == nil {
 		// create default transport
-		trans = &http.Transport{
-			TLSClientConfig:     b.setting.TLSClientConfig,
-			Proxy:               b.setting.Proxy,
-			Dial:                TimeoutDialer(b.setting.ConnectTimeout, b.setting.ReadWriteTimeout),
-			MaxIdleConnsPerHost: 100,
-		}
+		trans = b.newTransport()
 	} else {
 		// if b.transport is *http.Transport then set the settings.
 		if t, ok := trans.(*http.Transport); ok {
-			if t.TLSClientConfig == nil {
-				t.TLSClientConfig = b.setting.TLSClientConfig
-			}
-			if t.Proxy == nil {
-				t.Proxy = b.setting.Proxy
-			}
-			if t.Dial == nil {
-				t.Dial = TimeoutDialer(b.setting.ConnectTimeout, b.setting.ReadWriteTimeout)
+			filled, single := b.configureTransport(t)
+			if single {
+				oneOff = filled
 			}
+			trans = filled
 		}
 	}
 
@@ -468,24 +563,7 @@ func (b *HTTPRequest) DoRequest() (resp *http.Response, err error) {
 	if b.setting.CheckRedirect != nil {
 		client.CheckRedirect = b.setting.CheckRedirect
 	}
-
-	if b.setting.ShowDebug {
-		dump, err := httputil.DumpRequest(b.req, b.setting.DumpBody)
-		if err != nil {
-			log.Println(err.Error())
-		}
-		b.dump = dump
-	}
-	// retries default value is 0, it will run once.
-	// retries equal to -1, it will run forever until success
-	// retries is setted, it will retries fixed times.
-	for i := 0; b.setting.Retries == -1 || i <= b.setting.Retries; i++ {
-		resp, err = client.Do(b.req)
-		if err == nil {
-			break
-		}
-	}
-	return resp, err
+	return client, oneOff
 }
 
 // String returns the body string in response.
@@ -503,6 +581,9 @@ func (b *HTTPRequest) String() (string, error) {
 // it calls Response inner.
 func (b *HTTPRequest) Bytes() ([]byte, error) {
 	if b.body != nil {
+		if err := b.checkStatus(b.body); err != nil {
+			return nil, err
+		}
 		return b.body, nil
 	}
 	resp, err := b.getResponse()
@@ -510,7 +591,7 @@ func (b *HTTPRequest) Bytes() ([]byte, error) {
 		return nil, err
 	}
 	if resp.Body == nil {
-		return nil, nil
+		return nil, b.checkStatus(nil)
 	}
 	defer resp.Body.Close()
 	if b.setting.Gzip && resp.Header.Get("Content-Encoding") == "gzip" {
@@ -519,25 +600,37 @@ func (b *HTTPRequest) Bytes() ([]byte, error) {
 			return nil, err
 		}
 		b.body, err = ioutil.ReadAll(reader)
-		return b.body, err
+	} else {
+		b.body, err = ioutil.ReadAll(resp.Body)
 	}
-	b.body, err = ioutil.ReadAll(resp.Body)
-	return b.body, err
+	if err != nil {
+		return nil, err
+	}
+	if err = b.checkStatus(b.body); err != nil {
+		return nil, err
+	}
+	return b.body, nil
 }
 
 // ToFile saves the body data in response to one file.
 // it calls Response inner.
 func (b *HTTPRequest) ToFile(filename string) error {
-	f, err := os.Create(filename)
+	resp, err := b.getResponse()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if !b.statusAccepted(resp.StatusCode) {
+		// read the payload into the error instead of the file
+		_, err = b.Bytes()
+		return err
+	}
 
-	resp, err := b.getResponse()
+	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
 	if resp.Body == nil {
 		return nil
 	}
@@ -582,6 +675,8 @@ func (b *HTTPRequest) Response() (*http.Response, error) {
 }
 
 // TimeoutDialer returns functions of connection dialer with timeout settings for http.Transport Dial field.
+//
+// Deprecated: use TimeoutDialContext.
 func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
 	return func(netw, addr string) (net.Conn, error) {
 		conn, err := net.DialTimeout(netw, addr, cTimeout)
@@ -595,40 +690,31 @@ func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, ad
 
 //  add
 
-func HttpPostJson(url string, json string) (statusCode int, body []byte) {
-	jsonStr := []byte(json)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+// HttpPostJson posts the json string to url and returns the response status and body.
+func HttpPostJson(url string, json string) (statusCode int, body []byte, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(json))
+	if err != nil {
+		return 0, nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		println(err.Error())
-		return
-		// handle error
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
-	if resp != nil {
-		statusCode = resp.StatusCode
-		//head := resp.Header
-		body, _ = ioutil.ReadAll(resp.Body)
-	}
-	return
+	body, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
 }
 
-func HttpJsonPost(url string, jsonBody string, header map[string]string) []byte {
-	req := HttpPost(url)
+// HttpJsonPost posts jsonBody to url with the extra headers and returns the response body.
+// A non-2xx response is returned as *HTTPError.
+func HttpJsonPost(url string, jsonBody string, header map[string]string) ([]byte, error) {
+	req := HttpPost(url).ExpectStatus()
 	req.Body(jsonBody)
 	for k, v := range header {
 		req.Header(k, v)
 	}
-	resp, err := req.Response()
-	if err != nil {
-		println(err.Error())
-		return nil
-	}
-
-	body, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	return body
+	return req.Bytes()
 }
@@ -0,0 +1,463 @@
+// Package httpcache provides a private http cache as a http.RoundTripper.
+// It honors Cache-Control (max-age, no-store, no-cache, must-revalidate and
+// the max-stale of requests), Expires and Vary and revalidates stale entries
+// with If-None-Match and If-Modified-Since. Responses varying by request
+// headers are kept side by side, one per set of header values.
+//
+//	t := httpcache.NewTransport(httpcache.NewMemoryStorage(cache.New(time.Hour, 10*time.Minute)))
+//	http.HttpGet(url).SetTransport(t).String()
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carmel/go-util/cache"
+)
+
+// XCache is the response header carrying the Status of a response.
+const XCache = "X-Cache"
+
+// Status describes how a response was served.
+type Status string
+
+const (
+	// Miss is a response fetched from the origin.
+	Miss Status = "MISS"
+	// Hit is a fresh response served from the cache.
+	Hit Status = "HIT"
+	// Revalidated is a stored response confirmed by a 304 from the origin.
+	Revalidated Status = "REVALIDATED"
+)
+
+// CacheStatus returns the Status of a response returned by Transport.
+func CacheStatus(resp *http.Response) Status {
+	return Status(resp.Header.Get(XCache))
+}
+
+// Storage stores serialized cache entries.
+type Storage interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, data []byte)
+	Delete(key string)
+}
+
+type memoryStorage struct {
+	c *cache.Cache
+}
+
+// NewMemoryStorage returns a Storage keeping entries in c with its default expiration.
+func NewMemoryStorage(c *cache.Cache) Storage {
+	return &memoryStorage{c: c}
+}
+
+func (s *memoryStorage) Get(key string) ([]byte, bool) {
+	v, ok := s.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	data, ok := v.([]byte)
+	return data, ok
+}
+
+func (s *memoryStorage) Set(key string, data []byte) {
+	s.c.SetDefault(key, data)
+}
+
+func (s *memoryStorage) Delete(key string) {
+	s.c.Delete(key)
+}
+
+type diskStorage struct {
+	dir string
+}
+
+// NewDiskStorage returns a Storage keeping one file per entry in dir.
+func NewDiskStorage(dir string) Storage {
+	return &diskStorage{dir: dir}
+}
+
+func (s *diskStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *diskStorage) Get(key string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(s.path(key))
+	return data, err == nil
+}
+
+func (s *diskStorage) Set(key string, data []byte) {
+	if os.MkdirAll(s.dir, 0755) != nil {
+		return
+	}
+	// write and rename so readers never see half an entry
+	tmp := s.path(key) + ".tmp"
+	if ioutil.WriteFile(tmp, data, 0644) == nil {
+		os.Rename(tmp, s.path(key))
+	}
+}
+
+func (s *diskStorage) Delete(key string) {
+	os.Remove(s.path(key))
+}
+
+// entry is a cached response.
+type entry struct {
+	Response []byte            // the response as dumped by httputil.DumpResponse
+	Vary     map[string]string // request header values named by Vary
+	Stored   int64             // unix nano time the response was received
+}
+
+// maxVariants limits the responses kept for one url.
+const maxVariants = 8
+
+// variants is what gets stored for a url, the responses for different
+// values of the request headers named by Vary, the latest last.
+type variants struct {
+	Entries []*entry
+}
+
+// find returns the latest entry matching the Vary headers of req.
+func (v *variants) find(req *http.Request) *entry {
+	for i := len(v.Entries) - 1; i >= 0; i-- {
+		if v.Entries[i].matchVary(req) {
+			return v.Entries[i]
+		}
+	}
+	return nil
+}
+
+// remove drops the entries matching the Vary headers of req.
+func (v *variants) remove(req *http.Request) {
+	entries := v.Entries[:0]
+	for _, e := range v.Entries {
+		if !e.matchVary(req) {
+			entries = append(entries, e)
+		}
+	}
+	v.Entries = entries
+}
+
+// put replaces the entries matching the Vary headers of req with e.
+func (v *variants) put(req *http.Request, e *entry) {
+	v.remove(req)
+	v.Entries = append(v.Entries, e)
+	if n := len(v.Entries) - maxVariants; n > 0 {
+		v.Entries = v.Entries[n:]
+	}
+}
+
+// Transport is a private caching http.RoundTripper.
+type Transport struct {
+	// Transport sends the requests, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+	Storage   Storage
+	// Now returns the current time, time.Now when nil.
+	Now func() time.Time
+}
+
+// NewTransport returns a Transport storing responses in s.
+func NewTransport(s Storage) *Transport {
+	return &Transport{Storage: s}
+}
+
+func (t *Transport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *Transport) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// load returns the variants stored for key, empty when there are none.
+func (t *Transport) load(key string) *variants {
+	v := &variants{}
+	if data, ok := t.Storage.Get(key); ok {
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(v) != nil {
+			return &variants{}
+		}
+	}
+	return v
+}
+
+// save stores the variants for key, deleting key when there are none.
+func (t *Transport) save(key string, v *variants) {
+	if len(v.Entries) == 0 {
+		t.Storage.Delete(key)
+		return
+	}
+	var buf bytes.Buffer
+	if gob.NewEncoder(&buf).Encode(v) == nil {
+		t.Storage.Set(key, buf.Bytes())
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp, err := t.transport().RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			// unsafe methods invalidate the stored response (RFC 9111 4.4)
+			t.Storage.Delete("GET " + req.URL.String())
+			t.Storage.Delete("HEAD " + req.URL.String())
+		}
+		return resp, err
+	}
+
+	key := cacheKey(req)
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		t.Storage.Delete(key)
+		return t.transport().RoundTrip(req)
+	}
+
+	var (
+		stored *entry
+		cached *http.Response
+	)
+	vs := t.load(key)
+	if e := vs.find(req); e != nil {
+		if resp, err := e.response(req); err == nil {
+			stored, cached = e, resp
+		}
+	}
+
+	if cached != nil {
+		_, noCache := reqCC["no-cache"]
+		if !noCache && t.fresh(stored, cached, reqCC) {
+			cached.Header.Set(XCache, string(Hit))
+			return cached, nil
+		}
+		req = revalidation(req, cached.Header)
+	}
+
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		// update the stored headers with the ones sent along the 304 (RFC 9111 4.3.4)
+		for k, v := range resp.Header {
+			cached.Header[k] = v
+		}
+		body, err := ioutil.ReadAll(cached.Body)
+		cached.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		cached.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if e, err := t.store(req, cached); err == nil {
+			vs.put(req, e)
+			t.save(key, vs)
+		}
+		cached.Body = ioutil.NopCloser(bytes.NewReader(body))
+		cached.Header.Set(XCache, string(Revalidated))
+		return cached, nil
+	}
+	if cached != nil {
+		cached.Body.Close()
+	}
+
+	if storable(req, resp) {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if e, err := t.store(req, resp); err == nil {
+			vs.put(req, e)
+			t.save(key, vs)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	} else {
+		vs.remove(req)
+		t.save(key, vs)
+	}
+	resp.Header.Set(XCache, string(Miss))
+	return resp, nil
+}
+
+// store returns the entry for resp, it consumes resp.Body.
+func (t *Transport) store(req *http.Request, resp *http.Response) (*entry, error) {
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{Response: dump, Stored: t.now().UnixNano()}
+	for _, name := range varyHeaders(resp.Header) {
+		if e.Vary == nil {
+			e.Vary = map[string]string{}
+		}
+		e.Vary[name] = strings.Join(req.Header.Values(name), ",")
+	}
+	return e, nil
+}
+
+func (e *entry) response(req *http.Request) (*http.Response, error) {
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(e.Response)), req)
+}
+
+func (e *entry) matchVary(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if name == "*" || strings.Join(req.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// fresh reports whether the stored response can be served without revalidation.
+// A stale response is served when the request accepts it with max-stale,
+// unless the response requires revalidation with must-revalidate (RFC 9111 4.2.4).
+func (t *Transport) fresh(e *entry, resp *http.Response, reqCC map[string]string) bool {
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+	lifetime, ok := freshnessLifetime(resp.Header, cc)
+	if !ok {
+		return false
+	}
+	age := currentAge(e, resp.Header, t.now())
+	if age < lifetime {
+		return true
+	}
+	if _, ok := cc["must-revalidate"]; ok {
+		return false
+	}
+	maxStale, ok := reqCC["max-stale"]
+	if !ok {
+		return false
+	}
+	if maxStale == "" {
+		// any staleness is accepted
+		return true
+	}
+	n, err := strconv.ParseInt(maxStale, 10, 64)
+	return err == nil && age-lifetime < time.Duration(n)*time.Second
+}
+
+func freshnessLifetime(h http.Header, cc map[string]string) (time.Duration, bool) {
+	if v, ok := cc["max-age"]; ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+		return 0, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// an invalid Expires means already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			return 0, true
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+func currentAge(e *entry, h http.Header, now time.Time) time.Duration {
+	age := now.Sub(time.Unix(0, e.Stored))
+	if v, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil {
+		age += time.Duration(v) * time.Second
+	}
+	return age
+}
+
+// revalidation returns a copy of req carrying the validators of the stored response.
+func revalidation(req *http.Request, stored http.Header) *http.Request {
+	etag := stored.Get("ETag")
+	modified := stored.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		return req
+	}
+	req = req.Clone(req.Context())
+	if etag != "" && req.Header.Get("If-None-Match") == "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" && req.Header.Get("If-Modified-Since") == "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	return req
+}
+
+func storable(req *http.Request, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+	default:
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if _, ok := cc["max-age"]; ok {
+		return true
+	}
+	return resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" ||
+		resp.Header.Get("Last-Modified") != ""
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				cc[strings.ToLower(strings.TrimSpace(part[:i]))] = strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			} else {
+				cc[strings.ToLower(part)] = ""
+			}
+		}
+	}
+	return cc
+}
@@ -0,0 +1,394 @@
+// Package mock provides a programmable stub server for testing code built on
+// the http package.
+//
+//	s := mock.NewServer(t)
+//	s.Expect("POST", "/v1/x").WithJSON(map[string]interface{}{"a": 1}).
+//		Reply(201).JSON(map[string]string{"id": "1"}).Times(2)
+//	...
+//	s.Verify()
+package mock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+// TestingT is the part of testing.TB used by Server.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Server is a httptest.Server answering requests from a list of expectations.
+type Server struct {
+	*httptest.Server
+	t TestingT
+
+	mu           sync.Mutex
+	expectations []*Expectation
+	unexpected   []string
+}
+
+// NewServer starts a http stub server. When t has a Cleanup method the server
+// is verified and closed at the end of the test.
+func NewServer(t TestingT) *Server {
+	s := &Server{t: t}
+	s.Server = httptest.NewServer(nethttp.HandlerFunc(s.serve))
+	s.cleanup()
+	return s
+}
+
+// NewTLSServer starts a https stub server.
+func NewTLSServer(t TestingT) *Server {
+	s := &Server{t: t}
+	s.Server = httptest.NewTLSServer(nethttp.HandlerFunc(s.serve))
+	s.cleanup()
+	return s
+}
+
+func (s *Server) cleanup() {
+	if c, ok := s.t.(interface{ Cleanup(func()) }); ok {
+		c.Cleanup(func() {
+			s.Verify()
+			s.Close()
+		})
+	}
+}
+
+// Expect adds an expectation for a request with method and path.
+func (s *Server) Expect(method, path string) *Expectation {
+	e := &Expectation{
+		method: strings.ToUpper(method),
+		path:   path,
+		status: nethttp.StatusOK,
+		header: nethttp.Header{},
+		times:  1,
+	}
+	s.mu.Lock()
+	s.expectations = append(s.expectations, e)
+	s.mu.Unlock()
+	return e
+}
+
+// Verify reports unmet expectations and unexpected requests through t.
+// It returns true when every expectation was met.
+func (s *Server) Verify() bool {
+	s.t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := true
+	for _, e := range s.expectations {
+		if e.times >= 0 && e.calls != e.times {
+			s.t.Errorf("mock: %s %s expected %d call(s), got %d", e.method, e.path, e.times, e.calls)
+			ok = false
+		}
+	}
+	for _, u := range s.unexpected {
+		s.t.Errorf("mock: unexpected request %s", u)
+		ok = false
+	}
+	s.unexpected = nil
+	return ok
+}
+
+// NewRequest returns a *http.HTTPRequest for path on the server.
+// For a tls server the request trusts the server certificate.
+func (s *Server) NewRequest(path, method string) *http.HTTPRequest {
+	req := http.NewRequest(s.URL+path, method)
+	if s.TLS != nil {
+		req.SetTLSClientConfig(s.Client().Transport.(*nethttp.Transport).TLSClientConfig)
+	}
+	return req
+}
+
+// Setting returns setting prepared to talk to the server.
+func (s *Server) Setting(setting http.HTTPSettings) http.HTTPSettings {
+	if s.TLS != nil {
+		setting.TLSClientConfig = s.Client().Transport.(*nethttp.Transport).TLSClientConfig
+	}
+	return setting
+}
+
+func (s *Server) serve(w nethttp.ResponseWriter, r *nethttp.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	var found *Expectation
+	for _, e := range s.expectations {
+		if (e.times < 0 || e.calls < e.times) && e.match(r, body) {
+			found = e
+			break
+		}
+	}
+	if found == nil {
+		s.unexpected = append(s.unexpected, r.Method+" "+r.URL.RequestURI())
+		s.mu.Unlock()
+		nethttp.Error(w, "mock: unexpected request "+r.Method+" "+r.URL.RequestURI(), nethttp.StatusNotImplemented)
+		return
+	}
+	found.calls++
+	s.mu.Unlock()
+
+	found.respond(s.t, w, r)
+}
+
+// Expectation describes an expected request and the reply to it.
+type Expectation struct {
+	method   string
+	path     string
+	query    map[string]string
+	reqHead  map[string]string
+	body     *string
+	json     interface{}
+	matchers []func(*nethttp.Request, []byte) bool
+
+	status int
+	header nethttp.Header
+	reply  []byte
+	delay  time.Duration
+	reset  bool
+	chunk  int
+	gzip   bool
+	times  int
+	calls  int
+}
+
+// WithHeader expects a request header value.
+func (e *Expectation) WithHeader(key, value string) *Expectation {
+	if e.reqHead == nil {
+		e.reqHead = map[string]string{}
+	}
+	e.reqHead[key] = value
+	return e
+}
+
+// WithQuery expects a query parameter value.
+func (e *Expectation) WithQuery(key, value string) *Expectation {
+	if e.query == nil {
+		e.query = map[string]string{}
+	}
+	e.query[key] = value
+	return e
+}
+
+// WithBody expects the exact request body.
+func (e *Expectation) WithBody(body string) *Expectation {
+	e.body = &body
+	return e
+}
+
+// WithJSON expects a json request body containing every field of v.
+// Objects are compared as subsets, all other values must be equal.
+func (e *Expectation) WithJSON(v interface{}) *Expectation {
+	e.json = normalize(v)
+	return e
+}
+
+// Match adds a custom request matcher.
+func (e *Expectation) Match(f func(r *nethttp.Request, body []byte) bool) *Expectation {
+	e.matchers = append(e.matchers, f)
+	return e
+}
+
+// Reply sets the response status, 200 by default.
+func (e *Expectation) Reply(status int) *Expectation {
+	e.status = status
+	return e
+}
+
+// Header sets a response header.
+func (e *Expectation) Header(key, value string) *Expectation {
+	e.header.Set(key, value)
+	return e
+}
+
+// Body sets the response body.
+func (e *Expectation) Body(body string) *Expectation {
+	e.reply = []byte(body)
+	return e
+}
+
+// JSON sets v encoded as json as the response body.
+func (e *Expectation) JSON(v interface{}) *Expectation {
+	e.reply, _ = json.Marshal(v)
+	e.header.Set("Content-Type", "application/json")
+	return e
+}
+
+// Times sets how often the expectation must be met, 1 by default.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+// AnyTimes lets the expectation be met any number of times, including none.
+func (e *Expectation) AnyTimes() *Expectation {
+	e.times = -1
+	return e
+}
+
+// Delay waits d before replying, e.g. to exercise read timeouts.
+func (e *Expectation) Delay(d time.Duration) *Expectation {
+	e.delay = d
+	return e
+}
+
+// Reset closes the connection without replying.
+func (e *Expectation) Reset() *Expectation {
+	e.reset = true
+	return e
+}
+
+// Chunked sends the body with chunked transfer encoding in pieces of size bytes.
+func (e *Expectation) Chunked(size int) *Expectation {
+	e.chunk = size
+	return e
+}
+
+// Gzip compresses the response body and sets Content-Encoding.
+func (e *Expectation) Gzip() *Expectation {
+	e.gzip = true
+	return e
+}
+
+func (e *Expectation) String() string {
+	return e.method + " " + e.path
+}
+
+func (e *Expectation) match(r *nethttp.Request, body []byte) bool {
+	if e.method != "" && e.method != r.Method {
+		return false
+	}
+	if e.path != "" && e.path != r.URL.Path {
+		return false
+	}
+	q := r.URL.Query()
+	for k, v := range e.query {
+		if q.Get(k) != v {
+			return false
+		}
+	}
+	for k, v := range e.reqHead {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	if e.body != nil && *e.body != string(body) {
+		return false
+	}
+	if e.json != nil {
+		var actual interface{}
+		if json.Unmarshal(body, &actual) != nil || !contains(actual, e.json) {
+			return false
+		}
+	}
+	for _, m := range e.matchers {
+		if !m(r, body) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Expectation) respond(t TestingT, w nethttp.ResponseWriter, r *nethttp.Request) {
+	if e.delay > 0 {
+		select {
+		case <-time.After(e.delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if e.reset {
+		hj, ok := w.(nethttp.Hijacker)
+		if !ok {
+			t.Errorf("mock: %s %s can not reset the connection, it can not be hijacked", e.method, e.path)
+			return
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Errorf("mock: %s %s can not reset the connection: %v", e.method, e.path, err)
+			return
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+		return
+	}
+
+	body := e.reply
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	if e.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if e.chunk <= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	}
+	w.WriteHeader(e.status)
+
+	if e.chunk <= 0 {
+		w.Write(body)
+		return
+	}
+	f, _ := w.(nethttp.Flusher)
+	for len(body) > 0 {
+		n := e.chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		w.Write(body[:n])
+		body = body[n:]
+		if f != nil {
+			f.Flush()
+		}
+	}
+}
+
+// normalize converts v to the generic form json.Unmarshal produces.
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
+
+// contains reports whether actual holds every field of expected.
+func contains(actual, expected interface{}) bool {
+	em, ok := expected.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(actual, expected)
+	}
+	am, ok := actual.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for k, ev := range em {
+		av, ok := am[k]
+		if !ok || !contains(av, ev) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a server-sent event.
+type Event struct {
+	ID    string
+	Event string // the event type, "message" by default
+	Data  string
+	Retry time.Duration // the reconnection time sent with the event, if any
+}
+
+// DefaultEventRetry is the reconnection delay of Events until the server sends one.
+var DefaultEventRetry = 3 * time.Second
+
+// maxEventBackoff caps the reconnection delay after consecutive failed connects.
+const maxEventBackoff = time.Minute
+
+// ErrNotEventStream is returned by Events when the response is not text/event-stream.
+var ErrNotEventStream = errors.New("http: response is not text/event-stream")
+
+// Events consumes a text/event-stream response. The stream is reconnected with
+// the Last-Event-ID header when the connection ends or fails, until ctx is done
+// or the server answers 204; failed connects back off exponentially up to a
+// minute. A non-2xx status, another content type or an error that is not a
+// transport error (an unknown svc:// service, a bad url) ends the stream with
+// an error. Both channels are closed when the stream ends.
+func (b *HTTPRequest) Events(ctx context.Context) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errc := make(chan error, 1)
+	b.req = b.req.WithContext(ctx)
+	b.req.Header.Set("Accept", "text/event-stream")
+	b.req.Header.Set("Cache-Control", "no-cache")
+
+	go func() {
+		defer close(events)
+		defer close(errc)
+
+		retry := DefaultEventRetry
+		lastID := ""
+		failures := 0
+		for first := true; ; first = false {
+			if !first {
+				delay := retry
+				for i := 0; i < failures && delay < maxEventBackoff; i++ {
+					delay *= 2
+				}
+				delay = max(retry, min(delay, maxEventBackoff))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				if !b.rewindBody() {
+					errc <- errors.New("http: request body can not be sent again")
+					return
+				}
+				if lastID != "" {
+					b.req.Header.Set("Last-Event-ID", lastID)
+				}
+			}
+
+			resp, err := b.DoRequest()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// only transport errors are retried
+				var uerr *url.Error
+				if !errors.As(err, &uerr) || uerr.Op == "parse" {
+					errc <- err
+					return
+				}
+				failures++
+				continue
+			}
+			if resp.StatusCode == http.StatusNoContent {
+				resp.Body.Close()
+				return
+			}
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				b.resp = resp
+				errc <- newHTTPError(b.req, resp, body)
+				return
+			}
+			if !strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream") {
+				resp.Body.Close()
+				errc <- ErrNotEventStream
+				return
+			}
+
+			// a broken stream is reconnected like a closed one
+			failures = 0
+			readEvents(ctx, b.responseBody(resp), lastID, func(ev Event) bool {
+				if ev.Retry > 0 {
+					retry = ev.Retry
+				}
+				lastID = ev.ID
+				if ev.Data == "" && ev.Event == "" {
+					// only carried the id or retry fields
+					return true
+				}
+				select {
+				case events <- ev:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			})
+			resp.Body.Close()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return events, errc
+}
+
+// readEvents parses the event stream r and calls emit for every dispatched
+// event, emit returns false to stop reading. Events without an id field carry
+// lastID, the last event id seen on this or an earlier connection.
+func readEvents(ctx context.Context, r io.Reader, lastID string, emit func(Event) bool) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), 1<<20)
+	sc.Split(scanEventLines)
+
+	var (
+		ev      Event
+		data    strings.Builder
+		hasData bool
+		id      = lastID
+	)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			// dispatch
+			ev.ID = id
+			if hasData {
+				ev.Data = strings.TrimSuffix(data.String(), "\n")
+				if ev.Event == "" {
+					ev.Event = "message"
+				}
+				if !emit(ev) {
+					return ctx.Err()
+				}
+			} else if ev.Retry > 0 || ev.ID != "" {
+				emit(Event{ID: ev.ID, Retry: ev.Retry})
+			}
+			ev = Event{}
+			data.Reset()
+			hasData = false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				id = value
+			}
+		case "retry":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				ev.Retry = time.Duration(n) * time.Millisecond
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// scanEventLines splits lines ended by \r\n, \n or \r.
+func scanEventLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\r' {
+			if i+1 == len(data) && !atEOF {
+				// need to know whether \n follows
+				return 0, nil, nil
+			}
+			if i+1 < len(data) && data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// DecodeStream reads a newline-delimited json response and calls fn with
+// every record, stopping at the first error returned by fn.
+// Without ExpectStatus a response status other than 2xx is returned as an *HTTPError.
+func (b *HTTPRequest) DecodeStream(ctx context.Context, fn func(json.RawMessage) error) error {
+	b.req = b.req.WithContext(ctx)
+	if b.req.Header.Get("Accept") == "" {
+		b.req.Header.Set("Accept", "application/x-ndjson")
+	}
+	resp, err := b.getResponse()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !b.statusAccepted(resp.StatusCode) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return b.checkStatus(body)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// an error payload is not a stream of records
+		body, _ := ioutil.ReadAll(resp.Body)
+		return newHTTPError(b.req, resp, body)
+	}
+
+	sc := bufio.NewScanner(b.responseBody(resp))
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return errors.New("http: invalid json record: " + string(line))
+		}
+		record := make(json.RawMessage, len(line))
+		copy(record, line)
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	if err = sc.Err(); err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// responseBody returns the response body, decompressed when Gzip is enabled.
+func (b *HTTPRequest) responseBody(resp *http.Response) io.Reader {
+	if b.setting.Gzip && resp.Header.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(resp.Body); err == nil {
+			return zr
+		}
+	}
+	return resp.Body
+}
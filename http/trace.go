@@ -0,0 +1,218 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings are the durations of the phases of a request attempt. When the
+// attempt follows redirects or retries after a 401, the phases of the last
+// connection are reported.
+type Timings struct {
+	Start      time.Time
+	DNS        time.Duration // name resolution
+	Connect    time.Duration // tcp connect
+	TLS        time.Duration // tls handshake
+	TTFB       time.Duration // from Start to the first response byte
+	Transfer   time.Duration // from the first response byte to the end of the body
+	Total      time.Duration // from Start to the end of the body
+	ConnReused bool
+}
+
+// Tracer starts spans for requests, so a tracing system such as OpenTelemetry
+// can be plugged in without this package depending on it. The span of a request
+// is started first and its phases (dns, connect, tls, ttfb) are started with
+// the context it returned, once they completed.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, start time.Time) (context.Context, Span)
+}
+
+// Span is a timed operation started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End(end time.Time, err error)
+}
+
+// SetTracer sets the tracer receiving the spans of the request.
+func (b *HTTPRequest) SetTracer(tracer Tracer) *HTTPRequest {
+	b.setting.Tracer = tracer
+	return b
+}
+
+// Timings returns the timings of the last attempt of the request. Transfer
+// and Total are set once the response body has been read or closed.
+func (b *HTTPRequest) Timings() Timings {
+	if b.timer == nil {
+		return Timings{}
+	}
+	b.timer.mu.Lock()
+	defer b.timer.mu.Unlock()
+	return b.timer.t
+}
+
+// reqTimer records the httptrace events of one attempt.
+type reqTimer struct {
+	mu   sync.Mutex
+	t    Timings
+	done bool
+
+	dnsStart, connStart, tlsStart, firstByte time.Time
+
+	// parent is the request context before tracing, traced the one with the ClientTrace
+	parent, traced context.Context
+
+	tracer Tracer
+	ctx    context.Context
+	span   Span
+}
+
+// startTimer traces the next attempt of b.req.
+func (b *HTTPRequest) startTimer() *reqTimer {
+	ctx := b.req.Context()
+	if b.timer != nil && ctx == b.timer.traced {
+		// do not stack the traces of previous attempts
+		ctx = b.timer.parent
+	}
+	t := &reqTimer{t: Timings{Start: time.Now()}, parent: ctx}
+	if tracer := b.setting.Tracer; tracer != nil {
+		t.tracer = tracer
+		t.ctx, t.span = tracer.StartSpan(ctx, "HTTP "+b.req.Method, t.t.Start)
+		t.span.SetAttribute("http.method", b.req.Method)
+		t.span.SetAttribute("http.url", b.req.URL.String())
+		ctx = t.ctx
+	}
+	t.traced = httptrace.WithClientTrace(ctx, t.clientTrace())
+	b.req = b.req.WithContext(t.traced)
+	b.timer = t
+	return t
+}
+
+func (t *reqTimer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.phase("dns", &t.dnsStart, &t.t.DNS, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			if t.connStart.IsZero() {
+				t.connStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				t.phase("connect", &t.connStart, &t.t.Connect, nil)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			t.phase("tls", &t.tlsStart, &t.t.TLS, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.t.ConnReused = info.Reused
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			start := t.t.Start
+			t.phase("ttfb", &start, &t.t.TTFB, nil)
+			t.mu.Lock()
+			t.firstByte = t.t.Start.Add(t.t.TTFB)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// phase records the duration since *start into *d and emits its span.
+func (t *reqTimer) phase(name string, start *time.Time, d *time.Duration, err error) {
+	end := time.Now()
+	t.mu.Lock()
+	if t.done || start.IsZero() {
+		t.mu.Unlock()
+		return
+	}
+	begin := *start
+	*d = end.Sub(begin)
+	*start = time.Time{}
+	t.mu.Unlock()
+
+	if t.tracer != nil {
+		_, span := t.tracer.StartSpan(t.ctx, name, begin)
+		span.End(end, err)
+	}
+}
+
+// finish ends the attempt when it failed or has no body, otherwise when
+// its body is read or closed.
+func (t *reqTimer) finish(resp *http.Response, err error) {
+	if err != nil || resp == nil {
+		t.end(resp, err)
+		return
+	}
+	if resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 {
+		t.end(resp, nil)
+		return
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, t: t, resp: resp}
+}
+
+func (t *reqTimer) end(resp *http.Response, err error) {
+	now := time.Now()
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	if !t.firstByte.IsZero() {
+		t.t.Transfer = now.Sub(t.firstByte)
+	}
+	t.t.Total = now.Sub(t.t.Start)
+	reused := t.t.ConnReused
+	t.mu.Unlock()
+
+	if t.span != nil {
+		if resp != nil {
+			t.span.SetAttribute("http.status_code", resp.StatusCode)
+		}
+		t.span.SetAttribute("net.conn.reused", reused)
+		t.span.End(now, err)
+	}
+}
+
+// timedBody ends the attempt timing at the end of the body.
+type timedBody struct {
+	io.ReadCloser
+	t    *reqTimer
+	resp *http.Response
+}
+
+func (r *timedBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.t.end(r.resp, nil)
+	} else if err != nil {
+		r.t.end(r.resp, err)
+	}
+	return n, err
+}
+
+func (r *timedBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.t.end(r.resp, nil)
+	return err
+}
@@ -0,0 +1,347 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSOptions describes a tls client configuration, see NewTLSConfig.
+type TLSOptions struct {
+	CAFile             string // PEM file with the CAs trusted instead of the system pool
+	CertFile           string // PEM client certificate
+	KeyFile            string // PEM client private key
+	ServerName         string // SNI and verification name, defaults to the url host
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig builds a *tls.Config for pinned CAs, client certificates and SNI overrides.
+func NewTLSConfig(opt TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         opt.ServerName,
+		InsecureSkipVerify: opt.InsecureSkipVerify,
+	}
+	if opt.CAFile != "" {
+		pem, err := ioutil.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("http: no certificate found in " + opt.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if opt.CertFile != "" || opt.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// SetTLSHostConfig sets the tls configuration used for host instead of TLSClientConfig.
+func (b *HTTPRequest) SetTLSHostConfig(host string, config *tls.Config) *HTTPRequest {
+	// the map may be shared with the default setting
+	hosts := make(map[string]*tls.Config, len(b.setting.TLSHostConfig)+1)
+	for k, v := range b.setting.TLSHostConfig {
+		hosts[k] = v
+	}
+	hosts[strings.ToLower(host)] = config
+	b.setting.TLSHostConfig = hosts
+	return b
+}
+
+// SetDialContext sets the function used to open connections.
+func (b *HTTPRequest) SetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *HTTPRequest {
+	b.setting.DialContext = dial
+	return b
+}
+
+// SetUnixSocket sends the request over the unix domain socket at path,
+// whatever the url host is.
+func (b *HTTPRequest) SetUnixSocket(path string) *HTTPRequest {
+	b.setting.UnixSocket = path
+	return b
+}
+
+// tlsConfig returns a copy of the tls configuration for host,
+// the transport adds its ALPN protocols to it.
+func (b *HTTPRequest) tlsConfig(host string) *tls.Config {
+	config, ok := b.setting.TLSHostConfig[strings.ToLower(host)]
+	if !ok {
+		config = b.setting.TLSClientConfig
+	}
+	if config == nil {
+		return nil
+	}
+	return config.Clone()
+}
+
+// dialContext returns the dial function honoring DialContext, UnixSocket and the timeouts.
+func (b *HTTPRequest) dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := b.setting.DialContext
+	if dial == nil {
+		dial = TimeoutDialContext(b.setting.ConnectTimeout, b.setting.ReadWriteTimeout)
+	}
+	if socket := b.setting.UnixSocket; socket != "" {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, "unix", socket)
+		}
+	}
+	return dial
+}
+
+// dialTLSContext returns a DialTLSContext choosing the tls configuration by the
+// host dialed, so redirects and svc:// endpoints use their own TLSHostConfig.
+// Connections through a proxy use TLSClientConfig.
+func (b *HTTPRequest) dialTLSContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	alpn := []string{"h2", "http/1.1"}
+	if p := b.setting.Protocols; p != nil {
+		switch {
+		case !p.HTTP2():
+			alpn = []string{"http/1.1"}
+		case !p.HTTP1():
+			alpn = []string{"h2"}
+		}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config := b.tlsConfig(host)
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = alpn
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// newTransport creates the default transport for the request settings.
+func (b *HTTPRequest) newTransport() *http.Transport {
+	t := &http.Transport{
+		TLSClientConfig:     b.setting.TLSClientConfig.Clone(),
+		Proxy:               b.setting.Proxy,
+		DialContext:         b.dialContext(),
+		MaxIdleConnsPerHost: 100,
+		ForceAttemptHTTP2:   true,
+		Protocols:           b.setting.Protocols,
+	}
+	if len(b.setting.TLSHostConfig) > 0 {
+		t.DialTLSContext = b.dialTLSContext(t.DialContext)
+	}
+	return t
+}
+
+// filledKey identifies the settings a clone of a user transport was filled from.
+type filledKey struct {
+	fillTLS, fillDial, fillProtocols bool
+	tls                              *tls.Config
+	unixSocket                       string
+	connectTimeout, readWriteTimeout time.Duration
+	protocols                        http.Protocols
+}
+
+// userTransport records the fields a user transport left unset when first
+// seen, as Clone sets up HTTP/2 and its TLSClientConfig on the original, and
+// the last clone filled from the settings, so requests with the same settings
+// share its connection pool.
+type userTransport struct {
+	noTLS, noProxy, noDial, noProtocols bool
+
+	mu     sync.Mutex
+	key    filledKey
+	filled *http.Transport
+}
+
+// userTransports holds one entry for each user transport, which is meant to
+// be shared and kept for the life of the program.
+var userTransports sync.Map // *http.Transport -> *userTransport
+
+func lookupTransport(t *http.Transport) *userTransport {
+	if v, ok := userTransports.Load(t); ok {
+		return v.(*userTransport)
+	}
+	v, _ := userTransports.LoadOrStore(t, &userTransport{
+		noTLS:       t.TLSClientConfig == nil && t.DialTLSContext == nil && t.DialTLS == nil,
+		noProxy:     t.Proxy == nil,
+		noDial:      t.Dial == nil && t.DialContext == nil,
+		noProtocols: t.Protocols == nil,
+	})
+	return v.(*userTransport)
+}
+
+// reuse returns the clone filled from the settings key.
+func (u *userTransport) reuse(key filledKey) *http.Transport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.filled != nil && u.key == key {
+		return u.filled
+	}
+	return nil
+}
+
+// keep stores the clone filled from the settings key.
+func (u *userTransport) keep(key filledKey, t *http.Transport) {
+	u.mu.Lock()
+	old := u.filled
+	u.key, u.filled = key, t
+	u.mu.Unlock()
+	if old != nil {
+		// the settings changed, the previous clone is not used any more
+		old.CloseIdleConnections()
+	}
+}
+
+// configureTransport returns the user transport with its unset fields filled
+// from the settings. The transport may be shared by other requests and is never
+// modified, a clone is returned when a field has to be filled; a transport with
+// its own DialContext, Proxy and TLS settings is used as is and keeps its
+// connection pool. The clone is reused by the next requests with the same
+// settings unless they fill in a Proxy, DialContext or TLSHostConfig, then
+// oneOff is true and its connections are to be closed after the response.
+func (b *HTTPRequest) configureTransport(t *http.Transport) (_ *http.Transport, oneOff bool) {
+	s := &b.setting
+	u := lookupTransport(t)
+	fillTLS := u.noTLS && (s.TLSClientConfig != nil || len(s.TLSHostConfig) > 0)
+	fillProxy := u.noProxy && s.Proxy != nil
+	fillDial := u.noDial &&
+		(s.DialContext != nil || s.UnixSocket != "" || s.ConnectTimeout > 0 || s.ReadWriteTimeout > 0)
+	fillProtocols := u.noProtocols && s.Protocols != nil
+	if !fillTLS && !fillProxy && !fillDial && !fillProtocols {
+		return t, false
+	}
+
+	// functions can not be compared, nor kept without keeping the request
+	reusable := !fillProxy && !(fillDial && s.DialContext != nil) && !(fillTLS && len(s.TLSHostConfig) > 0)
+	key := filledKey{fillTLS: fillTLS, fillDial: fillDial, fillProtocols: fillProtocols}
+	if fillTLS {
+		key.tls = s.TLSClientConfig
+	}
+	if fillDial {
+		key.unixSocket, key.connectTimeout, key.readWriteTimeout = s.UnixSocket, s.ConnectTimeout, s.ReadWriteTimeout
+	}
+	if fillProtocols {
+		key.protocols = *s.Protocols
+	}
+	if reusable {
+		if filled := u.reuse(key); filled != nil {
+			return filled, false
+		}
+	}
+
+	t = t.Clone()
+	if fillProxy {
+		t.Proxy = s.Proxy
+	}
+	if fillDial {
+		t.DialContext = b.dialContext()
+	}
+	if fillProtocols {
+		t.Protocols = s.Protocols
+	}
+	if fillTLS {
+		t.TLSClientConfig = s.TLSClientConfig.Clone()
+		if len(s.TLSHostConfig) > 0 {
+			dial := t.DialContext
+			switch {
+			case dial == nil && t.Dial != nil:
+				plain := t.Dial
+				dial = func(_ context.Context, network, addr string) (net.Conn, error) {
+					return plain(network, addr)
+				}
+			case dial == nil:
+				dial = (&net.Dialer{}).DialContext
+			}
+			t.DialTLSContext = b.dialTLSContext(dial)
+		}
+	}
+	if reusable {
+		u.keep(key, t)
+	}
+	return t, !reusable
+}
+
+// closeOneOff closes the connections of a transport used for a single request
+// once the response body is closed.
+func closeOneOff(t *http.Transport, resp *http.Response, err error) {
+	if err != nil || resp == nil || resp.Body == nil {
+		t.CloseIdleConnections()
+		return
+	}
+	resp.Body = &oneOffBody{ReadCloser: resp.Body, t: t}
+}
+
+// oneOffBody closes the idle connections of its transport once closed.
+type oneOffBody struct {
+	io.ReadCloser
+	t    *http.Transport
+	once sync.Once
+}
+
+func (r *oneOffBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.t.CloseIdleConnections)
+	return err
+}
+
+// resolveUnixURL turns unix:///path/to.sock:/request/path?query into a http url
+// sent over the socket.
+func (b *HTTPRequest) resolveUnixURL(u *url.URL) *url.URL {
+	if u.Scheme != "unix" {
+		return u
+	}
+	socket, path := u.Path, "/"
+	if i := strings.Index(u.Path, ":"); i >= 0 {
+		socket, path = u.Path[:i], u.Path[i+1:]
+	}
+	b.setting.UnixSocket = socket
+	return &url.URL{
+		Scheme:   "http",
+		Host:     "localhost",
+		Path:     path,
+		RawQuery: u.RawQuery,
+	}
+}
+
+// TimeoutDialContext returns a DialContext function with timeout settings for http.Transport.
+func TimeoutDialContext(cTimeout time.Duration, rwTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: cTimeout}
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if rwTimeout > 0 {
+			err = conn.SetDeadline(time.Now().Add(rwTimeout))
+		}
+		return conn, err
+	}
+}
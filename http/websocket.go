@@ -0,0 +1,666 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket message types.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// WebSocket close codes.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseAbnormalClosure  = 1006
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+)
+
+const (
+	wsGUID          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsCloseTimeout  = 5 * time.Second
+	wsMaxWindow     = 32 << 10
+	wsDefaultLimit  = 32 << 20
+	opContinuation  = 0
+	finBit          = 0x80
+	rsv1Bit         = 0x40
+	maskBit         = 0x80
+	maxControlFrame = 125
+)
+
+// WebSocket errors.
+var (
+	ErrBadHandshake  = errors.New("http: websocket bad handshake")
+	ErrWSClosed      = errors.New("http: websocket closed")
+	ErrMessageTooBig = errors.New("http: websocket message too big")
+)
+
+// CloseError is returned by ReadMessage when the peer closed the connection.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("http: websocket closed: %d %s", e.Code, e.Text)
+}
+
+// WSOptions configures a websocket connection, see WebSocket.
+type WSOptions struct {
+	Subprotocols []string
+	// Compression negotiates permessage-deflate (RFC 7692).
+	Compression bool
+	// PingInterval sends pings to keep the connection alive, 0 disables them.
+	PingInterval time.Duration
+	// FragmentSize splits outgoing messages into frames of at most this
+	// many bytes, 0 sends every message as a single frame.
+	FragmentSize int
+	// ReadLimit is the maximum size of a received message, 32MB by default.
+	ReadLimit int64
+}
+
+// WSConn is a client websocket connection. One goroutine may read while
+// others write.
+type WSConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	opt  WSOptions
+
+	subprotocol string
+	compress    bool
+	// readDict is the decompressed history kept when the server compresses
+	// with context takeover.
+	readDict      []byte
+	serverContext bool
+
+	readMu    sync.Mutex
+	writeMu   sync.Mutex
+	closeSent bool
+	closeRecv chan struct{}
+	recvOnce  sync.Once
+	done      chan struct{}
+	doneOnce  sync.Once
+}
+
+// WebSocket performs the websocket upgrade handshake for the request url
+// (ws, wss, http or https) with the request headers, cookies, tls and proxy
+// settings. opt may be nil.
+func (b *HTTPRequest) WebSocket(ctx context.Context, opt *WSOptions) (*WSConn, *http.Response, error) {
+	if opt == nil {
+		opt = &WSOptions{}
+	}
+	if err := b.prepare(); err != nil {
+		return nil, nil, err
+	}
+	u := *b.req.URL
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported scheme %q", ErrBadHandshake, u.Scheme)
+	}
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     b.req.Header.Clone(),
+		Host:       b.req.Host,
+	}
+	req = req.WithContext(ctx)
+	if b.setting.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", b.setting.UserAgent)
+	}
+	var jar http.CookieJar
+	if b.setting.EnableCookie {
+		if defaultCookieJar == nil {
+			createDefaultCookie()
+		}
+		jar = defaultCookieJar
+		for _, c := range jar.Cookies(&u) {
+			req.AddCookie(c)
+		}
+	}
+	if b.setting.Auth != nil {
+		if err := b.setting.Auth.Authorize(req); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	keyBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, keyBytes); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(opt.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(opt.Subprotocols, ", "))
+	}
+	if opt.Compression {
+		req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_no_context_takeover")
+	}
+
+	conn, err := b.dialWebSocket(ctx, &u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if jar != nil {
+		if rc := resp.Cookies(); len(rc) > 0 {
+			jar.SetCookies(&u, rc)
+		}
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(MaxErrorBodySize)))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		conn.Close()
+		return nil, resp, fmt.Errorf("%w: %s", ErrBadHandshake, resp.Status)
+	}
+	// the dialer deadline only applies to the handshake
+	conn.SetDeadline(time.Time{})
+
+	c := &WSConn{
+		conn:        conn,
+		br:          br,
+		opt:         *opt,
+		subprotocol: resp.Header.Get("Sec-WebSocket-Protocol"),
+		closeRecv:   make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if c.opt.ReadLimit <= 0 {
+		c.opt.ReadLimit = wsDefaultLimit
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		if !opt.Compression || !strings.HasPrefix(strings.TrimSpace(ext), "permessage-deflate") {
+			conn.Close()
+			return nil, resp, fmt.Errorf("%w: unexpected extension %q", ErrBadHandshake, ext)
+		}
+		c.compress = true
+		c.serverContext = !strings.Contains(ext, "server_no_context_takeover")
+	}
+	if c.opt.PingInterval > 0 {
+		go c.keepalive()
+	}
+	return c, resp, nil
+}
+
+// dialWebSocket opens the connection to u, through the proxy and tls when needed.
+func (b *HTTPRequest) dialWebSocket(ctx context.Context, u *url.URL) (net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dial := b.dialContext()
+
+	var proxy *url.URL
+	if b.setting.Proxy != nil {
+		p, err := b.setting.Proxy(&http.Request{URL: u, Header: http.Header{}})
+		if err != nil {
+			return nil, err
+		}
+		proxy = p
+	}
+
+	var conn net.Conn
+	var err error
+	if proxy == nil {
+		conn, err = dial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		proxyAddr := proxy.Host
+		if proxy.Port() == "" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+		conn, err = dial(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		connect := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: http.Header{},
+		}
+		if proxy.User != nil {
+			pass, _ := proxy.User.Password()
+			connect.SetBasicAuth(proxy.User.Username(), pass)
+			connect.Header.Set("Proxy-Authorization", connect.Header.Get("Authorization"))
+			connect.Header.Del("Authorization")
+		}
+		if err = connect.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, connect)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("http: proxy CONNECT %s: %s", addr, resp.Status)
+		}
+	}
+
+	if u.Scheme == "https" {
+		config := b.tlsConfig(u.Hostname())
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		// the upgrade needs HTTP/1.1
+		config.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(conn, config)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return conn, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Subprotocol returns the subprotocol selected by the server.
+func (c *WSConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn returns the underlying connection.
+func (c *WSConn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *WSConn) keepalive() {
+	t := time.NewTicker(c.opt.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if c.Ping(nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// ReadMessage reads the next text or binary message, answering pings and
+// close frames on the way. When the peer closes it returns a *CloseError.
+func (c *WSConn) ReadMessage() (messageType int, data []byte, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.readMessage()
+}
+
+func (c *WSConn) readMessage() (int, []byte, error) {
+	var (
+		msgType    int
+		compressed bool
+		buf        bytes.Buffer
+	)
+	for {
+		fin, rsv1, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case PingMessage:
+			if err = c.writeFrame(PongMessage, payload, true, false); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(payload)
+		case TextMessage, BinaryMessage:
+			if msgType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "new message before the end of the previous one")
+			}
+			msgType, compressed = op, rsv1
+		case opContinuation:
+			if msgType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if int64(buf.Len()+len(payload)) > c.opt.ReadLimit {
+			c.fail(CloseMessageTooBig, "")
+			return 0, nil, ErrMessageTooBig
+		}
+		buf.Write(payload)
+		if !fin {
+			continue
+		}
+
+		data := buf.Bytes()
+		if compressed {
+			if data, err = c.inflate(data); err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, err.Error())
+			}
+		}
+		if msgType == TextMessage && !utf8.Valid(data) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid utf-8")
+		}
+		return msgType, data, nil
+	}
+}
+
+// readFrame reads one frame.
+func (c *WSConn) readFrame() (fin, rsv1 bool, op int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&finBit != 0
+	rsv1 = head[0]&rsv1Bit != 0
+	op = int(head[0] & 0x0f)
+	if head[0]&0x30 != 0 || (rsv1 && !c.compress) {
+		err = c.fail(CloseProtocolError, "unexpected reserved bits")
+		return
+	}
+	if head[1]&maskBit != 0 {
+		err = c.fail(CloseProtocolError, "masked server frame")
+		return
+	}
+	n := int64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if op >= CloseMessage && (n > maxControlFrame || !fin) {
+		err = c.fail(CloseProtocolError, "invalid control frame")
+		return
+	}
+	if n < 0 || n > c.opt.ReadLimit {
+		c.fail(CloseMessageTooBig, "")
+		err = ErrMessageTooBig
+		return
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(c.br, payload)
+	return
+}
+
+// inflate decompresses a permessage-deflate message.
+func (c *WSConn) inflate(data []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader([]byte{0x00, 0x00, 0xff, 0xff}))
+	var dict []byte
+	if c.serverContext {
+		dict = c.readDict
+	}
+	zr := flate.NewReaderDict(src, dict)
+	out, err := ioutil.ReadAll(io.LimitReader(zr, c.opt.ReadLimit+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if int64(len(out)) > c.opt.ReadLimit {
+		return nil, ErrMessageTooBig
+	}
+	if c.serverContext {
+		c.readDict = append(c.readDict, out...)
+		if len(c.readDict) > wsMaxWindow {
+			c.readDict = append([]byte(nil), c.readDict[len(c.readDict)-wsMaxWindow:]...)
+		}
+	}
+	return out, nil
+}
+
+func (c *WSConn) handleClose(payload []byte) error {
+	code, text := CloseNoStatusReceived, ""
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload))
+		text = string(payload[2:])
+	}
+	c.recvOnce.Do(func() { close(c.closeRecv) })
+	// echo the code to complete the handshake
+	echo := code
+	if echo == CloseNoStatusReceived {
+		echo = CloseNormalClosure
+	}
+	c.writeClose(echo, "")
+	return &CloseError{Code: code, Text: text}
+}
+
+// fail closes the connection for a protocol violation.
+func (c *WSConn) fail(code int, text string) error {
+	c.writeClose(code, text)
+	c.shutdown()
+	return &CloseError{Code: code, Text: text}
+}
+
+// WriteMessage sends a text or binary message.
+func (c *WSConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("http: invalid websocket message type %d", messageType)
+	}
+	compressed := false
+	if c.compress && len(data) > 0 {
+		var buf bytes.Buffer
+		zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		zw.Write(data)
+		zw.Flush()
+		data = bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+		compressed = true
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrWSClosed
+	}
+	size := c.opt.FragmentSize
+	if size <= 0 || size >= len(data) {
+		return c.writeFrameLocked(messageType, data, true, compressed)
+	}
+	op := messageType
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := c.writeFrameLocked(op, data[:n], n == len(data), compressed && op != opContinuation); err != nil {
+			return err
+		}
+		data = data[n:]
+		op = opContinuation
+	}
+	return nil
+}
+
+// Ping sends a ping frame.
+func (c *WSConn) Ping(data []byte) error {
+	return c.writeFrame(PingMessage, data, true, false)
+}
+
+func (c *WSConn) writeFrame(op int, payload []byte, fin, rsv1 bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrWSClosed
+	}
+	return c.writeFrameLocked(op, payload, fin, rsv1)
+}
+
+func (c *WSConn) writeFrameLocked(op int, payload []byte, fin, rsv1 bool) error {
+	var head [14]byte
+	head[0] = byte(op)
+	if fin {
+		head[0] |= finBit
+	}
+	if rsv1 {
+		head[0] |= rsv1Bit
+	}
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		head[1] = byte(l)
+	case l <= 0xffff:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(l))
+		n += 2
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(l))
+		n += 8
+	}
+	head[1] |= maskBit
+	if _, err := io.ReadFull(rand.Reader, head[n:n+4]); err != nil {
+		return err
+	}
+	mask := head[n : n+4]
+	n += 4
+
+	frame := make([]byte, n+len(payload))
+	copy(frame, head[:n])
+	for i, v := range payload {
+		frame[n+i] = v ^ mask[i%4]
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeClose sends a close frame once.
+func (c *WSConn) writeClose(code int, text string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return
+	}
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, text...)
+	if len(payload) > maxControlFrame {
+		payload = payload[:maxControlFrame]
+	}
+	c.writeFrameLocked(CloseMessage, payload, true, false)
+	c.closeSent = true
+}
+
+// CloseWithCode performs the close handshake with code and reason: it sends
+// a close frame, waits for the peer's close frame and closes the connection.
+func (c *WSConn) CloseWithCode(code int, reason string) error {
+	c.writeClose(code, reason)
+	if c.readMu.TryLock() {
+		c.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+		for {
+			if _, _, err := c.readMessage(); err != nil {
+				break
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		// a reader is active and will see the close frame
+		select {
+		case <-c.closeRecv:
+		case <-time.After(wsCloseTimeout):
+		}
+	}
+	return c.shutdown()
+}
+
+// Close performs a normal close handshake.
+func (c *WSConn) Close() error {
+	return c.CloseWithCode(CloseNormalClosure, "")
+}
+
+func (c *WSConn) shutdown() error {
+	var err error
+	c.doneOnce.Do(func() {
+		close(c.done)
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,492 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// 内置函数由编译器直接处理，不通过 Env 注册：
+//   - if(cond, a, b)：cond 为 true 时求值 a，否则求值 b
+//   - any(list, pred)、all(list, pred)：pred 中 it 为当前元素，元素为 map 或 struct 时其字段也可直接使用，
+//     否则 pred 中唯一的未定义标志符也表示当前元素，如 any(scores, x > 90)
+//   - any(list, x, pred)、all(list, x, pred)：pred 中 x 为当前元素
+//   - x in y、x not in y：y 为 slice 时判断元素，为 map 或 struct 时判断键，为字符串时判断子串
+//   - x?.name：x 为 nil 或没有字段 name 时结果为 nil
+var builtins = map[string]bool{
+	"if":            true,
+	"any":           true,
+	"all":           true,
+	builtinIn:       true,
+	builtinNullSafe: true,
+}
+
+// variable any、all 中元素的作用域
+type variable struct {
+	name   string
+	value  interface{}
+	fields bool // 元素的字段可以直接作为标志符使用
+}
+
+// lookup 在作用域中查找标志符
+func (st *state) lookup(name string) (interface{}, bool) {
+	for i := len(st.vars) - 1; i >= 0; i-- {
+		v := &st.vars[i]
+		if v.name == name {
+			return v.value, true
+		}
+		if v.fields {
+			if value, err := field(v.value, name); err == nil {
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (c *compiler) compileBuiltin(t *ast.CallExpr, name string) (evalFn, error) {
+	switch name {
+	case "if":
+		if len(t.Args) != 3 {
+			return nil, fmt.Errorf("%w: if expects 3 arguments, got %d", ErrUnsupportParam, len(t.Args))
+		}
+		args, err := c.compileArgs(t.Args)
+		if err != nil {
+			return nil, err
+		}
+		cond, a, b := args[0], args[1], args[2]
+		switch v, _ := c.constValue(t.Args[0]); v {
+		case true:
+			return a, nil
+		case false:
+			return b, nil
+		}
+		skipA, skipB := c.skip(t.Args[1]), c.skip(t.Args[2])
+		return func(st *state) (interface{}, error) {
+			v, err := cond(st)
+			if err != nil {
+				return nil, err
+			}
+			ok, isBool := v.(bool)
+			if !isBool {
+				return nil, fmt.Errorf("if: condition is %T: %w", v, ErrNotBool)
+			}
+			if ok {
+				v, err := a(st)
+				skipB(st)
+				return v, err
+			}
+			skipA(st)
+			return b(st)
+		}, nil
+	case "any", "all":
+		return c.compileQuantifier(t, name == "all")
+	case builtinIn:
+		args, err := c.compileArgs(t.Args)
+		if err != nil {
+			return nil, err
+		}
+		x, y := args[0], args[1]
+		return func(st *state) (interface{}, error) {
+			a, err := x(st)
+			if err != nil {
+				return nil, err
+			}
+			b, err := y(st)
+			if err != nil {
+				return nil, err
+			}
+			return member(a, b)
+		}, nil
+	case builtinNullSafe:
+		x, err := c.compile(t.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		sel, _ := literal(t.Args[1].(*ast.BasicLit))
+		name := sel.(string)
+		return func(st *state) (interface{}, error) {
+			v, err := x(st)
+			if err != nil {
+				if errors.Is(err, ErrKeyNotFound) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			if v == nil {
+				return nil, nil
+			}
+			v, err = field(v, name)
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil, nil
+			}
+			return v, err
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFuncNotFound, name)
+}
+
+func (c *compiler) compileArgs(exprs []ast.Expr) ([]evalFn, error) {
+	args := make([]evalFn, len(exprs))
+	for i, arg := range exprs {
+		a, err := c.compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = a
+	}
+	return args, nil
+}
+
+// quantifierArgs 返回 any、all 的列表、元素变量名及条件，
+// 两个参数且条件中未使用 it 时 binds 为条件中的未定义标志符，
+// 其中只有一个不是数据源的键且元素不是 map 或 struct 时将它绑定到元素
+func quantifierArgs(t *ast.CallExpr, name string) (list ast.Expr, elem string, binds []string, pred ast.Expr, err error) {
+	switch len(t.Args) {
+	case 2:
+		if !usesElem(t.Args[1]) {
+			binds = freeNames(t.Args[1], nil)
+		}
+		return t.Args[0], elemName, binds, t.Args[1], nil
+	case 3:
+		ident, ok := t.Args[1].(*ast.Ident)
+		if !ok {
+			return nil, "", nil, nil, fmt.Errorf("%w: %s expects a variable name, got %s", ErrUnsupportParam, name, types.ExprString(t.Args[1]))
+		}
+		return t.Args[0], ident.Name, nil, t.Args[2], nil
+	}
+	return nil, "", nil, nil, fmt.Errorf("%w: %s expects 2 or 3 arguments, got %d", ErrUnsupportParam, name, len(t.Args))
+}
+
+// freeNames 返回表达式中作为变量使用的标志符，不含 it 及嵌套的 any、all 的条件
+func freeNames(expr ast.Expr, names []string) []string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "true", "false", "nil", elemName:
+			return names
+		}
+		for _, name := range names {
+			if name == t.Name {
+				return names
+			}
+		}
+		return append(names, t.Name)
+	case *ast.ParenExpr:
+		return freeNames(t.X, names)
+	case *ast.UnaryExpr:
+		return freeNames(t.X, names)
+	case *ast.BinaryExpr:
+		return freeNames(t.Y, freeNames(t.X, names))
+	case *ast.SelectorExpr:
+		return freeNames(t.X, names)
+	case *ast.IndexExpr:
+		return freeNames(t.Index, freeNames(t.X, names))
+	case *ast.CallExpr:
+		args := t.Args
+		if ident, ok := t.Fun.(*ast.Ident); ok && (ident.Name == "any" || ident.Name == "all") && len(args) > 0 {
+			args = args[:1]
+		}
+		for _, arg := range args {
+			names = freeNames(arg, names)
+		}
+	}
+	return names
+}
+
+// unbound 返回 names 中唯一不满足 defined 的标志符，没有或多于一个时返回空
+func unbound(names []string, defined func(string) bool) string {
+	bind := ""
+	for _, name := range names {
+		if defined(name) {
+			continue
+		}
+		if bind != "" {
+			return ""
+		}
+		bind = name
+	}
+	return bind
+}
+
+// usesElem 判断条件中是否使用 it，不含嵌套的 any、all 的条件
+func usesElem(expr ast.Expr) bool {
+	used := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch t := n.(type) {
+		case *ast.Ident:
+			if t.Name == elemName {
+				used = true
+			}
+		case *ast.CallExpr:
+			if ident, ok := t.Fun.(*ast.Ident); ok && (ident.Name == "any" || ident.Name == "all") && len(t.Args) > 0 {
+				used = used || usesElem(t.Args[0])
+				return false
+			}
+		}
+		return !used
+	})
+	return used
+}
+
+// hasFields 判断元素是否为 map 或 struct，其字段可以在条件中直接使用
+func hasFields(v interface{}) bool {
+	if _, ok := v.(map[string]interface{}); ok {
+		return true
+	}
+	switch indirect(reflect.ValueOf(v)).Kind() {
+	case reflect.Map, reflect.Struct:
+		return true
+	}
+	return false
+}
+
+func (c *compiler) compileQuantifier(t *ast.CallExpr, all bool) (evalFn, error) {
+	name := "any"
+	if all {
+		name = "all"
+	}
+	listExpr, elem, binds, predExpr, err := quantifierArgs(t, name)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.compile(listExpr)
+	if err != nil {
+		return nil, err
+	}
+	pred, err := c.compile(predExpr)
+	if err != nil {
+		return nil, err
+	}
+	fields := len(t.Args) == 2
+	return func(st *state) (interface{}, error) {
+		v, err := list(st)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := elements(v)
+		if !ok {
+			return nil, fmt.Errorf("%s: %T is not a slice or map: %w", name, v, ErrUnsupportParam)
+		}
+		// 数据源中的同名变量优先
+		bind := unbound(binds, func(name string) bool {
+			_, err := field(st.root, name)
+			return err == nil
+		})
+		base := len(st.vars)
+		defer func() { st.vars = st.vars[:base] }()
+		for _, e := range values {
+			if st.limit != nil {
+				if err := st.limit.check(); err != nil {
+					return nil, err
+				}
+			}
+			st.vars = append(st.vars[:base], variable{name: elem, value: e, fields: fields})
+			if bind != "" && !hasFields(e) {
+				st.vars = append(st.vars, variable{name: bind, value: e})
+			}
+			r, err := pred(st)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := r.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s: condition is %T: %w", name, r, ErrNotBool)
+			}
+			if b != all {
+				return b, nil
+			}
+		}
+		return all, nil
+	}, nil
+}
+
+// elements 返回 slice 的元素或 map 的值，map 按键排序
+func elements(v interface{}) ([]interface{}, bool) {
+	if list, ok := sliceValues(v); ok {
+		return list, true
+	}
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	keys := rv.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		e, err := toValue(rv.MapIndex(k))
+		if err != nil {
+			return nil, false
+		}
+		values[i] = e
+	}
+	return values, true
+}
+
+// member 判断 x 是否在 y 中
+func member(x, y interface{}) (interface{}, error) {
+	if y == nil {
+		return false, nil
+	}
+	if list, ok := sliceValues(y); ok {
+		for _, e := range list {
+			if equal(x, e) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	rv := indirect(reflect.ValueOf(y))
+	switch rv.Kind() {
+	case reflect.String:
+		s, ok := str(x)
+		if !ok {
+			return nil, fmt.Errorf("in: %T in string: %w", x, ErrUnsupportParam)
+		}
+		return strings.Contains(rv.String(), s), nil
+	case reflect.Map, reflect.Struct:
+		key, ok := str(x)
+		if !ok {
+			return false, nil
+		}
+		_, err := field(y, key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return nil, fmt.Errorf("in: %T is not a slice, map or string: %w", y, ErrUnsupportParam)
+}
+
+// checkBuiltin 推导内置函数的类型
+func (c *checker) checkBuiltin(t *ast.CallExpr, name string) (*Type, error) {
+	switch name {
+	case "if":
+		if len(t.Args) != 3 {
+			return nil, c.errorf(t, ErrUnsupportParam, "if expects 3 arguments, got %d", len(t.Args))
+		}
+		var typs [3]*Type
+		for i, arg := range t.Args {
+			typ, err := c.check(arg)
+			if err != nil {
+				return nil, err
+			}
+			typs[i] = typ
+		}
+		if err := c.expect(t.Args[0], typs[0], Bool); err != nil {
+			return nil, err
+		}
+		if typs[1].String() == typs[2].String() {
+			return typs[1], nil
+		}
+		return AnyType, nil
+	case "any", "all":
+		listExpr, elem, binds, predExpr, err := quantifierArgs(t, name)
+		if err != nil {
+			return nil, c.errorf(t, ErrUnsupportParam, "%v", err)
+		}
+		list, err := c.check(listExpr)
+		if err != nil {
+			return nil, err
+		}
+		var elemType *Type
+		switch list.Kind {
+		case Any:
+			elemType = AnyType
+		case Slice:
+			elemType = list.elem()
+		case Map:
+			if len(list.Fields) > 0 {
+				elemType = AnyType
+			} else {
+				elemType = list.elem()
+			}
+		default:
+			return nil, c.errorf(listExpr, ErrUnsupportParam, "%s is %s, expected slice or map", types.ExprString(listExpr), list)
+		}
+		base := len(c.scopes)
+		c.scopes = append(c.scopes, scope{name: elem, typ: elemType, fields: len(t.Args) == 2})
+		bind := unbound(binds, func(name string) bool {
+			_, ok := c.schema[name]
+			return ok
+		})
+		if bind != "" && elemType.Kind != Any && elemType.Kind != Map {
+			c.scopes = append(c.scopes, scope{name: bind, typ: elemType})
+		}
+		pred, err := c.check(predExpr)
+		c.scopes = c.scopes[:base]
+		if err != nil {
+			return nil, err
+		}
+		return BoolType, c.expect(predExpr, pred, Bool)
+	case builtinIn:
+		if _, err := c.check(t.Args[0]); err != nil {
+			return nil, err
+		}
+		y, err := c.check(t.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		switch y.Kind {
+		case Any, Slice, Map, String:
+			return BoolType, nil
+		}
+		return nil, c.errorf(t.Args[1], ErrUnsupportParam, "%s is %s, expected slice, map or string", types.ExprString(t.Args[1]), y)
+	case builtinNullSafe:
+		x, err := c.check(t.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		sel, _ := literal(t.Args[1].(*ast.BasicLit))
+		return c.field(t.Args[1], x, sel.(string))
+	}
+	return nil, c.errorf(t, ErrFuncNotFound, "unknown function %s", name)
+}
+
+// scope 类型检查时 any、all 中元素的作用域
+type scope struct {
+	name   string
+	typ    *Type
+	fields bool
+}
+
+// lookup 在作用域中查找标志符的类型
+func (c *checker) lookup(name string) (*Type, bool) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		s := c.scopes[i]
+		if s.name == name {
+			return s.typ, true
+		}
+		if !s.fields {
+			continue
+		}
+		switch {
+		case s.typ.Kind == Any:
+			// 元素的字段未知
+			return AnyType, true
+		case s.typ.Kind == Map && len(s.typ.Fields) > 0:
+			if f, ok := s.typ.Fields[name]; ok {
+				if f == nil {
+					return AnyType, true
+				}
+				return f, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// str 返回字符串的值
+func str(v interface{}) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		return rv.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,446 @@
+package rule
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+// evalFn 编译后的表达式，求值时不修改自身，可并发调用
+type evalFn func(st *state) (interface{}, error)
+
+// state 单次求值的状态，通过 statePool 复用
+type state struct {
+	root  interface{}   // 数据源
+	args  []interface{} // 函数调用的参数栈
+	vars  []variable    // any、all 的元素作用域
+	trace *Trace        // EvalTrace 中当前的节点
+	memo  []memo        // 多次出现的字段访问的结果，见 optimize.go
+	limit *limiter      // 有 Limits 或 ctx 时不为 nil，见 limits.go
+
+	limiter limiter
+}
+
+var statePool = sync.Pool{
+	New: func() interface{} { return &state{args: make([]interface{}, 0, 16)} },
+}
+
+// compiler 将语法树编译为闭包
+type compiler struct {
+	env *Env
+	div division // / 的小数位数和舍入方式
+
+	// EvalTrace 编译时记录每个子表达式的值
+	trace bool
+	src   string
+	fset  *token.FileSet
+
+	// prepare 后启用优化
+	consts map[ast.Expr]interface{} // 已折叠的常量
+	slots  map[ast.Expr]int         // 缓存的字段访问在 state.memo 中的位置
+}
+
+func (c *compiler) compile(expr ast.Expr) (evalFn, error) {
+	fn, err := c.compileExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if !c.trace {
+		// Limits 和 ctx 在求值时才确定，总是计入步数
+		return c.limit(c.optimize(expr, fn)), nil
+	}
+	if _, ok := expr.(*ast.ParenExpr); ok {
+		return fn, nil
+	}
+	// 超出限制的节点也记录在 Trace 中
+	return c.traced(expr, c.limit(fn)), nil
+}
+
+func (c *compiler) compileExpr(expr ast.Expr) (evalFn, error) {
+	switch t := expr.(type) {
+	case *ast.UnaryExpr: // 一元表达式
+		compileX := c.compile
+		if pos, _ := span(t.X); c.trace && pos < t.OpPos {
+			// x not in y 改写为 !∈(x, y)，EvalTrace 中只记录为一个节点
+			compileX = c.compileExpr
+		}
+		x, err := compileX(t.X)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Op {
+		case token.NOT: // !
+			return func(st *state) (interface{}, error) {
+				v, err := x(st)
+				if err != nil {
+					return nil, err
+				}
+				if b, ok := v.(bool); ok {
+					return !b, nil
+				}
+				if oprd := reflect.ValueOf(v); oprd.Kind() == reflect.Bool {
+					return !oprd.Bool(), nil
+				}
+				return false, ErrNotBool
+			}, nil
+		case token.SUB: // -
+			return func(st *state) (interface{}, error) {
+				v, err := x(st)
+				if err != nil {
+					return nil, err
+				}
+				return negate(v)
+			}, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportToken, t.Op)
+	case *ast.BinaryExpr: // 二元表达式
+		return c.compileBinary(t)
+	case *ast.Ident: // 标志符（已定义变量或常量（bool））
+		switch name := t.Name; name {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "nil":
+			return constant(nil), nil
+		default:
+			return func(st *state) (interface{}, error) {
+				if len(st.vars) > 0 {
+					if v, ok := st.lookup(name); ok {
+						return v, nil
+					}
+				}
+				if m, ok := st.root.(map[string]interface{}); ok {
+					if value, ok := m[name]; ok {
+						return value, nil
+					}
+					return nil, ErrKeyNotFound
+				}
+				return field(st.root, name)
+			}, nil
+		}
+	case *ast.BasicLit: // 基本类型文字
+		v, err := literal(t)
+		if err != nil {
+			return nil, err
+		}
+		return constant(v), nil
+	case *ast.ParenExpr: // 圆括号内表达式
+		return c.compile(t.X)
+	case *ast.SelectorExpr: // 属性或方法选择表达式
+		x, err := c.compile(t.X)
+		if err != nil {
+			return nil, err
+		}
+		name := t.Sel.Name
+		return func(st *state) (interface{}, error) {
+			v, err := x(st)
+			if err != nil {
+				return nil, err
+			}
+			return field(v, name)
+		}, nil
+	case *ast.IndexExpr: // 中括号内表达式——map或slice索引
+		return c.compileIndex(t)
+	case *ast.CallExpr: // 方法调用表达式
+		return c.compileCall(t)
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportExpr, expr)
+}
+
+func constant(v interface{}) evalFn {
+	return func(*state) (interface{}, error) { return v, nil }
+}
+
+// literal 解析基本类型文字，整数为 int64（超出范围时为小数），小数为 decimal.Decimal
+func literal(t *ast.BasicLit) (interface{}, error) {
+	switch t.Kind {
+	case token.STRING:
+		return strconv.Unquote(t.Value)
+	case token.INT:
+		n, err := strconv.ParseInt(t.Value, 0, 64)
+		if err == nil {
+			return n, nil
+		}
+		if i, ok := new(big.Int).SetString(t.Value, 0); ok {
+			return decimal.NewFromBigInt(i, 0), nil
+		}
+		return nil, err
+	case token.FLOAT:
+		if d, err := decimal.NewFromString(t.Value); err == nil {
+			return d, nil
+		}
+		// 十六进制浮点数
+		f, err := strconv.ParseFloat(t.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return decimal.NewFromFloat(f), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportParam, t.Value)
+}
+
+func (c *compiler) compileBinary(t *ast.BinaryExpr) (evalFn, error) {
+	x, err := c.compile(t.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := c.compile(t.Y)
+	if err != nil {
+		return nil, err
+	}
+	op := t.Op
+	switch op {
+	case token.LSS, token.GTR, token.LEQ, token.GEQ, token.EQL, token.NEQ:
+		xf, xlit := floatLiteral(t.X)
+		yf, ylit := floatLiteral(t.Y)
+		return func(st *state) (interface{}, error) {
+			a, err := x(st)
+			if err != nil {
+				return nil, err
+			}
+			b, err := y(st)
+			if err != nil {
+				return nil, err
+			}
+			// 常见的数值类型不经过反射，也不转换为小数
+			if af, ok := fastNumber(a); ok {
+				bf, ok := fastNumber(b)
+				if !ok && ylit {
+					bf, ok = yf, true
+				}
+				if ok {
+					return compareFloat(af, bf, op), nil
+				}
+			} else if xlit {
+				if bf, ok := fastNumber(b); ok {
+					return compareFloat(xf, bf, op), nil
+				}
+			}
+			return compareValues(a, b, op)
+		}, nil
+	case token.LAND, token.LOR:
+		if a, ok := c.constValue(t.X); ok {
+			if ab, isBool := a.(bool); isBool && ab != (op == token.LOR) {
+				// true && y、false || y 的结果为 y
+				return func(st *state) (interface{}, error) {
+					b, err := y(st)
+					if err != nil {
+						return nil, err
+					}
+					if _, ok := b.(bool); ok {
+						return b, nil
+					}
+					return operate(a, b, op)
+				}, nil
+			}
+		}
+		if b, ok := c.constValue(t.Y); ok {
+			if bb, isBool := b.(bool); isBool {
+				return func(st *state) (interface{}, error) {
+					a, err := x(st)
+					if err != nil {
+						return nil, err
+					}
+					if ab, ok := a.(bool); ok {
+						if ab == (op == token.LOR) {
+							return ab, nil
+						}
+						return bb, nil
+					}
+					return operate(a, b, op)
+				}, nil
+			}
+		}
+		skip := c.skip(t.Y)
+		return func(st *state) (interface{}, error) {
+			a, err := x(st)
+			if err != nil {
+				return nil, err
+			}
+			// 短路求值：&& 左边为 false、|| 左边为 true 时不对右边求值
+			ab, isBool := a.(bool)
+			if isBool && ab == (op == token.LOR) {
+				skip(st)
+				return ab, nil
+			}
+			b, err := y(st)
+			if err != nil {
+				return nil, err
+			}
+			if bb, ok := b.(bool); ok && isBool {
+				return bb, nil
+			}
+			return operate(a, b, op)
+		}, nil
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		div := c.div
+		return func(st *state) (interface{}, error) {
+			a, err := x(st)
+			if err != nil {
+				return nil, err
+			}
+			b, err := y(st)
+			if err != nil {
+				return nil, err
+			}
+			if op == token.ADD {
+				if s, ok := concat(a, b); ok {
+					if st.limit != nil {
+						if err := st.limit.allocated(s); err != nil {
+							return nil, err
+						}
+					}
+					return s, nil
+				}
+			}
+			return arith(a, b, op, div)
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportToken, op)
+}
+
+// maxExact 绝对值不超过它的整数转换为 float64 时没有误差
+const maxExact = 1 << 53
+
+// fastNumber 返回可以无误差地按 float64 比较的数值
+func fastNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), n <= maxExact && n >= -maxExact
+	case float64:
+		return n, true
+	case int:
+		return float64(n), n <= maxExact && n >= -maxExact
+	}
+	return 0, false
+}
+
+// floatLiteral 小数常量恰好是某个 float64 的最短表示时返回该 float64，
+// 此时与 float64 按浮点数比较和按小数比较的结果相同
+func floatLiteral(expr ast.Expr) (float64, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.FLOAT {
+		return 0, false
+	}
+	v, err := literal(lit)
+	if err != nil {
+		return 0, false
+	}
+	d := v.(decimal.Decimal)
+	f := d.InexactFloat64()
+	if math.IsInf(f, 0) || !decimal.NewFromFloat(f).Equal(d) {
+		return 0, false
+	}
+	return f, true
+}
+
+func compareFloat(a, b float64, op token.Token) bool {
+	switch op {
+	case token.LSS:
+		return a < b
+	case token.GTR:
+		return a > b
+	case token.LEQ:
+		return a <= b
+	case token.GEQ:
+		return a >= b
+	case token.EQL:
+		return a == b
+	}
+	return a != b
+}
+
+func (c *compiler) compileIndex(t *ast.IndexExpr) (evalFn, error) {
+	x, err := c.compile(t.X)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.compile(t.Index)
+	if err != nil {
+		return nil, err
+	}
+	return func(st *state) (interface{}, error) {
+		data, err := x(st)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := key(st)
+		if err != nil {
+			return nil, err
+		}
+		return index(data, idx)
+	}, nil
+}
+
+func (c *compiler) compileCall(t *ast.CallExpr) (evalFn, error) {
+	ident, ok := t.Fun.(*ast.Ident)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportExpr, t.Fun)
+	}
+	name := ident.Name
+	if builtins[name] {
+		return c.compileBuiltin(t, name)
+	}
+	f, ok := c.env.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFuncNotFound, name)
+	}
+	if err := f.arity(len(t.Args)); err != nil {
+		return nil, fmt.Errorf("%w: %s %v", ErrUnsupportParam, name, err)
+	}
+	args, err := c.compileArgs(t.Args)
+	if err != nil {
+		return nil, err
+	}
+	return func(st *state) (interface{}, error) {
+		// 参数压入 state 的参数栈，调用返回后出栈
+		base := len(st.args)
+		for _, arg := range args {
+			v, err := arg(st)
+			if err != nil {
+				st.args = st.args[:base]
+				return nil, err
+			}
+			st.args = append(st.args, v)
+		}
+		// values 在调用返回后会被复用，Func.Call 不能保留
+		values := st.args[base:len(st.args):len(st.args)]
+		for i, v := range values {
+			if p := f.param(i); !p.accepts(v) {
+				st.args = st.args[:base]
+				return nil, fmt.Errorf("%s: argument %d is %T, expected %s: %w", name, i+1, v, p, kindError(p.Kind))
+			}
+		}
+		// err 为每次求值各自的变量，compileArgs 的 err 被所有求值共享
+		var (
+			v   interface{}
+			err error
+		)
+		if st.limit != nil {
+			err = st.limit.check()
+		}
+		if err == nil {
+			if f.CallContext != nil {
+				v, err = f.CallContext(st.context(), values)
+				if err != nil && st.limit != nil {
+					err = st.limit.interrupted(err)
+				}
+			} else {
+				v, err = f.Call(values)
+			}
+		}
+		if err == nil && st.limit != nil {
+			err = st.limit.allocated(v)
+		}
+		st.args = st.args[:base]
+		return v, err
+	}, nil
+}
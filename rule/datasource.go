@@ -0,0 +1,412 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// 数据源除 map[string]interface{} 外还可以是：
+//   - struct 或其指针，字段名取自 `rule:"name"`、`json:"name"` 标签或字段名，支持（指针）嵌入
+//   - map[string]T、任意类型的 slice 和数组
+//   - JSON 文档（[]byte 或 json.RawMessage），整数解析为 int64，其他数值为精确的 decimal.Decimal
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	rawType      = reflect.TypeOf(json.RawMessage(nil))
+	timeType     = reflect.TypeOf(time.Time{})
+	decimalType  = reflect.TypeOf(decimal.Decimal{})
+)
+
+// structInfo 结构体字段名到字段路径的映射，每个类型只计算一次
+type structInfo struct {
+	fields map[string][]int
+}
+
+var structCache sync.Map // reflect.Type -> *structInfo
+
+func structFields(t reflect.Type) *structInfo {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info := &structInfo{fields: map[string][]int{}}
+
+	// 按嵌入深度逐层查找，浅层的字段优先，同一层重名的字段都忽略
+	type level struct {
+		typ   reflect.Type
+		index []int
+	}
+	current := []level{{typ: t}}
+	visited := map[reflect.Type]bool{}
+	for len(current) > 0 {
+		var next []level
+		found := map[string][][]int{}
+		var order []string
+		for _, l := range current {
+			if visited[l.typ] {
+				continue
+			}
+			visited[l.typ] = true
+			for i := 0; i < l.typ.NumField(); i++ {
+				f := l.typ.Field(i)
+				index := append(append([]int(nil), l.index...), i)
+				name, tagged := fieldName(f)
+				if name == "-" {
+					continue
+				}
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if f.Anonymous && !tagged && ft.Kind() == reflect.Struct && ft != timeType && ft != decimalType {
+					next = append(next, level{typ: ft, index: index})
+					continue
+				}
+				if !f.IsExported() {
+					continue
+				}
+				if _, ok := found[name]; !ok {
+					order = append(order, name)
+				}
+				found[name] = append(found[name], index)
+			}
+		}
+		for _, name := range order {
+			if _, ok := info.fields[name]; ok || len(found[name]) > 1 {
+				continue
+			}
+			info.fields[name] = found[name][0]
+		}
+		current = next
+	}
+
+	actual, _ := structCache.LoadOrStore(t, info)
+	return actual.(*structInfo)
+}
+
+// fieldName 返回字段在规则中的名字，tagged 表示名字来自标签
+func fieldName(f reflect.StructField) (name string, tagged bool) {
+	for _, key := range []string{"rule", "json"} {
+		if tag, ok := f.Tag.Lookup(key); ok {
+			name, _, _ = strings.Cut(tag, ",")
+			if name != "" {
+				return name, true
+			}
+		}
+	}
+	return f.Name, false
+}
+
+// indirect 解除指针和接口
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// toValue 将反射得到的值转换为求值使用的值：整数为 int64（超出范围的无符号数除外），浮点数为 float64，
+// JSON 被解码，nil 指针为 nil
+func toValue(v reflect.Value) (interface{}, error) {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v = indirect(v); !v.IsValid() {
+			return nil, nil
+		}
+	}
+	if v.Type() == durationType {
+		return time.Duration(v.Int()), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := v.Uint(); n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	}
+	if v.Type() == rawType {
+		return decodeJSON(v.Bytes())
+	}
+	if !v.CanInterface() {
+		return nil, fmt.Errorf("%s can not be read", v.Type())
+	}
+	return v.Interface(), nil
+}
+
+// field 返回数据 v 中名为 name 的字段
+func field(v interface{}, name string) (interface{}, error) {
+	switch data := v.(type) {
+	case map[string]interface{}:
+		if value, ok := data[name]; ok {
+			return value, nil
+		}
+		return nil, ErrKeyNotFound
+	case json.RawMessage:
+		doc, err := decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return field(doc, name)
+	}
+
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		value := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !value.IsValid() {
+			return nil, ErrKeyNotFound
+		}
+		return toValue(value)
+	case reflect.Struct:
+		index, ok := structFields(rv.Type()).fields[name]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		for _, i := range index {
+			if rv.Kind() == reflect.Ptr {
+				if rv.IsNil() {
+					// 嵌入的指针为 nil
+					return nil, nil
+				}
+				rv = rv.Elem()
+			}
+			rv = rv.Field(i)
+		}
+		return toValue(rv)
+	case reflect.Invalid:
+		return nil, fmt.Errorf("SelectorExpr: nil has no field %s", name)
+	}
+	return nil, fmt.Errorf("SelectorExpr: %T has no field %s", v, name)
+}
+
+// index 返回 map 或 slice 数据 v 中 idx 对应的元素
+func index(v, idx interface{}) (interface{}, error) {
+	switch data := v.(type) {
+	case map[string]interface{}:
+		if key, ok := idx.(string); ok {
+			return data[key], nil
+		}
+		return nil, fmt.Errorf("map here index must be string")
+	case []interface{}:
+		i, ok := toIndex(idx)
+		if !ok {
+			return nil, fmt.Errorf("slice index index must be number")
+		}
+		if i < 0 || i >= int64(len(data)) {
+			return nil, fmt.Errorf("slice index %d out of range [0:%d]", i, len(data))
+		}
+		return data[i], nil
+	case json.RawMessage:
+		doc, err := decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return index(doc, idx)
+	}
+
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Map:
+		key, ok := idx.(string)
+		if !ok || rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map here index must be string")
+		}
+		value := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+		if !value.IsValid() {
+			return nil, nil
+		}
+		return toValue(value)
+	case reflect.Slice, reflect.Array:
+		i, ok := toIndex(idx)
+		if !ok {
+			return nil, fmt.Errorf("slice index index must be number")
+		}
+		if i < 0 || i >= int64(rv.Len()) {
+			return nil, fmt.Errorf("slice index %d out of range [0:%d]", i, rv.Len())
+		}
+		return toValue(rv.Index(int(i)))
+	case reflect.Struct:
+		if key, ok := idx.(string); ok {
+			return field(v, key)
+		}
+	}
+	return nil, fmt.Errorf("IndexExpr: unsupport data type")
+}
+
+// sliceValues 返回 slice 或数组的元素
+func sliceValues(v interface{}) ([]interface{}, bool) {
+	if list, ok := v.([]interface{}); ok {
+		return list, true
+	}
+	rv := indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		e, err := toValue(rv.Index(i))
+		if err != nil {
+			return nil, false
+		}
+		list[i] = e
+	}
+	return list, true
+}
+
+func toIndex(idx interface{}) (int64, bool) {
+	switch i := idx.(type) {
+	case int64:
+		return i, true
+	case int:
+		return int64(i), true
+	}
+	rv := reflect.ValueOf(idx)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// root 返回求值时的根数据，JSON 文档在此解码
+func root(datasource interface{}) (interface{}, error) {
+	switch data := datasource.(type) {
+	case map[string]interface{}:
+		return data, nil
+	case []byte:
+		return decodeJSON(data)
+	case json.RawMessage:
+		return decodeJSON(data)
+	}
+	return datasource, nil
+}
+
+// decodeJSON 解码 JSON，整数解码为 int64，其他数值为 decimal.Decimal
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return jsonValue(doc), nil
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		if d, err := decimal.NewFromString(t.String()); err == nil {
+			return d
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = jsonValue(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// SchemaOf 按 struct 或 map[string]T 类型的数据生成 Schema，用于 SetSchema
+func SchemaOf(sample interface{}) (Schema, error) {
+	t := reflect.TypeOf(sample)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil, errors.New("SchemaOf: nil sample")
+	}
+	typ := typeOf(t, map[reflect.Type]bool{})
+	if typ.Kind != Map {
+		return nil, fmt.Errorf("SchemaOf: %s is not a struct or map", t)
+	}
+	if typ.Fields == nil {
+		return nil, fmt.Errorf("SchemaOf: %s has no fixed fields", t)
+	}
+	return Schema(typ.Fields), nil
+}
+
+// typeOf 返回 Go 类型对应的规则类型
+func typeOf(t reflect.Type, visiting map[reflect.Type]bool) *Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case durationType:
+		return DurationType
+	case timeType:
+		return TimeType
+	case decimalType:
+		return NumberType
+	case rawType:
+		return AnyType
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return BoolType
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return NumberType
+	case reflect.String:
+		return StringType
+	case reflect.Slice, reflect.Array:
+		return SliceOf(typeOf(t.Elem(), visiting))
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return AnyType
+		}
+		return &Type{Kind: Map, Elem: typeOf(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			// 递归类型
+			return &Type{Kind: Map}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		info := structFields(t)
+		fields := make(map[string]*Type, len(info.fields))
+		for name, index := range info.fields {
+			f := t
+			for _, i := range index {
+				for f.Kind() == reflect.Ptr {
+					f = f.Elem()
+				}
+				f = f.Field(i).Type
+			}
+			fields[name] = typeOf(f, visiting)
+		}
+		return MapOf(fields)
+	}
+	return AnyType
+}
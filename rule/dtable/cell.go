@@ -0,0 +1,315 @@
+package dtable
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// 条件单元格的写法：
+//   - 空、- 或 *：任意值
+//   - 区间：[1..100)、(0..10]、[100..]、[..0)，方括号包含端点，圆括号不包含
+//   - 比较：>= 100、< 5、> 3、<= 2、= gold、!= gold
+//   - 列表：gold, silver 或 "gold", "silver"，数值、true、false 以外不加引号的值作为字符串
+//   - 排除：not(gold, silver)
+
+// cellKind 条件单元格的种类
+type cellKind int
+
+const (
+	anyCell   cellKind = iota // 任意值
+	rangeCell                 // 数值区间
+	setCell                   // 值列表，neg 为 true 时表示排除
+)
+
+// cell 解析后的条件单元格
+type cell struct {
+	kind   cellKind
+	lo, hi *decimal.Decimal // nil 表示无穷
+	loIncl bool
+	hiIncl bool
+	values []value
+	neg    bool
+}
+
+// value 单元格中的值，数值为 decimal.Decimal
+type value struct {
+	v interface{}
+}
+
+// key 用于比较两个值是否相等
+func (v value) key() string {
+	switch t := v.v.(type) {
+	case decimal.Decimal:
+		return "n:" + t.String()
+	case bool:
+		return "b:" + strconv.FormatBool(t)
+	}
+	return "s:" + v.v.(string)
+}
+
+// expr 返回值在规则表达式中的写法
+func (v value) expr() string {
+	switch t := v.v.(type) {
+	case decimal.Decimal:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return strconv.Quote(v.v.(string))
+}
+
+func (v value) number() (decimal.Decimal, bool) {
+	d, ok := v.v.(decimal.Decimal)
+	return d, ok
+}
+
+// parseValue 解析单个值
+func parseValue(s string) (value, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return value{}, fmt.Errorf("empty value")
+	case s == "true" || s == "false":
+		return value{s == "true"}, nil
+	case strings.HasPrefix(s, `"`):
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return value{}, fmt.Errorf("invalid string %s", s)
+		}
+		return value{u}, nil
+	}
+	if d, err := decimal.NewFromString(s); err == nil {
+		return value{d}, nil
+	}
+	return value{s}, nil
+}
+
+// splitList 按逗号拆分列表，引号内的逗号不拆分
+func splitList(s string) []string {
+	var items []string
+	var quoted, escaped bool
+	start := 0
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+func parseList(s string) ([]value, error) {
+	var values []value
+	for _, item := range splitList(s) {
+		v, err := parseValue(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// parseCell 解析条件单元格
+func parseCell(s string) (cell, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == "-" || s == "*":
+		return cell{kind: anyCell}, nil
+	case strings.HasPrefix(s, "not(") && strings.HasSuffix(s, ")"):
+		values, err := parseList(s[4 : len(s)-1])
+		return cell{kind: setCell, values: values, neg: true}, err
+	case strings.Contains(s, "..") && (s[0] == '[' || s[0] == '('):
+		return parseRange(s)
+	}
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		v, err := parseValue(s[len(op):])
+		if err != nil {
+			return cell{}, err
+		}
+		switch op {
+		case "=":
+			return cell{kind: setCell, values: []value{v}}, nil
+		case "!=":
+			return cell{kind: setCell, values: []value{v}, neg: true}, nil
+		}
+		d, ok := v.number()
+		if !ok {
+			return cell{}, fmt.Errorf("%s expects a number", op)
+		}
+		c := cell{kind: rangeCell}
+		switch op {
+		case ">=", ">":
+			c.lo, c.loIncl = &d, op == ">="
+		default:
+			c.hi, c.hiIncl = &d, op == "<="
+		}
+		return c, nil
+	}
+	values, err := parseList(s)
+	return cell{kind: setCell, values: values}, err
+}
+
+// parseRange 解析区间
+func parseRange(s string) (cell, error) {
+	last := s[len(s)-1]
+	if last != ']' && last != ')' {
+		return cell{}, fmt.Errorf("invalid range %s", s)
+	}
+	lo, hi, _ := strings.Cut(s[1:len(s)-1], "..")
+	c := cell{kind: rangeCell, loIncl: s[0] == '[', hiIncl: last == ']'}
+	for _, b := range []struct {
+		src string
+		dst **decimal.Decimal
+	}{{lo, &c.lo}, {hi, &c.hi}} {
+		if strings.TrimSpace(b.src) == "" {
+			continue
+		}
+		d, err := decimal.NewFromString(strings.TrimSpace(b.src))
+		if err != nil {
+			return cell{}, fmt.Errorf("invalid range %s", s)
+		}
+		*b.dst = &d
+	}
+	if c.lo != nil && c.hi != nil && (c.lo.GreaterThan(*c.hi) || c.lo.Equal(*c.hi) && !(c.loIncl && c.hiIncl)) {
+		return cell{}, fmt.Errorf("empty range %s", s)
+	}
+	return c, nil
+}
+
+// expr 返回单元格对应的规则表达式，path 为列对应的字段
+func (c *cell) expr(path string) string {
+	switch c.kind {
+	case rangeCell:
+		var parts []string
+		if c.lo != nil {
+			op := " > "
+			if c.loIncl {
+				op = " >= "
+			}
+			parts = append(parts, path+op+c.lo.String())
+		}
+		if c.hi != nil {
+			op := " < "
+			if c.hiIncl {
+				op = " <= "
+			}
+			parts = append(parts, path+op+c.hi.String())
+		}
+		return strings.Join(parts, " && ")
+	case setCell:
+		parts := make([]string, len(c.values))
+		for i, v := range c.values {
+			parts[i] = path + " == " + v.expr()
+		}
+		e := strings.Join(parts, " || ")
+		if c.neg {
+			return "!(" + e + ")"
+		}
+		if len(parts) > 1 {
+			return "(" + e + ")"
+		}
+		return e
+	}
+	return ""
+}
+
+// contains 判断数值 d 是否在区间内
+func (c *cell) contains(d decimal.Decimal) bool {
+	if c.lo != nil {
+		if cmp := d.Cmp(*c.lo); cmp < 0 || cmp == 0 && !c.loIncl {
+			return false
+		}
+	}
+	if c.hi != nil {
+		if cmp := d.Cmp(*c.hi); cmp > 0 || cmp == 0 && !c.hiIncl {
+			return false
+		}
+	}
+	return true
+}
+
+// has 判断值列表是否包含 v（不考虑 neg）
+func (c *cell) has(v value) bool {
+	for _, e := range c.values {
+		if e.key() == v.key() {
+			return true
+		}
+	}
+	return false
+}
+
+// intersects 判断两个单元格是否可能同时匹配某个值
+func intersects(a, b *cell) bool {
+	switch {
+	case a.kind == anyCell || b.kind == anyCell:
+		return true
+	case a.kind == rangeCell && b.kind == rangeCell:
+		return rangesIntersect(a, b)
+	case a.kind == rangeCell:
+		return rangeSetIntersect(a, b)
+	case b.kind == rangeCell:
+		return rangeSetIntersect(b, a)
+	}
+	switch {
+	case a.neg && b.neg:
+		return true
+	case a.neg:
+		a, b = b, a
+		fallthrough
+	case b.neg:
+		for _, v := range a.values {
+			if !b.has(v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range a.values {
+		if b.has(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func rangesIntersect(a, b *cell) bool {
+	// a 的下界不超过 b 的上界，且 b 的下界不超过 a 的上界
+	below := func(lo *decimal.Decimal, loIncl bool, hi *decimal.Decimal, hiIncl bool) bool {
+		if lo == nil || hi == nil {
+			return true
+		}
+		cmp := lo.Cmp(*hi)
+		return cmp < 0 || cmp == 0 && loIncl && hiIncl
+	}
+	return below(a.lo, a.loIncl, b.hi, b.hiIncl) && below(b.lo, b.loIncl, a.hi, a.hiIncl)
+}
+
+func rangeSetIntersect(r, s *cell) bool {
+	if s.neg {
+		// 区间内有无穷多个值，除非区间只有一个点
+		if r.lo != nil && r.hi != nil && r.lo.Equal(*r.hi) {
+			return !s.has(value{*r.lo})
+		}
+		return true
+	}
+	for _, v := range s.values {
+		if d, ok := v.number(); ok && r.contains(d) {
+			return true
+		}
+	}
+	return false
+}
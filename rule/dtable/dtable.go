@@ -0,0 +1,590 @@
+// Package dtable 读取 CSV 格式的决策表，每一行编译为一条规则表达式。
+//
+// 表头中以 out: 开头的列为输出列，@priority 列为行的优先级，其他列为条件列，
+// 列名是数据源中的字段，如 order.amount。条件单元格的写法见 parseCell，
+// 输出单元格为数值、true、false、带引号或不带引号的字符串，以 = 开头时为按数据源求值的表达式，
+// 空的输出单元格不出现在结果中。
+//
+//	tier,         order.amount, @priority, out:discount, out:note
+//	"gold,silver", [100..],     10,        0.1,          vip
+//	-,            [0..100),     0,         0,
+package dtable
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/carmel/go-util/rule"
+	"github.com/shopspring/decimal"
+)
+
+// HitPolicy 多行匹配时的处理方式
+type HitPolicy string
+
+const (
+	First    HitPolicy = "FIRST"    // 返回第一个匹配的行
+	Unique   HitPolicy = "UNIQUE"   // 行之间不能重叠，最多一行匹配
+	Collect  HitPolicy = "COLLECT"  // 返回所有匹配的行
+	Priority HitPolicy = "PRIORITY" // 返回 @priority 最大的行，相同时返回靠前的行
+)
+
+const (
+	outputPrefix   = "out:"
+	priorityColumn = "@priority"
+)
+
+// 错误定义
+var (
+	ErrOverlap = errors.New("overlapping rows")
+	ErrIssues  = errors.New("decision table has issues")
+)
+
+// Options 解析选项
+type Options struct {
+	HitPolicy HitPolicy // 默认为 FIRST
+	Env       *rule.Env // 规则可以调用的函数，nil 时使用标准函数库
+	Strict    bool      // 有 Issue 时返回错误
+	Comma     rune      // 字段分隔符，默认为 ','
+}
+
+// Issue 加载时发现的问题
+type Issue struct {
+	Kind   string // overlap、gap 或 incomplete
+	Lines  []int  // 相关的行号
+	Column string
+	Msg    string
+}
+
+func (i Issue) String() string {
+	lines := make([]string, len(i.Lines))
+	for k, l := range i.Lines {
+		lines[k] = strconv.Itoa(l)
+	}
+	s := i.Kind
+	if len(lines) > 0 {
+		s += " at line " + strings.Join(lines, ", ")
+	}
+	if i.Column != "" {
+		s += " column " + i.Column
+	}
+	return s + ": " + i.Msg
+}
+
+// Row 决策表的一行
+type Row struct {
+	Line     int    // CSV 中的行号
+	Expr     string // 条件编译后的规则表达式
+	Priority int
+
+	cells   []cell
+	when    *rule.Rule
+	outputs []output
+}
+
+type output struct {
+	name  string
+	value interface{}
+	expr  *rule.Rule // 非 nil 时按数据源求值
+}
+
+// Match 匹配的行及其输出
+type Match struct {
+	Line    int
+	Outputs map[string]interface{}
+}
+
+// Table 编译后的决策表，可以并发求值
+type Table struct {
+	policy  HitPolicy
+	inputs  []string
+	outputs []string
+	rows    []*Row
+	issues  []Issue
+
+	// 索引：第一个只包含字符串列表和任意值的条件列
+	index    int // -1 表示没有索引
+	indexKey *rule.Rule
+	keyRows  map[string][]int
+	anyRows  []int
+}
+
+// Load 读取 CSV 文件
+func Load(path string, opt Options) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := Parse(f, opt)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Parse 读取并编译决策表，UNIQUE 中重叠的行返回 ErrOverlap，
+// 其他问题记录在 Issues 中，Strict 时返回 ErrIssues
+func Parse(r io.Reader, opt Options) (*Table, error) {
+	t := &Table{policy: opt.HitPolicy, index: -1}
+	if t.policy == "" {
+		t.policy = First
+	}
+	t.policy = HitPolicy(strings.ToUpper(string(t.policy)))
+	switch t.policy {
+	case First, Unique, Collect, Priority:
+	default:
+		return nil, fmt.Errorf("unknown hit policy %s", opt.HitPolicy)
+	}
+
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.LazyQuotes = true // 允许表达式中的字符串
+	cr.Comment = '#'
+	if opt.Comma != 0 {
+		cr.Comma = opt.Comma
+	}
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 列的种类：条件列在 inputs 中的下标，-1 为 @priority，其他为 -2 - 输出列的下标
+	cols := make([]int, len(header))
+	prio := false
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		switch {
+		case strings.EqualFold(h, priorityColumn):
+			prio = true
+			cols[i] = -1
+		case strings.HasPrefix(h, outputPrefix):
+			name := strings.TrimSpace(h[len(outputPrefix):])
+			if name == "" {
+				return nil, fmt.Errorf("column %d: empty output name", i+1)
+			}
+			cols[i] = -2 - len(t.outputs)
+			t.outputs = append(t.outputs, name)
+		default:
+			if err := (&rule.Rule{}).SetExpr(h); err != nil {
+				return nil, fmt.Errorf("column %d: invalid input %q: %w", i+1, h, err)
+			}
+			cols[i] = len(t.inputs)
+			t.inputs = append(t.inputs, h)
+		}
+	}
+	if len(t.outputs) == 0 {
+		return nil, errors.New("no output columns")
+	}
+	if t.policy == Priority && !prio {
+		return nil, fmt.Errorf("hit policy %s requires a %s column", Priority, priorityColumn)
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		row, err := t.parseRow(record, cols, line, opt.Env)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		t.rows = append(t.rows, row)
+	}
+	if len(t.rows) == 0 {
+		return nil, errors.New("no rows")
+	}
+
+	t.check()
+	if t.policy == Unique {
+		for _, issue := range t.issues {
+			if issue.Kind == "overlap" {
+				return nil, fmt.Errorf("%w: %s", ErrOverlap, issue)
+			}
+		}
+	}
+	if opt.Strict && len(t.issues) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrIssues, t.issues[0])
+	}
+	if err := t.buildIndex(opt.Env); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Table) parseRow(record []string, cols []int, line int, env *rule.Env) (*Row, error) {
+	row := &Row{Line: line, cells: make([]cell, len(t.inputs))}
+	var conds []string
+	for i, s := range record {
+		switch k := cols[i]; {
+		case k >= 0:
+			c, err := parseCell(s)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", t.inputs[k], err)
+			}
+			row.cells[k] = c
+			if e := c.expr(t.inputs[k]); e != "" {
+				conds = append(conds, e)
+			}
+		case k == -1:
+			if s = strings.TrimSpace(s); s != "" {
+				p, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: invalid priority %q", priorityColumn, s)
+				}
+				row.Priority = p
+			}
+		default:
+			name := t.outputs[-2-k]
+			o, ok, err := parseOutput(name, s, env)
+			if err != nil {
+				return nil, fmt.Errorf("column %s%s: %w", outputPrefix, name, err)
+			}
+			if ok {
+				row.outputs = append(row.outputs, o)
+			}
+		}
+	}
+	row.Expr = strings.Join(conds, " && ")
+	if row.Expr == "" {
+		row.Expr = "true"
+	}
+	row.when = &rule.Rule{}
+	row.when.SetEnv(env)
+	if err := row.when.SetExpr(row.Expr); err != nil {
+		return nil, fmt.Errorf("%s: %w", row.Expr, err)
+	}
+	return row, nil
+}
+
+// parseOutput 解析输出单元格，ok 为 false 表示单元格为空
+func parseOutput(name, s string, env *rule.Env) (o output, ok bool, err error) {
+	o.name = name
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return o, false, nil
+	case strings.HasPrefix(s, "="):
+		o.expr = &rule.Rule{}
+		o.expr.SetEnv(env)
+		return o, true, o.expr.SetExpr(strings.TrimSpace(s[1:]))
+	}
+	v, err := parseValue(s)
+	if err != nil {
+		return o, false, err
+	}
+	o.value = v.v
+	if d, isNum := v.number(); isNum {
+		// 与规则表达式的字面量一致：整数为 int64，其他为 decimal.Decimal
+		if d.IsInteger() && d.Equal(decimal.NewFromInt(d.IntPart())) {
+			o.value = d.IntPart()
+		}
+	}
+	return o, true, nil
+}
+
+// check 检查重叠、未覆盖的区间及没有输出的行
+func (t *Table) check() {
+	for _, row := range t.rows {
+		if len(row.outputs) == 0 {
+			t.issues = append(t.issues, Issue{Kind: "incomplete", Lines: []int{row.Line}, Msg: "row has no output"})
+		}
+	}
+	if t.policy != Collect {
+		for i, a := range t.rows {
+			for _, b := range t.rows[i+1:] {
+				if overlaps(a, b) && (t.policy != Priority || a.Priority == b.Priority) {
+					t.issues = append(t.issues, Issue{Kind: "overlap", Lines: []int{a.Line, b.Line}, Msg: "rows can match the same input"})
+				}
+			}
+		}
+	}
+	for k, name := range t.inputs {
+		if msg := t.gaps(k); msg != "" {
+			t.issues = append(t.issues, Issue{Kind: "gap", Column: name, Msg: msg})
+		}
+	}
+}
+
+func overlaps(a, b *Row) bool {
+	for k := range a.cells {
+		if !intersects(&a.cells[k], &b.cells[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// gaps 返回数值条件列中没有被任何行覆盖的区间，列中有任意值或非数值的单元格时不检查
+func (t *Table) gaps(k int) string {
+	var ranges []cell
+	for _, row := range t.rows {
+		c := row.cells[k]
+		switch {
+		case c.kind == rangeCell:
+			ranges = append(ranges, c)
+		case c.kind == setCell && !c.neg:
+			for _, v := range c.values {
+				d, ok := v.number()
+				if !ok {
+					return ""
+				}
+				ranges = append(ranges, cell{kind: rangeCell, lo: &d, hi: &d, loIncl: true, hiIncl: true})
+			}
+		default:
+			return ""
+		}
+	}
+	// 按下界排序后依次合并
+	sort.SliceStable(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		switch {
+		case a.lo == nil || b.lo == nil:
+			return a.lo == nil && b.lo != nil
+		case !a.lo.Equal(*b.lo):
+			return a.lo.LessThan(*b.lo)
+		}
+		return a.loIncl && !b.loIncl
+	})
+	var missing []string
+	if ranges[0].lo != nil {
+		missing = append(missing, bound("(", nil, ranges[0].lo, !ranges[0].loIncl))
+	}
+	hi, hiIncl := ranges[0].hi, ranges[0].hiIncl
+	for _, r := range ranges[1:] {
+		if hi == nil {
+			break
+		}
+		// 没有下界的范围不会留下空隙，只扩展已覆盖的上界
+		if r.lo != nil {
+			if cmp := r.lo.Cmp(*hi); cmp > 0 || cmp == 0 && !r.loIncl && !hiIncl {
+				open := "("
+				if !hiIncl {
+					open = "["
+				}
+				missing = append(missing, bound(open, hi, r.lo, !r.loIncl))
+			}
+		}
+		if r.hi == nil {
+			hi = nil
+		} else if cmp := r.hi.Cmp(*hi); cmp > 0 || cmp == 0 && r.hiIncl {
+			hi, hiIncl = r.hi, r.hiIncl
+		}
+	}
+	if hi != nil {
+		open := "("
+		if !hiIncl {
+			open = "["
+		}
+		missing = append(missing, bound(open, hi, nil, false))
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+	return "not covered " + strings.Join(missing, ", ")
+}
+
+func bound(open string, lo, hi *decimal.Decimal, hiIncl bool) string {
+	s := open
+	if lo != nil {
+		s += lo.String()
+	}
+	s += ".."
+	if hi != nil {
+		s += hi.String()
+	}
+	if hiIncl {
+		return s + "]"
+	}
+	return s + ")"
+}
+
+// buildIndex 为第一个只包含字符串列表和任意值的条件列建立索引
+func (t *Table) buildIndex(env *rule.Env) error {
+	for k := range t.inputs {
+		indexable, discrete := true, false
+		for _, row := range t.rows {
+			c := row.cells[k]
+			if c.kind == anyCell {
+				continue
+			}
+			discrete = true
+			if c.kind != setCell || c.neg {
+				indexable = false
+				break
+			}
+			for _, v := range c.values {
+				if _, ok := v.v.(string); !ok {
+					indexable = false
+				}
+			}
+		}
+		if !indexable || !discrete {
+			continue
+		}
+		key := &rule.Rule{}
+		key.SetEnv(env)
+		if err := key.SetExpr(t.inputs[k]); err != nil {
+			return fmt.Errorf("column %s: %w", t.inputs[k], err)
+		}
+		t.index, t.indexKey, t.keyRows = k, key, map[string][]int{}
+		for i, row := range t.rows {
+			c := row.cells[k]
+			if c.kind == anyCell {
+				t.anyRows = append(t.anyRows, i)
+				continue
+			}
+			for _, v := range c.values {
+				s := v.v.(string)
+				if rows := t.keyRows[s]; len(rows) == 0 || rows[len(rows)-1] != i {
+					t.keyRows[s] = append(rows, i)
+				}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// candidates 返回可能匹配的行的下标，按行的顺序排列
+func (t *Table) candidates(datasource interface{}) ([]int, error) {
+	if t.index < 0 {
+		return nil, nil
+	}
+	v, err := t.indexKey.Eval(datasource)
+	if err != nil {
+		if errors.Is(err, rule.ErrKeyNotFound) {
+			return t.anyRows, nil
+		}
+		return nil, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return t.anyRows, nil
+	}
+	a, b := t.keyRows[s], t.anyRows
+	rows := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		if len(b) == 0 || len(a) > 0 && a[0] < b[0] {
+			rows, a = append(rows, a[0]), a[1:]
+		} else {
+			rows, b = append(rows, b[0]), b[1:]
+		}
+	}
+	return rows, nil
+}
+
+// Eval 按命中策略返回匹配的行，FIRST、UNIQUE、PRIORITY 最多返回一行，COLLECT 按行的顺序返回所有匹配的行
+func (t *Table) Eval(datasource interface{}) ([]Match, error) {
+	rows, err := t.candidates(datasource)
+	if err != nil {
+		return nil, err
+	}
+	n := len(rows)
+	if t.index < 0 {
+		n = len(t.rows)
+	}
+	var (
+		matches []Match
+		best    *Row
+	)
+rows:
+	for i := 0; i < n; i++ {
+		row := t.rows[i]
+		if t.index >= 0 {
+			row = t.rows[rows[i]]
+		}
+		ok, err := row.when.Bool(datasource)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", row.Line, err)
+		}
+		if !ok {
+			continue
+		}
+		switch t.policy {
+		case Collect:
+			m, err := row.match(datasource)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, m)
+			continue
+		case Priority:
+			if best == nil || row.Priority > best.Priority {
+				best = row
+			}
+			continue
+		}
+		best = row
+		break rows
+	}
+	if best != nil {
+		m, err := best.match(datasource)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+// Lookup 返回第一个匹配的行的输出，ok 为 false 表示没有匹配的行
+func (t *Table) Lookup(datasource interface{}) (outputs map[string]interface{}, ok bool, err error) {
+	matches, err := t.Eval(datasource)
+	if err != nil || len(matches) == 0 {
+		return nil, false, err
+	}
+	return matches[0].Outputs, true, nil
+}
+
+func (row *Row) match(datasource interface{}) (Match, error) {
+	m := Match{Line: row.Line, Outputs: make(map[string]interface{}, len(row.outputs))}
+	for _, o := range row.outputs {
+		if o.expr == nil {
+			m.Outputs[o.name] = o.value
+			continue
+		}
+		v, err := o.expr.Eval(datasource)
+		if err != nil {
+			return Match{}, fmt.Errorf("line %d: %s%s: %w", row.Line, outputPrefix, o.name, err)
+		}
+		m.Outputs[o.name] = v
+	}
+	return m, nil
+}
+
+// HitPolicy 返回命中策略
+func (t *Table) HitPolicy() HitPolicy {
+	return t.policy
+}
+
+// Inputs 返回条件列的字段
+func (t *Table) Inputs() []string {
+	return t.inputs
+}
+
+// Outputs 返回输出列的名字
+func (t *Table) Outputs() []string {
+	return t.outputs
+}
+
+// Rows 返回所有的行，调用方不应修改
+func (t *Table) Rows() []*Row {
+	return t.rows
+}
+
+// Issues 返回加载时发现的问题
+func (t *Table) Issues() []Issue {
+	return t.issues
+}
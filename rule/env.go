@@ -0,0 +1,170 @@
+package rule
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"reflect"
+	"time"
+)
+
+// Func 可在规则中调用的函数
+type Func struct {
+	Params   []*Type // 参数类型，nil 表示任意类型
+	Variadic bool    // 最后一个参数可以出现零到多次
+	Optional int     // 最后 Optional 个参数可以省略
+	Result   *Type   // 返回值类型，nil 表示任意类型
+	// Call 的 args 取自求值时复用的参数栈，调用返回后会被改写，需要保留时应复制
+	Call func(args []interface{}) (interface{}, error)
+	// CallContext 不为 nil 时代替 Call，ctx 为 EvalContext 的 ctx 或 Limits.Timeout 的截止时间，args 与 Call 相同
+	CallContext func(ctx context.Context, args []interface{}) (interface{}, error)
+}
+
+// arity 检查参数个数
+func (f *Func) arity(n int) error {
+	min, max := len(f.Params)-f.Optional, len(f.Params)
+	switch {
+	case f.Variadic:
+		if f.Optional == 0 {
+			min--
+		}
+		if n < min {
+			return fmt.Errorf("expects at least %d arguments, got %d", min, n)
+		}
+	case min == max && n != min:
+		return fmt.Errorf("expects %d arguments, got %d", min, n)
+	case n < min || n > max:
+		return fmt.Errorf("expects %d to %d arguments, got %d", min, max, n)
+	}
+	return nil
+}
+
+// param 返回第 i 个参数的类型
+func (f *Func) param(i int) *Type {
+	if i >= len(f.Params) {
+		i = len(f.Params) - 1
+	}
+	if i < 0 || f.Params[i] == nil {
+		return AnyType
+	}
+	return f.Params[i]
+}
+
+// Env 规则可以调用的函数集合
+type Env struct {
+	funcs map[string]*Func
+	// Now 为 now() 的时间来源，默认 time.Now
+	Now func() time.Time
+	div *division
+}
+
+// FuncRegistry 为 Env 的别名
+type FuncRegistry = Env
+
+// NewEnv 返回包含标准函数库的 Env
+func NewEnv() *Env {
+	e := &Env{funcs: map[string]*Func{}}
+	registerStdlib(e)
+	return e
+}
+
+// defaultEnv 未调用 SetEnv 时使用，只包含标准函数库
+var defaultEnv = NewEnv()
+
+// Register 注册或替换函数 name
+func (e *Env) Register(name string, f *Func) error {
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("invalid function name %q", name)
+	}
+	if builtins[name] {
+		return fmt.Errorf("%s is a builtin function", name)
+	}
+	if f == nil || f.Call == nil && f.CallContext == nil {
+		return fmt.Errorf("function %s has no Call", name)
+	}
+	if f.Variadic && len(f.Params) == 0 {
+		return fmt.Errorf("variadic function %s has no parameters", name)
+	}
+	if f.Optional < 0 || f.Optional > len(f.Params) {
+		return fmt.Errorf("function %s has %d optional of %d parameters", name, f.Optional, len(f.Params))
+	}
+	if e.funcs == nil {
+		e.funcs = map[string]*Func{}
+	}
+	e.funcs[name] = f
+	return nil
+}
+
+// Lookup 查找函数 name
+func (e *Env) Lookup(name string) (*Func, bool) {
+	f, ok := e.funcs[name]
+	return f, ok
+}
+
+// SetDivision 设置 / 的结果保留的小数位数及舍入方式，默认保留 16 位、四舍五入，需在 SetExpr 之前调用
+func (e *Env) SetDivision(places int32, mode RoundingMode) {
+	e.div = &division{places: places, mode: mode}
+}
+
+func (e *Env) division() division {
+	if e.div != nil {
+		return *e.div
+	}
+	return defaultDivision
+}
+
+func (e *Env) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
+
+// SetEnv 设置规则可以调用的函数，需在 SetExpr 之前调用
+func (r *Rule) SetEnv(env *Env) {
+	r.env = env
+}
+
+// accepts 判断运行时的值是否属于类型 t
+func (t *Type) accepts(v interface{}) bool {
+	if t == nil {
+		return true
+	}
+	switch t.Kind {
+	case Bool:
+		_, ok := v.(bool)
+		return ok || reflect.ValueOf(v).Kind() == reflect.Bool
+	case Number:
+		return toNum(v).kind != notNum
+	case String:
+		_, ok := v.(string)
+		return ok || reflect.ValueOf(v).Kind() == reflect.String
+	case Map:
+		if _, ok := v.(map[string]interface{}); ok {
+			return true
+		}
+		k := indirect(reflect.ValueOf(v)).Kind()
+		return k == reflect.Map || k == reflect.Struct
+	case Slice:
+		_, ok := sliceValues(v)
+		return ok
+	case Time:
+		_, ok := v.(time.Time)
+		return ok
+	case Duration:
+		_, ok := v.(time.Duration)
+		return ok
+	}
+	return true
+}
+
+// kindError 返回与类型 k 不匹配时的错误
+func kindError(k Kind) error {
+	switch k {
+	case Bool:
+		return ErrNotBool
+	case Number, Duration:
+		return ErrNotNumber
+	}
+	return ErrUnsupportParam
+}
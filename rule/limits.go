@@ -0,0 +1,208 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"reflect"
+	"time"
+)
+
+// 超出 Limits 时 LimitError 的 Err
+var (
+	ErrDepthLimit = errors.New("expression too deep")
+	ErrStepLimit  = errors.New("too many evaluation steps")
+	ErrTimeLimit  = errors.New("evaluation deadline exceeded")
+	ErrAllocLimit = errors.New("allocation limit exceeded")
+)
+
+// Limits 求值的资源限制，零值表示不限制
+type Limits struct {
+	MaxDepth int           // 语法树的最大深度，SetExpr 及求值时检查
+	MaxSteps int64         // 一次求值最多计算的子表达式个数
+	MaxAlloc int64         // 一次求值中字符串连接及函数返回的字符串、slice、map 的总字节数
+	Timeout  time.Duration // 一次求值的最长时间，与 EvalContext 的 ctx 同时生效
+}
+
+// LimitError 超出 Limits 或 ctx 的截止时间，可用 errors.Is 判断是哪一种限制
+type LimitError struct {
+	Err   error // ErrDepthLimit、ErrStepLimit、ErrTimeLimit 或 ErrAllocLimit
+	Limit int64 // 超出的限制，ErrTimeLimit 时为 0
+	Cause error // ErrTimeLimit 时为 context.DeadlineExceeded
+}
+
+func (e *LimitError) Error() string {
+	if e.Limit > 0 {
+		return fmt.Sprintf("%v (limit %d)", e.Err, e.Limit)
+	}
+	return e.Err.Error()
+}
+
+func (e *LimitError) Unwrap() []error {
+	if e.Cause != nil {
+		return []error{e.Err, e.Cause}
+	}
+	return []error{e.Err}
+}
+
+// SetLimits 设置求值的资源限制，可在 SetExpr 之前或之后调用
+func (r *Rule) SetLimits(limits Limits) {
+	r.limits = limits
+}
+
+// checkDepth 检查语法树的深度，SetLimits 可能在 SetExpr 之后调用
+func (r *Rule) checkDepth() error {
+	if max := r.limits.MaxDepth; max > 0 && r.depth > max {
+		return &LimitError{Err: ErrDepthLimit, Limit: int64(max)}
+	}
+	return nil
+}
+
+// limit 按 Limits 和 ctx 设置 st 的资源限制，求值结束后调用返回的 cancel
+func (r *Rule) limit(ctx context.Context, st *state) context.CancelFunc {
+	cancel := func() {}
+	if r.limits.Timeout > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, cancel = context.WithTimeout(ctx, r.limits.Timeout)
+	}
+	if ctx != nil || r.limits != (Limits{}) {
+		st.limiter = limiter{ctx: ctx, maxSteps: r.limits.MaxSteps, maxAlloc: r.limits.MaxAlloc}
+		if ctx != nil {
+			st.limiter.done = ctx.Done()
+		}
+		st.limit = &st.limiter
+	}
+	return cancel
+}
+
+// EvalContext 与 Eval 相同，ctx 取消或超过截止时间时停止求值，
+// 注册的函数只有通过 Func.CallContext 实现时才能在调用过程中被中断
+func (r *Rule) EvalContext(ctx context.Context, datasource interface{}) (interface{}, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return r.eval(ctx, datasource)
+}
+
+// limiter 一次求值的资源使用
+type limiter struct {
+	ctx      context.Context
+	done     <-chan struct{}
+	steps    int64
+	maxSteps int64
+	alloc    int64
+	maxAlloc int64
+}
+
+// step 计算一个子表达式，每 64 步检查一次 ctx，只有 ctx 时也会检查
+func (l *limiter) step() error {
+	l.steps++
+	if l.maxSteps > 0 && l.steps > l.maxSteps {
+		return &LimitError{Err: ErrStepLimit, Limit: l.maxSteps}
+	}
+	if l.steps&63 == 0 {
+		return l.check()
+	}
+	return nil
+}
+
+// check 检查 ctx 是否已取消或超时
+func (l *limiter) check() error {
+	if l.done == nil {
+		return nil
+	}
+	select {
+	case <-l.done:
+		err := l.ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &LimitError{Err: ErrTimeLimit, Cause: err}
+		}
+		return err
+	default:
+		return nil
+	}
+}
+
+// interrupted 函数因 ctx 超时返回的错误转换为 ErrTimeLimit
+func (l *limiter) interrupted(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		if e := l.check(); e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+// allocated 记录求值中产生的值占用的字节数
+func (l *limiter) allocated(v interface{}) error {
+	if l.maxAlloc <= 0 {
+		return nil
+	}
+	l.alloc += sizeOf(v)
+	if l.alloc > l.maxAlloc {
+		return &LimitError{Err: ErrAllocLimit, Limit: l.maxAlloc}
+	}
+	return nil
+}
+
+// sizeOf 估计字符串、slice、map 占用的字节数，不计算元素引用的内存
+func sizeOf(v interface{}) int64 {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(t))
+	case []byte:
+		return int64(len(t))
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return int64(rv.Len())
+	case reflect.Slice:
+		return int64(rv.Len()) * int64(rv.Type().Elem().Size())
+	case reflect.Map:
+		return int64(rv.Len()) * int64(rv.Type().Key().Size()+rv.Type().Elem().Size())
+	}
+	return 0
+}
+
+// context 返回注册的函数使用的 ctx
+func (st *state) context() context.Context {
+	if st.limit != nil && st.limit.ctx != nil {
+		return st.limit.ctx
+	}
+	return context.Background()
+}
+
+// limit 有步数限制时每个子表达式计一步
+func (c *compiler) limit(fn evalFn) evalFn {
+	return func(st *state) (interface{}, error) {
+		if st.limit != nil {
+			if err := st.limit.step(); err != nil {
+				return nil, err
+			}
+		}
+		return fn(st)
+	}
+}
+
+// depth 返回语法树的深度
+func depth(expr ast.Expr) int {
+	max, cur := 0, 0
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if n == nil {
+			cur--
+			return false
+		}
+		cur++
+		if cur > max {
+			max = cur
+		}
+		return true
+	})
+	return max
+}
@@ -0,0 +1,288 @@
+package rule
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// Format 返回表达式的规范形式：运算符两边各一个空格，逗号后一个空格，
+// 去掉多余的圆括号，in、not in、?.、if 按原写法输出
+func Format(expr string) (string, error) {
+	if strings.TrimSpace(expr) == "" {
+		return "", ErrRuleEmpty
+	}
+	exp, err := parseExpr(token.NewFileSet(), expr)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	format(&b, exp, 0)
+	return b.String(), nil
+}
+
+// format 输出表达式，prec 为不加圆括号时表达式需要的最低优先级，多余的圆括号去掉
+func format(b *strings.Builder, expr ast.Expr, prec int) {
+	switch t := expr.(type) {
+	case *ast.ParenExpr:
+		x := unparen(t.X)
+		if precedence(x) >= prec {
+			format(b, x, prec)
+			return
+		}
+		b.WriteByte('(')
+		format(b, x, 0)
+		b.WriteByte(')')
+	case *ast.BinaryExpr:
+		p := t.Op.Precedence()
+		format(b, t.X, p)
+		b.WriteString(" " + t.Op.String() + " ")
+		format(b, t.Y, p+1)
+	case *ast.UnaryExpr:
+		if call, ok := t.X.(*ast.CallExpr); ok && t.Op == token.NOT && funcName(call) == builtinIn {
+			format(b, call.Args[0], token.EQL.Precedence())
+			b.WriteString(" not in ")
+			format(b, call.Args[1], token.EQL.Precedence()+1)
+			return
+		}
+		b.WriteString(t.Op.String())
+		if x, ok := unparen(t.X).(*ast.UnaryExpr); ok && x.Op == t.Op && t.Op == token.SUB {
+			// - -x 不能写作 --x
+			b.WriteByte(' ')
+		}
+		format(b, t.X, token.UnaryPrec)
+	case *ast.SelectorExpr:
+		format(b, t.X, token.HighestPrec)
+		b.WriteString("." + t.Sel.Name)
+	case *ast.IndexExpr:
+		format(b, t.X, token.HighestPrec)
+		b.WriteByte('[')
+		format(b, t.Index, 0)
+		b.WriteByte(']')
+	case *ast.CallExpr:
+		switch funcName(t) {
+		case builtinIn:
+			format(b, t.Args[0], token.EQL.Precedence())
+			b.WriteString(" in ")
+			format(b, t.Args[1], token.EQL.Precedence()+1)
+			return
+		case builtinNullSafe:
+			format(b, t.Args[0], token.HighestPrec)
+			name, _ := strconv.Unquote(t.Args[1].(*ast.BasicLit).Value)
+			if t.Fun.Pos() == t.Lparen-1 {
+				// a?.b.c 中 ?. 之后的 .c
+				b.WriteString("." + name)
+			} else {
+				b.WriteString("?." + name)
+			}
+			return
+		}
+		format(b, t.Fun, token.HighestPrec)
+		b.WriteByte('(')
+		for i, arg := range t.Args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, arg, 0)
+		}
+		b.WriteByte(')')
+	default:
+		b.WriteString(types.ExprString(expr))
+	}
+}
+
+// precedence 返回表达式的优先级，in、not in 与 == 相同
+func precedence(expr ast.Expr) int {
+	switch t := expr.(type) {
+	case *ast.BinaryExpr:
+		return t.Op.Precedence()
+	case *ast.UnaryExpr:
+		if call, ok := t.X.(*ast.CallExpr); ok && t.Op == token.NOT && funcName(call) == builtinIn {
+			return token.EQL.Precedence()
+		}
+		return token.UnaryPrec
+	case *ast.CallExpr:
+		if funcName(t) == builtinIn {
+			return token.EQL.Precedence()
+		}
+	}
+	return token.HighestPrec
+}
+
+// unparen 去掉外层的圆括号
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		p, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.X
+	}
+}
+
+// funcName 返回函数调用的函数名
+func funcName(call *ast.CallExpr) string {
+	if ident, ok := call.Fun.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// Warning Lint 发现的可疑写法
+type Warning struct {
+	Pos  token.Position // Offset、Line、Column 均按字节计算
+	Expr string         // 可疑的子表达式
+	Msg  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%d:%d: %s", w.Pos.Line, w.Pos.Column, w.Msg)
+}
+
+// Lint 检查表达式中的可疑写法：小数的 == 和 !=、值为常量的条件、env 中没有的函数，
+// env 为 nil 时使用标准函数库，表达式无法解析时返回错误
+func Lint(expr string, env *Env) ([]Warning, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, ErrRuleEmpty
+	}
+	fset := token.NewFileSet()
+	exp, err := parseExpr(fset, expr)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		env = defaultEnv
+	}
+	l := &linter{src: expr, fset: fset, env: env}
+	l.cond(exp)
+	return l.warnings, nil
+}
+
+type linter struct {
+	src      string
+	fset     *token.FileSet
+	env      *Env
+	warnings []Warning
+}
+
+func (l *linter) warn(expr ast.Expr, format string, args ...interface{}) {
+	pos, end := span(expr)
+	file := l.fset.File(pos)
+	l.warnings = append(l.warnings, Warning{
+		Pos:  l.fset.Position(pos),
+		Expr: l.src[file.Offset(pos):file.Offset(end)],
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// cond 检查作为条件使用的表达式，值为常量的布尔表达式只报告最外层
+func (l *linter) cond(expr ast.Expr) {
+	if constExpr(expr) {
+		prog, err := (&compiler{env: l.env, div: l.env.division()}).compile(expr)
+		if err == nil {
+			if v, err := prog(&state{}); err == nil {
+				if b, ok := v.(bool); ok {
+					l.warn(expr, "condition is always %t", b)
+					return
+				}
+			}
+		}
+	}
+	l.walk(expr)
+}
+
+func (l *linter) walk(expr ast.Expr) {
+	switch t := expr.(type) {
+	case *ast.ParenExpr:
+		l.walk(t.X)
+	case *ast.UnaryExpr:
+		if t.Op == token.NOT {
+			l.cond(t.X)
+		} else {
+			l.walk(t.X)
+		}
+	case *ast.BinaryExpr:
+		switch t.Op {
+		case token.LAND, token.LOR:
+			l.cond(t.X)
+			l.cond(t.Y)
+			return
+		case token.EQL, token.NEQ:
+			if fraction(t.X) || fraction(t.Y) {
+				l.warn(t, "%s on a fractional number, compare with a tolerance or round() instead", t.Op)
+			}
+		}
+		l.walk(t.X)
+		l.walk(t.Y)
+	case *ast.SelectorExpr:
+		l.walk(t.X)
+	case *ast.IndexExpr:
+		l.walk(t.X)
+		l.walk(t.Index)
+	case *ast.CallExpr:
+		name := funcName(t)
+		switch {
+		case name == "if" && len(t.Args) > 0:
+			l.cond(t.Args[0])
+			for _, arg := range t.Args[1:] {
+				l.walk(arg)
+			}
+			return
+		case (name == "any" || name == "all") && len(t.Args) > 1:
+			l.walk(t.Args[0])
+			l.cond(t.Args[len(t.Args)-1])
+			return
+		case name == builtinNullSafe:
+			l.walk(t.Args[0])
+			return
+		case builtins[name]:
+		case name != "":
+			if _, ok := l.env.Lookup(name); !ok {
+				l.warn(t.Fun, "unknown function %s", name)
+			}
+		}
+		for _, arg := range t.Args {
+			l.walk(arg)
+		}
+	}
+}
+
+// constExpr 判断表达式是否只由常量组成
+func constExpr(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return t.Name == "true" || t.Name == "false" || t.Name == "nil"
+	case *ast.ParenExpr:
+		return constExpr(t.X)
+	case *ast.UnaryExpr:
+		return constExpr(t.X)
+	case *ast.BinaryExpr:
+		return constExpr(t.X) && constExpr(t.Y)
+	case *ast.CallExpr:
+		return funcName(t) == builtinIn && constExpr(t.Args[0]) && constExpr(t.Args[1])
+	}
+	return false
+}
+
+// fraction 判断表达式是否为小数常量或含小数常量的算术运算
+func fraction(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.BasicLit:
+		return t.Kind == token.FLOAT
+	case *ast.ParenExpr:
+		return fraction(t.X)
+	case *ast.UnaryExpr:
+		return fraction(t.X)
+	case *ast.BinaryExpr:
+		switch t.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO:
+			return fraction(t.X) || fraction(t.Y)
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Definition 规则文件中的一条规则
+type Definition struct {
+	Name     string            `yaml:"name" json:"name"`
+	Expr     string            `yaml:"expr" json:"expr"` // 条件表达式
+	Then     []string          `yaml:"then,omitempty" json:"then,omitempty"`
+	Priority int               `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Salience int               `yaml:"salience,omitempty" json:"salience,omitempty"`
+	Enabled  *bool             `yaml:"enabled,omitempty" json:"enabled,omitempty"` // 默认启用
+	Metadata map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// IsEnabled 判断规则是否启用
+func (d *Definition) IsEnabled() bool {
+	return d.Enabled == nil || *d.Enabled
+}
+
+func (d *Definition) spec() RuleSpec {
+	return RuleSpec{Name: d.Name, When: d.Expr, Then: d.Then, Priority: d.Priority, Salience: d.Salience}
+}
+
+// ParseDefinitions 按文件扩展名（.yaml、.yml 或 .json）解析规则定义，
+// 文件内容可以是规则列表，也可以是包含 rules 列表的对象，未知的字段视为错误
+func ParseDefinitions(name string, data []byte) ([]Definition, error) {
+	var (
+		defs []Definition
+		doc  struct {
+			Rules []Definition `yaml:"rules" json:"rules"`
+		}
+	)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		var raw interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		var err error
+		if _, ok := raw.([]interface{}); ok {
+			err = yaml.UnmarshalStrict(data, &defs)
+		} else {
+			err = yaml.UnmarshalStrict(data, &doc)
+			defs = doc.Rules
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	case ".json":
+		trimmed := bytes.TrimSpace(data)
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		var err error
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			err = dec.Decode(&defs)
+		} else {
+			err = dec.Decode(&doc)
+			defs = doc.Rules
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported rule file type", name)
+	}
+	return defs, nil
+}
+
+// CompileDefinitions 编译规则定义，未启用的规则也会被检查，但不加入规则集
+func CompileDefinitions(defs []Definition, env *Env) (*RuleSet, error) {
+	set, disabled := NewRuleSet(), NewRuleSet()
+	set.SetEnv(env)
+	disabled.SetEnv(env)
+	seen := map[string]bool{}
+	for i := range defs {
+		d := &defs[i]
+		if seen[d.Name] {
+			return nil, fmt.Errorf("rule %s: duplicate name", d.Name)
+		}
+		seen[d.Name] = true
+		target := set
+		if !d.IsEnabled() {
+			target = disabled
+		}
+		if err := target.Add(d.spec()); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Loader 从 YAML、JSON 文件或目录下所有的 .yaml、.yml、.json 文件加载规则集，
+// Watch 后按修改时间轮询，文件变化时重新加载并原子地替换规则集，新规则有错误时继续使用原来的规则集
+type Loader struct {
+	// OnReload 重新加载成功后调用
+	OnReload func(*RuleSet)
+	// OnError Watch 中重新加载失败时调用，同一个错误持续出现时只调用一次
+	OnError func(error)
+
+	path   string
+	env    *Env
+	mu     sync.Mutex   // 串行化 Reload
+	loaded atomic.Value // *snapshot
+	stop   chan bool
+
+	// 最近一次加载失败时的文件状态及错误，文件没有再变化时不重复加载
+	failed  map[string]fileStamp
+	failErr error
+}
+
+// snapshot 一次加载的结果
+type snapshot struct {
+	set   *RuleSet
+	defs  []Definition
+	files map[string]fileStamp
+}
+
+type fileStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+// NewLoader 加载 path 下的规则，env 为 nil 时使用标准函数库
+func NewLoader(path string, env *Env) (*Loader, error) {
+	l := &Loader{path: path, env: env}
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// RuleSet 返回当前的规则集
+func (l *Loader) RuleSet() *RuleSet {
+	return l.snapshot().set
+}
+
+// Definitions 返回当前规则集的定义，包括未启用的规则，调用方不应修改
+func (l *Loader) Definitions() []Definition {
+	return l.snapshot().defs
+}
+
+// Definition 返回规则 name 的定义
+func (l *Loader) Definition(name string) (Definition, bool) {
+	for _, d := range l.snapshot().defs {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Definition{}, false
+}
+
+func (l *Loader) snapshot() *snapshot {
+	s, _ := l.loaded.Load().(*snapshot)
+	if s == nil {
+		return &snapshot{set: NewRuleSet()}
+	}
+	return s
+}
+
+// Reload 文件有变化时重新加载，reloaded 表示规则集被替换，出错时保留原来的规则集；
+// 加载失败后文件没有再变化时返回同一个错误
+func (l *Loader) Reload() (reloaded bool, err error) {
+	set, err := l.reload()
+	if set != nil && l.OnReload != nil {
+		l.OnReload(set)
+	}
+	return set != nil, err
+}
+
+// reload 文件有变化时重新加载并返回新的规则集，没有变化或出错时返回 nil
+func (l *Loader) reload() (*RuleSet, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files, err := l.stat()
+	if err != nil {
+		return nil, err
+	}
+	if old, _ := l.loaded.Load().(*snapshot); old != nil && sameFiles(old.files, files) {
+		return nil, nil
+	}
+	if l.failed != nil && sameFiles(l.failed, files) {
+		return nil, l.failErr
+	}
+	if err = l.load(files); err != nil {
+		l.failed, l.failErr = files, err
+		return nil, err
+	}
+	l.failed, l.failErr = nil, nil
+	return l.snapshot().set, nil
+}
+
+// load 加载并编译规则文件
+func (l *Loader) load(files map[string]fileStamp) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var defs []Definition
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		d, err := ParseDefinitions(name, data)
+		if err != nil {
+			return err
+		}
+		defs = append(defs, d...)
+	}
+	set, err := CompileDefinitions(defs, l.env)
+	if err != nil {
+		return err
+	}
+	l.loaded.Store(&snapshot{set: set, defs: defs, files: files})
+	return nil
+}
+
+// stat 返回规则文件的修改时间和大小
+func (l *Loader) stat() (map[string]fileStamp, error) {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]fileStamp{}
+	if !info.IsDir() {
+		files[l.path] = fileStamp{info.ModTime(), info.Size()}
+		return files, nil
+	}
+	entries, err := os.ReadDir(l.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		files[filepath.Join(l.path, e.Name())] = fileStamp{fi.ModTime(), fi.Size()}
+	}
+	return files, nil
+}
+
+func sameFiles(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, s := range a {
+		if t, ok := b[name]; !ok || !t.mtime.Equal(s.mtime) || t.size != s.size {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch 每隔 interval 检查一次文件变化，调用 Stop 停止
+func (l *Loader) Watch(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return
+	}
+	l.stop = make(chan bool)
+	go l.watch(interval, l.stop)
+}
+
+func (l *Loader) watch(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	// os.Stat 等每次返回新的错误值，按错误信息判断是否已报告
+	var reported string
+	for {
+		select {
+		case <-ticker.C:
+			_, err := l.Reload()
+			msg := ""
+			if err != nil {
+				msg = err.Error()
+			}
+			if msg != "" && msg != reported && l.OnError != nil {
+				l.OnError(err)
+			}
+			reported = msg
+		case <-stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// Stop 停止 Watch
+func (l *Loader) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
@@ -0,0 +1,315 @@
+package rule
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// 数值分为整数（int64）、浮点数（float64）和精确小数（decimal.Decimal）三种：
+//   - 整数之间的 + - * % 及 div() 结果仍为整数，溢出时提升为小数
+//   - 其他情况下浮点数按其最短的十进制表示转换为小数，结果为小数
+//   - / 的结果总是小数，小数位数和舍入方式由 Env.SetDivision 设置
+//   - 比较时整数之间直接比较，有小数参与时按小数比较，否则按浮点数比较
+//   - 无符号整数超出 int64 范围时作为小数，time.Duration 作为整数
+
+// numKind 数值种类
+type numKind int
+
+const (
+	notNum numKind = iota
+	intNum
+	floatNum
+	decNum
+)
+
+// num 统一后的数值
+type num struct {
+	kind numKind
+	i    int64
+	f    float64
+	d    decimal.Decimal
+}
+
+func toNum(v interface{}) num {
+	switch n := v.(type) {
+	case int64:
+		return num{kind: intNum, i: n}
+	case float64:
+		return num{kind: floatNum, f: n}
+	case decimal.Decimal:
+		return num{kind: decNum, d: n}
+	case int:
+		return num{kind: intNum, i: int64(n)}
+	case time.Duration:
+		return num{kind: intNum, i: int64(n)}
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return num{kind: intNum, i: rv.Int()}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u <= math.MaxInt64 {
+			return num{kind: intNum, i: int64(u)}
+		}
+		return num{kind: decNum, d: decimal.NewFromUint64(u)}
+	case reflect.Float32, reflect.Float64:
+		return num{kind: floatNum, f: rv.Float()}
+	}
+	return num{}
+}
+
+func (n num) decimal() (decimal.Decimal, error) {
+	switch n.kind {
+	case intNum:
+		return decimal.NewFromInt(n.i), nil
+	case floatNum:
+		if math.IsNaN(n.f) || math.IsInf(n.f, 0) {
+			return decimal.Decimal{}, fmt.Errorf("%w: %v", ErrNotNumber, n.f)
+		}
+		return decimal.NewFromFloat(n.f), nil
+	}
+	return n.d, nil
+}
+
+func (n num) float() float64 {
+	switch n.kind {
+	case intNum:
+		return float64(n.i)
+	case decNum:
+		return n.d.InexactFloat64()
+	}
+	return n.f
+}
+
+// value 返回求值使用的值
+func (n num) value() interface{} {
+	switch n.kind {
+	case intNum:
+		return n.i
+	case floatNum:
+		return n.f
+	}
+	return n.d
+}
+
+// RoundingMode 舍入方式
+type RoundingMode int
+
+const (
+	RoundHalfUp   RoundingMode = iota // 四舍五入，.5 远离零
+	RoundHalfEven                     // 四舍六入五成双
+	RoundDown                         // 向零截断
+	RoundUp                           // 远离零
+	RoundCeiling                      // 向正无穷
+	RoundFloor                        // 向负无穷
+)
+
+// division 除法结果保留的小数位数及舍入方式
+type division struct {
+	places int32
+	mode   RoundingMode
+}
+
+var defaultDivision = division{places: int32(decimal.DivisionPrecision), mode: RoundHalfUp}
+
+var two = decimal.NewFromInt(2)
+
+// quo 计算 a/b，b 不为 0
+func (d division) quo(a, b decimal.Decimal) decimal.Decimal {
+	q, r := a.QuoRem(b, d.places)
+	if r.IsZero() {
+		return q
+	}
+	neg := (a.Sign() < 0) != (b.Sign() < 0)
+	var up bool
+	switch d.mode {
+	case RoundDown:
+	case RoundUp:
+		up = true
+	case RoundCeiling:
+		up = !neg
+	case RoundFloor:
+		up = neg
+	default:
+		// 比较 2*|r|*10^places 与 |b|
+		c := r.Abs().Shift(d.places).Mul(two).Cmp(b.Abs())
+		up = c > 0 || (c == 0 && (d.mode == RoundHalfUp || q.Shift(d.places).BigInt().Bit(0) == 1))
+	}
+	if !up {
+		return q
+	}
+	unit := decimal.New(1, -d.places)
+	if neg {
+		return q.Sub(unit)
+	}
+	return q.Add(unit)
+}
+
+// arith 四则运算及取模
+func arith(a, b interface{}, op token.Token, div division) (interface{}, error) {
+	x, y := toNum(a), toNum(b)
+	if x.kind == notNum || y.kind == notNum {
+		return nil, ErrNotNumber
+	}
+	if x.kind == intNum && y.kind == intNum {
+		if v, ok := arithInt(x.i, y.i, op); ok {
+			return v, nil
+		}
+		if (op == token.QUO || op == token.REM) && y.i == 0 {
+			return nil, ErrDivByZero
+		}
+	}
+	dx, err := x.decimal()
+	if err != nil {
+		return nil, err
+	}
+	dy, err := y.decimal()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case token.ADD:
+		return dx.Add(dy), nil
+	case token.SUB:
+		return dx.Sub(dy), nil
+	case token.MUL:
+		return dx.Mul(dy), nil
+	case token.QUO:
+		if dy.IsZero() {
+			return nil, ErrDivByZero
+		}
+		return div.quo(dx, dy), nil
+	case token.REM:
+		if dy.IsZero() {
+			return nil, ErrDivByZero
+		}
+		return dx.Mod(dy), nil
+	}
+	return nil, ErrUnsupportToken
+}
+
+// arithInt 整数运算，溢出、除数为 0 或运算符为 / 时 ok 为 false
+func arithInt(a, b int64, op token.Token) (v int64, ok bool) {
+	switch op {
+	case token.ADD:
+		v = a + b
+		return v, (a^v)&(b^v) >= 0
+	case token.SUB:
+		v = a - b
+		return v, (a^b)&(a^v) >= 0
+	case token.MUL:
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		v = a * b
+		return v, v/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)
+	case token.REM:
+		if b == 0 {
+			return 0, false
+		}
+		return a % b, true
+	}
+	return 0, false
+}
+
+// intDiv 整数除法，商向零截断
+func intDiv(a, b interface{}) (interface{}, error) {
+	x, y := toNum(a), toNum(b)
+	if x.kind == notNum || y.kind == notNum {
+		return nil, ErrNotNumber
+	}
+	if x.kind == intNum && y.kind == intNum {
+		if y.i == 0 {
+			return nil, ErrDivByZero
+		}
+		if x.i != math.MinInt64 || y.i != -1 {
+			return x.i / y.i, nil
+		}
+	}
+	dx, err := x.decimal()
+	if err != nil {
+		return nil, err
+	}
+	dy, err := y.decimal()
+	if err != nil {
+		return nil, err
+	}
+	if dy.IsZero() {
+		return nil, ErrDivByZero
+	}
+	q, _ := dx.QuoRem(dy, 0)
+	if q.Cmp(decimal.NewFromInt(math.MaxInt64)) <= 0 && q.Cmp(decimal.NewFromInt(math.MinInt64)) >= 0 {
+		return q.IntPart(), nil
+	}
+	return q, nil
+}
+
+// negate 取负
+func negate(v interface{}) (interface{}, error) {
+	switch n := toNum(v); n.kind {
+	case intNum:
+		if n.i != math.MinInt64 {
+			return -n.i, nil
+		}
+		return decimal.NewFromInt(n.i).Neg(), nil
+	case floatNum:
+		return -n.f, nil
+	case decNum:
+		return n.d.Neg(), nil
+	}
+	return nil, ErrNotNumber
+}
+
+// compareNum 比较两个数值，返回 -1、0、1；有 NaN 参与时 ok 为 false
+func compareNum(a, b interface{}) (c int, ok bool, err error) {
+	x, y := toNum(a), toNum(b)
+	if x.kind == notNum || y.kind == notNum {
+		return 0, false, ErrNotNumber
+	}
+	switch {
+	case x.kind == intNum && y.kind == intNum:
+		switch {
+		case x.i < y.i:
+			return -1, true, nil
+		case x.i > y.i:
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case x.kind == decNum || y.kind == decNum:
+		dx, ex := x.decimal()
+		dy, ey := y.decimal()
+		if ex == nil && ey == nil {
+			return dx.Cmp(dy), true, nil
+		}
+	}
+	// 浮点数比较，也用于 ±Inf 与小数比较
+	xf, yf := x.float(), y.float()
+	switch {
+	case xf < yf:
+		return -1, true, nil
+	case xf > yf:
+		return 1, true, nil
+	case xf == yf:
+		return 0, true, nil
+	}
+	return 0, false, nil
+}
+
+// compare 按运算符比较两个数值
+func compare(a, b interface{}, op token.Token) (interface{}, error) {
+	c, ok, err := compareNum(a, b)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// NaN 与任何值都不相等
+		return op == token.NEQ, nil
+	}
+	return compareFloat(float64(c), 0, op), nil
+}
@@ -0,0 +1,317 @@
+package rule
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+)
+
+// SetExpr 编译前对表达式做以下优化，求值的结果及错误与优化前相同：
+//   - 常量折叠：只由常量组成的运算在编译时求值，求值出错的保留到运行时报告
+//   - 删除分支：true && x、false || x 等只对 x 求值，if 的条件为常量时只保留一个分支
+//   - 公共子表达式：多次出现的 a.b.c、a["b"]、a[0] 等字段访问在一次求值中只访问一次
+//   - 重排 && 和 ||：有 schema 时假定数据源符合 schema，所有操作数都不会出错的 && 和 || 按估计的代价从小到大求值
+
+// memo 一次求值中已访问的字段
+type memo struct {
+	done  bool
+	value interface{}
+	err   error
+}
+
+// prepare 为常量折叠和公共子表达式做准备
+func (c *compiler) prepare(expr ast.Expr) {
+	c.consts = map[ast.Expr]interface{}{}
+	c.slots = map[ast.Expr]int{}
+
+	// 统计每个字段访问出现的次数，及其作为更长的字段访问的一部分出现的位置
+	type lookup struct {
+		nodes []ast.Expr
+		uses  map[string]bool // 外层字段访问的 key，"" 表示单独使用
+	}
+	lookups := map[string]*lookup{}
+	var keys []string
+	var walk func(expr ast.Expr, outer string)
+	walk = func(expr ast.Expr, outer string) {
+		if key, x, ok := lookupKey(expr); ok {
+			l := lookups[key]
+			if l == nil {
+				l = &lookup{uses: map[string]bool{}}
+				lookups[key] = l
+				keys = append(keys, key)
+			}
+			l.nodes = append(l.nodes, expr)
+			l.uses[outer] = true
+			if x != nil {
+				walk(x, key)
+			}
+			return
+		}
+		switch t := expr.(type) {
+		case *ast.UnaryExpr:
+			walk(t.X, "")
+		case *ast.BinaryExpr:
+			walk(t.X, "")
+			walk(t.Y, "")
+		case *ast.ParenExpr:
+			walk(t.X, outer)
+		case *ast.IndexExpr:
+			walk(t.X, "")
+			walk(t.Index, "")
+		case *ast.CallExpr:
+			args := t.Args
+			if ident, ok := t.Fun.(*ast.Ident); ok && (ident.Name == "any" || ident.Name == "all") && len(args) > 0 {
+				// 条件中的标志符可能是元素的字段
+				args = args[:1]
+			}
+			for _, arg := range args {
+				walk(arg, "")
+			}
+		}
+	}
+	walk(expr, "")
+
+	for _, key := range keys {
+		l := lookups[key]
+		if len(l.nodes) < 2 {
+			continue
+		}
+		// 总是作为同一个更长的字段访问的一部分出现时，只缓存更长的那个
+		if len(l.uses) == 1 && !l.uses[""] {
+			continue
+		}
+		slot := len(c.slots)
+		for _, node := range l.nodes {
+			c.slots[node] = slot
+		}
+	}
+}
+
+// lookupKey 返回字段访问的 key 及被访问的表达式，ok 为 false 表示不是字段访问
+func lookupKey(expr ast.Expr) (key string, x ast.Expr, ok bool) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "true", "false", "nil":
+			return "", nil, false
+		}
+		return t.Name, nil, true
+	case *ast.SelectorExpr:
+		return types.ExprString(t), t.X, true
+	case *ast.IndexExpr:
+		if _, lit := t.Index.(*ast.BasicLit); lit {
+			return types.ExprString(t), t.X, true
+		}
+	}
+	return "", nil, false
+}
+
+// optimize 对编译后的表达式做常量折叠，缓存多次出现的字段访问
+func (c *compiler) optimize(expr ast.Expr, fn evalFn) evalFn {
+	if c.foldable(expr) {
+		// 出错时保留到运行时报告
+		if v, err := fn(&state{}); err == nil {
+			c.consts[expr] = v
+			return constant(v)
+		}
+	}
+	slot, ok := c.slots[expr]
+	if !ok {
+		return fn
+	}
+	return func(st *state) (interface{}, error) {
+		if slot < len(st.memo) && st.memo[slot].done {
+			m := &st.memo[slot]
+			return m.value, m.err
+		}
+		v, err := fn(st)
+		for len(st.memo) <= slot {
+			st.memo = append(st.memo, memo{})
+		}
+		st.memo[slot] = memo{true, v, err}
+		return v, err
+	}
+}
+
+// constValue 返回已折叠为常量的表达式的值
+func (c *compiler) constValue(expr ast.Expr) (interface{}, bool) {
+	if c.consts == nil {
+		return nil, false
+	}
+	if p, ok := expr.(*ast.ParenExpr); ok {
+		return c.constValue(p.X)
+	}
+	v, ok := c.consts[expr]
+	return v, ok
+}
+
+// foldable 判断表达式的值是否在编译时确定，函数调用可能有副作用（如 now），不折叠
+func (c *compiler) foldable(expr ast.Expr) bool {
+	if c.consts == nil {
+		return false
+	}
+	isConst := func(e ast.Expr) bool {
+		_, ok := c.constValue(e)
+		return ok
+	}
+	switch t := expr.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		switch t.Name {
+		case "true", "false", "nil":
+			return true
+		}
+	case *ast.UnaryExpr:
+		return isConst(t.X)
+	case *ast.BinaryExpr:
+		if t.Op == token.LAND || t.Op == token.LOR {
+			// 短路时只需要左边为常量
+			if v, ok := c.constValue(t.X); ok && v == (t.Op == token.LOR) {
+				return true
+			}
+		}
+		return isConst(t.X) && isConst(t.Y)
+	case *ast.CallExpr:
+		ident, ok := t.Fun.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		switch ident.Name {
+		case "if":
+			if len(t.Args) != 3 {
+				return false
+			}
+			switch cond, _ := c.constValue(t.Args[0]); cond {
+			case true:
+				return isConst(t.Args[1])
+			case false:
+				return isConst(t.Args[2])
+			}
+		case builtinIn:
+			return isConst(t.Args[0]) && isConst(t.Args[1])
+		}
+	}
+	return false
+}
+
+// reorder 返回 && 和 || 的操作数按代价重排后的表达式，不修改 expr
+func (c *checker) reorder(expr ast.Expr) ast.Expr {
+	switch t := expr.(type) {
+	case *ast.UnaryExpr:
+		u := *t
+		u.X = c.reorder(t.X)
+		return &u
+	case *ast.ParenExpr:
+		p := *t
+		p.X = c.reorder(t.X)
+		return &p
+	case *ast.BinaryExpr:
+		if t.Op != token.LAND && t.Op != token.LOR {
+			b := *t
+			b.X, b.Y = c.reorder(t.X), c.reorder(t.Y)
+			return &b
+		}
+		operands := flatten(t, t.Op, nil)
+		for _, x := range operands {
+			if !c.safe(x, Bool) {
+				b := *t
+				b.X, b.Y = c.reorder(t.X), c.reorder(t.Y)
+				return &b
+			}
+		}
+		for i, x := range operands {
+			operands[i] = c.reorder(x)
+		}
+		sort.SliceStable(operands, func(i, j int) bool { return cost(operands[i]) < cost(operands[j]) })
+		result := operands[0]
+		for _, y := range operands[1:] {
+			result = &ast.BinaryExpr{X: result, OpPos: t.OpPos, Op: t.Op, Y: y}
+		}
+		return result
+	}
+	return expr
+}
+
+// flatten 返回 a op b op c 的操作数
+func flatten(expr ast.Expr, op token.Token, operands []ast.Expr) []ast.Expr {
+	switch t := expr.(type) {
+	case *ast.ParenExpr:
+		return flatten(t.X, op, operands)
+	case *ast.BinaryExpr:
+		if t.Op == op {
+			return flatten(t.Y, op, flatten(t.X, op, operands))
+		}
+	}
+	return append(operands, expr)
+}
+
+// safe 判断表达式的求值是否一定不会出错且结果为 k 类型，schema 中声明的字段视为一定存在
+func (c *checker) safe(expr ast.Expr, k Kind) bool {
+	typ, err := c.check(expr)
+	if err != nil || typ.Kind != k && !(k == Number && typ.Kind == Duration) {
+		return false
+	}
+	switch t := expr.(type) {
+	case *ast.BasicLit, *ast.Ident:
+		return true
+	case *ast.ParenExpr:
+		return c.safe(t.X, k)
+	case *ast.SelectorExpr:
+		// 只有声明了字段的 map
+		x, err := c.check(t.X)
+		return err == nil && x.Kind == Map && x.Fields[t.Sel.Name] != nil && c.safe(t.X, Map)
+	case *ast.UnaryExpr:
+		return c.safe(t.X, k)
+	case *ast.BinaryExpr:
+		switch t.Op {
+		case token.LAND, token.LOR:
+			return c.safe(t.X, Bool) && c.safe(t.Y, Bool)
+		case token.ADD:
+			// 数值运算中的 NaN、Inf 转换为小数时出错，只有字符串连接
+			return k == String && c.safe(t.X, String) && c.safe(t.Y, String)
+		case token.LSS, token.GTR, token.LEQ, token.GEQ, token.EQL, token.NEQ:
+			for _, kind := range []Kind{Number, String, Bool} {
+				if c.safe(t.X, kind) && c.safe(t.Y, kind) {
+					return kind != Bool || t.Op == token.EQL || t.Op == token.NEQ
+				}
+			}
+		}
+	}
+	return false
+}
+
+// cost 估计表达式求值的代价
+func cost(expr ast.Expr) int {
+	switch t := expr.(type) {
+	case *ast.BasicLit:
+		return 0
+	case *ast.Ident:
+		switch t.Name {
+		case "true", "false", "nil":
+			return 0
+		}
+		return 1
+	case *ast.ParenExpr:
+		return cost(t.X)
+	case *ast.UnaryExpr:
+		return 1 + cost(t.X)
+	case *ast.BinaryExpr:
+		return 1 + cost(t.X) + cost(t.Y)
+	case *ast.SelectorExpr:
+		return 1 + cost(t.X)
+	case *ast.IndexExpr:
+		return 2 + cost(t.X) + cost(t.Index)
+	case *ast.CallExpr:
+		n := 10
+		if ident, ok := t.Fun.(*ast.Ident); ok && (ident.Name == "any" || ident.Name == "all") {
+			n = 50
+		}
+		for _, arg := range t.Args {
+			n += cost(arg)
+		}
+		return n
+	}
+	return 10
+}
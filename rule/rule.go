@@ -1,14 +1,13 @@
 package rule
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"go/ast"
-	"go/parser"
 	"go/token"
-	"reflect"
-	"strconv"
-	"strings"
+	"go/types"
+
+	"github.com/shopspring/decimal"
 )
 
 // 错误定义
@@ -21,34 +20,102 @@ var (
 	ErrIndexNotNumber = errors.New("index not a number")
 	ErrNotBool        = errors.New("not boolean")
 	ErrKeyNotFound    = errors.New("map key not found")
-	fns               = map[string]fn{
-		"contains": func(args []interface{}) (interface{}, error) {
-			fmt.Println("contains print: ", args)
-			return nil, nil
-		},
-	}
+	ErrFuncNotFound   = errors.New("function not found")
+	ErrDivByZero      = errors.New("division by zero")
 )
 
-type fn = func(args []interface{}) (interface{}, error)
-
+// Rule 规则表达式，SetExpr 编译后可重复并发求值
 type Rule struct {
-	expr ast.Expr
+	src    string
+	expr   ast.Expr
+	prog   evalFn
+	fset   *token.FileSet
+	schema Schema
+	env    *Env
+	typ    *Type
+	depth  int // 语法树的深度
+	limits Limits
+}
+
+// SetSchema 声明数据源的结构，之后的 SetExpr 会按其检查表达式的类型，
+// 并假定数据源符合 schema 重排 && 和 || 的操作数（见 optimize.go）
+func (r *Rule) SetSchema(schema Schema) {
+	r.schema = schema
 }
 
 func (r *Rule) SetExpr(expr string) error {
 	if len(expr) == 0 {
 		return ErrRuleEmpty
 	}
-	if exp, err := parser.ParseExpr(expr); err != nil {
+	fset := token.NewFileSet()
+	exp, err := parseExpr(fset, expr)
+	if err != nil {
 		return err
-	} else {
-		r.expr = exp
 	}
-
+	d := depth(exp)
+	if max := r.limits.MaxDepth; max > 0 && d > max {
+		return &LimitError{Err: ErrDepthLimit, Limit: int64(max)}
+	}
+	env := r.env
+	if env == nil {
+		env = defaultEnv
+	}
+	typ, opt := AnyType, exp
+	if r.schema != nil {
+		c := &checker{fset: fset, schema: r.schema, env: env}
+		if typ, err = c.check(exp); err != nil {
+			return err
+		}
+		opt = c.reorder(exp)
+	}
+	comp := &compiler{env: env, div: env.division()}
+	comp.prepare(opt)
+	prog, err := comp.compile(opt)
+	if err != nil {
+		return err
+	}
+	r.src, r.expr, r.prog, r.fset, r.typ, r.depth = expr, exp, prog, fset, typ, d
 	return nil
 }
 
-func (r *Rule) Bool(database map[string]interface{}) (bool, error) {
+// Expr 返回解析后的语法树，调用方不应修改；x in y、x not in y 为 ∈(x, y)、!∈(x, y)，
+// x?.name 为 ?.(x, "name")，函数名见 InFunc、NullSafeFunc
+func (r *Rule) Expr() ast.Expr {
+	return r.expr
+}
+
+// Source 返回 Expr 中的节点在表达式中对应的原文
+func (r *Rule) Source(node ast.Expr) string {
+	pos, end := span(node)
+	file := r.fset.File(pos)
+	if file == nil {
+		return types.ExprString(node)
+	}
+	return r.src[file.Offset(pos):file.Offset(end)]
+}
+
+// TypeOf 返回 Expr 中的节点按 schema 推导的类型，未设置 schema 或无法推导时为 AnyType
+func (r *Rule) TypeOf(node ast.Expr) *Type {
+	if r.schema == nil {
+		return AnyType
+	}
+	env := r.env
+	if env == nil {
+		env = defaultEnv
+	}
+	typ, err := (&checker{fset: r.fset, schema: r.schema, env: env}).check(node)
+	if err != nil || typ == nil {
+		return AnyType
+	}
+	return typ
+}
+
+// ResultType 返回按 schema 推导的结果类型，未设置 schema 时为 AnyType
+func (r *Rule) ResultType() *Type {
+	return r.typ
+}
+
+func (r *Rule) Bool(database interface{}) (bool, error) {
 	if r.expr != nil {
 		b, err := r.Eval(database)
 		if err != nil {
@@ -62,7 +129,7 @@ func (r *Rule) Bool(database map[string]interface{}) (bool, error) {
 	return false, errors.New("expr is nil")
 }
 
-func (r *Rule) Int(database map[string]interface{}) (int64, error) {
+func (r *Rule) Int(database interface{}) (int64, error) {
 	if r.expr != nil {
 		b, err := r.Eval(database)
 		if err != nil {
@@ -73,14 +140,15 @@ func (r *Rule) Int(database map[string]interface{}) (int64, error) {
 			return b, nil
 		case float64:
 			return int64(b), nil
-
+		case decimal.Decimal:
+			return b.IntPart(), nil
 		}
 	}
 	return 0, errors.New("expr is nil")
 
 }
 
-func (r *Rule) Float(database map[string]interface{}) (float64, error) {
+func (r *Rule) Float(database interface{}) (float64, error) {
 	if r.expr != nil {
 		b, err := r.Eval(database)
 		if err != nil {
@@ -91,153 +159,63 @@ func (r *Rule) Float(database map[string]interface{}) (float64, error) {
 			return float64(b), nil
 		case float64:
 			return b, nil
-
+		case decimal.Decimal:
+			return b.InexactFloat64(), nil
 		}
 	}
 	return 0, errors.New("expr is nil")
 }
 
-func (r *Rule) Eval(datasource map[string]interface{}) (interface{}, error) {
-	switch t := r.expr.(type) {
-	case *ast.UnaryExpr: // 一元表达式
-		r.expr = t.X
-		operand, err := r.Eval(datasource)
-		if err != nil {
-			return nil, err
-		}
-		oprd := reflect.ValueOf(operand)
-
-		switch t.Op {
-		case token.NOT: // !
-			if oprd.Kind() != reflect.Bool {
-				return false, ErrNotBool
-			}
-			return !oprd.Bool(), nil
-		case token.SUB: // -
-			if x, err := number(oprd); err == nil {
-				return (-1.0) * x, nil
-			}
-			return 0.0, ErrNotNumber
-		}
-	case *ast.BinaryExpr: // 二元表达式
-		r.expr = t.X
-		x, err := r.Eval(datasource)
-		if err != nil {
-			return nil, err
-		}
-		r.expr = t.Y
-		y, err := r.Eval(datasource)
-		if err != nil {
-			return nil, err
-		}
-		return operate(x, y, t.Op)
-	case *ast.Ident: // 标志符（已定义变量或常量（bool））
-		return evalIdent(t.Name, datasource)
-	case *ast.BasicLit: // 基本类型文字（当作字符串存储）
-		switch t.Kind {
-		case token.STRING:
-			return strings.Trim(t.Value, "\""), nil
-		case token.INT:
-			return strconv.ParseInt(t.Value, 10, 64)
-		case token.FLOAT:
-			return strconv.ParseFloat(t.Value, 64)
-		default:
-			return nil, ErrUnsupportParam
-		}
-	case *ast.ParenExpr: // 圆括号内表达式
-		r.expr = t.X
-		return r.Eval(datasource)
-	case *ast.SelectorExpr: // 属性或方法选择表达式
-		r.expr = t.X
-		v, err := r.Eval(datasource)
-		if err != nil {
-			return nil, err
-		}
-		return evalIdent(t.Sel.Name, v.(map[string]interface{}))
-	case *ast.IndexExpr: // 中括号内表达式——map或slice索引
-		r.expr = t.X
-		data, err := r.Eval(datasource)
-		if err != nil {
-			return nil, err
-		}
-
-		r.expr = t.Index
-		idx, err := r.Eval(datasource)
+// Decimal 返回精确的数值结果，浮点数按其最短的十进制表示转换
+func (r *Rule) Decimal(database interface{}) (decimal.Decimal, error) {
+	if r.expr != nil {
+		b, err := r.Eval(database)
 		if err != nil {
-			return nil, err
+			return decimal.Zero, err
 		}
-
-		switch data := data.(type) {
-		case map[string]interface{}:
-			if idx, isString := idx.(string); isString {
-				return data[idx], nil
-			} else {
-				return nil, fmt.Errorf("map here index must be string")
-			}
-		case []interface{}:
-			switch idx := idx.(type) {
-			case int:
-				return data[int64(idx)], nil
-			case int64:
-				return data[idx], nil
-			default:
-				return nil, fmt.Errorf("slice index index must be number")
-			}
-		default:
-			return nil, fmt.Errorf("IndexExpr: unsupport data type")
-		}
-	case *ast.CallExpr: // 方法调用表达式
-		// r.expr = t.Fun
-		// f, err := r.Eval(fns)
-
-		// if err != nil {
-		// 	return nil, err
-		// }
-		// switch f := f.(type) {
-		// case func(args []interface{}) (interface{}, error):
-		// 	if params, err := evalArg(t.Args, datasource); err != nil {
-		// 		return nil, err
-		// 	} else {
-		// 		return f(params)
-		// 	}
-		// }
-		if params, err := evalArg(t.Args, datasource); err != nil {
-			return nil, err
-		} else {
-			return fns[t.Fun.(*ast.Ident).Name](params)
+		if n := toNum(b); n.kind != notNum {
+			return n.decimal()
 		}
+		return decimal.Zero, ErrNotNumber
 	}
-	return nil, ErrUnsupportExpr
+	return decimal.Zero, errors.New("expr is nil")
 }
 
-func evalArg(args []ast.Expr, datasource map[string]interface{}) ([]interface{}, error) {
-	var result []interface{}
-	for _, arg := range args {
-		switch arg := arg.(type) {
-		case *ast.BasicLit:
-			result = append(result, arg.Value)
-		case *ast.Ident:
-			if val, err := evalIdent(arg.Name, datasource); err != nil {
-				return nil, err
-			} else {
-				result = append(result, val)
-			}
-		}
-	}
-	return result, nil
+// Eval 对数据源求值，数据源可以是 map、struct、slice 或 JSON 文档，见 datasource.go
+func (r *Rule) Eval(datasource interface{}) (interface{}, error) {
+	return r.eval(nil, datasource)
 }
 
-func evalIdent(key string, datasource map[string]interface{}) (interface{}, error) {
-	// while bool type is Ident
-	if key == "true" {
-		return true, nil
-	} else if key == "false" {
-		return false, nil
+func (r *Rule) eval(ctx context.Context, datasource interface{}) (interface{}, error) {
+	if r.prog == nil {
+		return nil, ErrRuleEmpty
 	}
-
-	if value, ok := datasource[key]; ok {
-		return value, nil
-	} else {
-		return nil, ErrKeyNotFound
+	if err := r.checkDepth(); err != nil {
+		return nil, err
+	}
+	data, err := root(datasource)
+	if err != nil {
+		return nil, err
+	}
+	st := statePool.Get().(*state)
+	st.root = data
+	cancel := r.limit(ctx, st)
+	defer cancel()
+	var v interface{}
+	if st.limit != nil {
+		err = st.limit.check()
+	}
+	if err == nil {
+		v, err = r.prog(st)
+	}
+	st.root = nil
+	st.limit, st.limiter = nil, limiter{}
+	st.args = st.args[:0]
+	st.vars = st.vars[:0]
+	for i := range st.memo {
+		st.memo[i] = memo{}
 	}
+	st.memo = st.memo[:0]
+	statePool.Put(st)
+	return v, err
 }
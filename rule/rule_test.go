@@ -0,0 +1,332 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// treeWalk 是编译前的求值方式（基线版本的 Rule.Eval），作为基准对照
+type treeWalk struct {
+	expr ast.Expr
+}
+
+func (r *treeWalk) Eval(datasource map[string]interface{}) (interface{}, error) {
+	switch t := r.expr.(type) {
+	case *ast.UnaryExpr:
+		r.expr = t.X
+		operand, err := r.Eval(datasource)
+		if err != nil {
+			return nil, err
+		}
+		oprd := reflect.ValueOf(operand)
+		switch t.Op {
+		case token.NOT:
+			if oprd.Kind() != reflect.Bool {
+				return false, ErrNotBool
+			}
+			return !oprd.Bool(), nil
+		case token.SUB:
+			if x, err := treeWalkNumber(oprd); err == nil {
+				return (-1.0) * x, nil
+			}
+			return 0.0, ErrNotNumber
+		}
+	case *ast.BinaryExpr:
+		r.expr = t.X
+		x, err := r.Eval(datasource)
+		if err != nil {
+			return nil, err
+		}
+		r.expr = t.Y
+		y, err := r.Eval(datasource)
+		if err != nil {
+			return nil, err
+		}
+		return treeWalkOperate(x, y, t.Op)
+	case *ast.Ident:
+		return evalIdent(t.Name, datasource)
+	case *ast.BasicLit:
+		switch t.Kind {
+		case token.STRING:
+			return strings.Trim(t.Value, "\""), nil
+		case token.INT:
+			return strconv.ParseInt(t.Value, 10, 64)
+		case token.FLOAT:
+			return strconv.ParseFloat(t.Value, 64)
+		default:
+			return nil, ErrUnsupportParam
+		}
+	case *ast.ParenExpr:
+		r.expr = t.X
+		return r.Eval(datasource)
+	case *ast.SelectorExpr:
+		r.expr = t.X
+		v, err := r.Eval(datasource)
+		if err != nil {
+			return nil, err
+		}
+		return evalIdent(t.Sel.Name, v.(map[string]interface{}))
+	case *ast.IndexExpr:
+		r.expr = t.X
+		data, err := r.Eval(datasource)
+		if err != nil {
+			return nil, err
+		}
+		r.expr = t.Index
+		idx, err := r.Eval(datasource)
+		if err != nil {
+			return nil, err
+		}
+		switch data := data.(type) {
+		case map[string]interface{}:
+			return data[idx.(string)], nil
+		case []interface{}:
+			return data[idx.(int64)], nil
+		}
+	}
+	return nil, ErrUnsupportExpr
+}
+
+// treeWalkOperate 是基线版本的 operate
+func treeWalkOperate(x, y interface{}, tk token.Token) (interface{}, error) {
+	xv := reflect.ValueOf(x)
+	yv := reflect.ValueOf(y)
+	switch tk {
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.LSS, token.GTR, token.LEQ, token.GEQ, token.EQL, token.NEQ:
+		var a, b float64
+		var err error
+		if a, err = treeWalkNumber(xv); err != nil {
+			return nil, err
+		}
+		if b, err = treeWalkNumber(yv); err != nil {
+			return nil, err
+		}
+		switch tk {
+		case token.ADD:
+			return decimal.NewFromFloat(a).Add(decimal.NewFromFloat(b)), nil
+		case token.SUB:
+			return decimal.NewFromFloat(a).Sub(decimal.NewFromFloat(b)), nil
+		case token.MUL:
+			return decimal.NewFromFloat(a).Mul(decimal.NewFromFloat(b)), nil
+		case token.QUO:
+			if b == 0 {
+				return 0, errors.New("x/0 error")
+			}
+			return a / b, nil
+		case token.LSS:
+			return a < b, nil
+		case token.GTR:
+			return a > b, nil
+		case token.LEQ:
+			return a <= b, nil
+		case token.GEQ:
+			return a >= b, nil
+		case token.EQL:
+			return a == b, nil
+		case token.NEQ:
+			return a != b, nil
+		default:
+			return 0, ErrUnsupportToken
+		}
+	case token.LAND, token.LOR:
+		if xv.Kind() != reflect.Bool || yv.Kind() != reflect.Bool {
+			return false, ErrNotBool
+		}
+		switch tk {
+		case token.LAND:
+			return xv.Bool() && yv.Bool(), nil
+		case token.LOR:
+			return xv.Bool() || yv.Bool(), nil
+		default:
+			return false, ErrUnsupportToken
+		}
+	default:
+		return nil, ErrUnsupportToken
+	}
+}
+
+// treeWalkNumber 是基线版本的 number
+func treeWalkNumber(x reflect.Value) (float64, error) {
+	switch x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(x.Int()), nil
+	case reflect.Float32, reflect.Float64:
+		return x.Float(), nil
+	default:
+		return 0, ErrNotNumber
+	}
+}
+
+var benchRules = []struct {
+	name, expr string
+}{
+	{"compare", `a > 10 && b <= 2.5 || !c`},
+	{"arith", `a * b`},
+	{"index", `m.items[1] == 3 && m["count"] > 1`},
+	{"repeated", `m.items[1] > 0 && m.items[1] < 10 && 6 / 2 > 2`},
+}
+
+var benchData = map[string]interface{}{
+	"a": int64(12),
+	"b": 2.5,
+	"c": false,
+	"m": map[string]interface{}{
+		"items": []interface{}{int64(1), int64(3)},
+		"count": int64(2),
+	},
+}
+
+func BenchmarkTreeWalk(b *testing.B) {
+	for _, br := range benchRules {
+		expr, err := parser.ParseExpr(br.expr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(br.name, func(b *testing.B) {
+			b.ReportAllocs()
+			w := &treeWalk{}
+			for i := 0; i < b.N; i++ {
+				// 每次求值都会改写 expr
+				w.expr = expr
+				if _, err := w.Eval(benchData); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompiled(b *testing.B) {
+	for _, br := range benchRules {
+		r := &Rule{}
+		if err := r.SetExpr(br.expr); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(br.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.Eval(benchData); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(br.name+"-parallel", func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := r.Eval(benchData); err != nil {
+						panic(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCompiledMatchesTreeWalk(t *testing.T) {
+	for _, br := range benchRules {
+		expr, _ := parser.ParseExpr(br.expr)
+		want, err := (&treeWalk{expr: expr}).Eval(benchData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &Rule{}
+		if err = r.SetExpr(br.expr); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.Eval(benchData)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: got %v %v, want %v", br.expr, got, err, want)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	schema := Schema{
+		"age":  NumberType,
+		"vip":  BoolType,
+		"name": StringType,
+		"tags": SliceOf(StringType),
+		"user": MapOf(map[string]*Type{"age": NumberType, "name": StringType}),
+	}
+	compile := func(expr string) (*compiler, ast.Expr) {
+		fset := token.NewFileSet()
+		exp, err := parseExpr(fset, expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &checker{fset: fset, schema: schema, env: defaultEnv}
+		if _, err := c.check(exp); err != nil {
+			t.Fatal(err)
+		}
+		exp = c.reorder(exp)
+		comp := &compiler{env: defaultEnv, div: defaultDivision}
+		comp.prepare(exp)
+		if _, err := comp.compile(exp); err != nil {
+			t.Fatal(err)
+		}
+		return comp, exp
+	}
+
+	// 所有操作数都不会出错时按代价重排
+	for expr, want := range map[string]string{
+		`user.age >= 18 && vip && name == "bob"`:   `vip && name == "bob" && user.age >= 18`,
+		`(user.age > 1 || name < "b") || !vip`:     `name < "b" || !vip || user.age > 1`,
+		`age / 2 > 1 && vip`:                       `age / 2 > 1 && vip`,
+		`user.age > 1 && (age % 2 == 0 || vip)`:    `user.age > 1 && (age % 2 == 0 || vip)`,
+		`"x" in tags && vip`:                       `∈("x", tags) && vip`,
+		`age > 1 && vip && user.name + "!" == "a"`: `vip && age > 1 && user.name + "!" == "a"`,
+	} {
+		if _, exp := compile(expr); types.ExprString(exp) != want {
+			t.Errorf("%s: reordered to %s", expr, types.ExprString(exp))
+		}
+	}
+
+	// 常量折叠，出错的运算不折叠
+	c, _ := compile(`age + (2 * 3 - 1) > 0 && 1 / 0 > age && !(1 > 2)`)
+	folded := map[string]interface{}{}
+	for expr, v := range c.consts {
+		folded[types.ExprString(expr)] = v
+	}
+	if folded["2 * 3 - 1"] != int64(5) || folded["!(1 > 2)"] != true {
+		t.Errorf("folded %v", folded)
+	}
+	if _, ok := folded["1 / 0"]; ok {
+		t.Errorf("folded 1 / 0")
+	}
+
+	// 多次出现的字段访问
+	c, _ = compile(`user.age > 18 && user.age < 65 && user.name != "" && age > 0`)
+	slots := map[string]int{}
+	for expr := range c.slots {
+		slots[types.ExprString(expr)]++
+	}
+	if fmt.Sprint(slots) != "map[user:3 user.age:2]" {
+		t.Errorf("slots %v", slots)
+	}
+}
+
+func evalIdent(key string, datasource map[string]interface{}) (interface{}, error) {
+	// while bool type is Ident
+	if key == "true" {
+		return true, nil
+	} else if key == "false" {
+		return false, nil
+	}
+
+	if value, ok := datasource[key]; ok {
+		return value, nil
+	} else {
+		return nil, ErrKeyNotFound
+	}
+}
@@ -0,0 +1,430 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 规则集按正向链式推理执行：
+//   - 每一轮在未撤回的规则中按 Priority、Salience 从高到低（相同时按添加顺序）找到第一个条件成立的规则并执行其动作
+//   - 规则执行后，只有其条件引用的事实在此之后被改变才会再次执行，规则自身动作的改变和赋值前后相等的不算
+//   - 没有可执行的规则时结束；执行次数超过 MaxCycles 时返回 ErrCycleLimit
+//   - 条件引用的事实不存在（ErrKeyNotFound）时视为条件不成立，其他错误终止执行
+
+// ErrCycleLimit 规则执行次数超过 MaxCycles
+var ErrCycleLimit = errors.New("rule set cycle limit exceeded")
+
+// DefaultMaxCycles 未设置 MaxCycles 时的执行次数上限
+const DefaultMaxCycles = 1000
+
+// RuleSpec 规则集中一条规则的定义
+type RuleSpec struct {
+	Name     string   `yaml:"name" json:"name"`
+	When     string   `yaml:"when" json:"when"`         // 条件表达式
+	Then     []string `yaml:"then" json:"then"`         // 动作：path = expr、path += expr、path -= expr、stop、retract、retract("name")
+	Priority int      `yaml:"priority" json:"priority"` // 优先级，高的先执行
+	Salience int      `yaml:"salience" json:"salience"` // 优先级相同时，高的先执行
+}
+
+// RuleSet 一组规则，添加完成后可并发执行
+type RuleSet struct {
+	// MaxCycles 单次 Run 中规则执行次数的上限，0 表示 DefaultMaxCycles
+	MaxCycles int
+
+	env   *Env
+	rules []*setRule // 按执行顺序排列
+	names map[string]*setRule
+}
+
+// setRule 编译后的规则
+type setRule struct {
+	RuleSpec
+	index   int
+	when    *Rule
+	deps    []string // 条件引用的事实
+	actions []action
+}
+
+// action 编译后的动作
+type action struct {
+	kind    actionKind
+	path    []string
+	op      token.Token // ASSIGN、ADD_ASSIGN 或 SUB_ASSIGN
+	value   *Rule
+	retract string
+}
+
+type actionKind int
+
+const (
+	actAssign actionKind = iota
+	actStop
+	actRetract
+)
+
+// NewRuleSet 返回空的规则集
+func NewRuleSet() *RuleSet {
+	return &RuleSet{names: map[string]*setRule{}}
+}
+
+// SetEnv 设置规则可以调用的函数，需在 Add 之前调用
+func (s *RuleSet) SetEnv(env *Env) {
+	s.env = env
+}
+
+// Add 编译并添加规则
+func (s *RuleSet) Add(spec RuleSpec) error {
+	if spec.Name == "" {
+		return errors.New("rule name is empty")
+	}
+	if s.names == nil {
+		s.names = map[string]*setRule{}
+	}
+	if _, ok := s.names[spec.Name]; ok {
+		return fmt.Errorf("rule %s: duplicate name", spec.Name)
+	}
+	r := &setRule{RuleSpec: spec, index: len(s.names), when: &Rule{env: s.env}}
+	if err := r.when.SetExpr(spec.When); err != nil {
+		return fmt.Errorf("rule %s: when: %w", spec.Name, err)
+	}
+	r.deps = rootNames(r.when.expr, nil)
+	for _, src := range spec.Then {
+		a, err := s.parseAction(src)
+		if err != nil {
+			return fmt.Errorf("rule %s: then %q: %w", spec.Name, src, err)
+		}
+		r.actions = append(r.actions, a)
+	}
+	s.names[spec.Name] = r
+	s.rules = append(s.rules, r)
+	sort.SliceStable(s.rules, func(i, j int) bool {
+		a, b := s.rules[i], s.rules[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.Salience != b.Salience {
+			return a.Salience > b.Salience
+		}
+		return a.index < b.index
+	})
+	return nil
+}
+
+// Len 返回规则数
+func (s *RuleSet) Len() int {
+	return len(s.rules)
+}
+
+// Rule 返回规则 name 编译后的条件
+func (s *RuleSet) Rule(name string) (*Rule, bool) {
+	r, ok := s.names[name]
+	if !ok {
+		return nil, false
+	}
+	return r.when, true
+}
+
+// parseAction 解析动作
+func (s *RuleSet) parseAction(src string) (action, error) {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return action{}, ErrRuleEmpty
+	}
+
+	// 查找最外层的赋值运算符
+	var sc scanner.Scanner
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	sc.Init(file, []byte(src), func(token.Position, string) {}, 0)
+	for depth := 0; ; {
+		pos, tok, _ := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+		case token.ASSIGN, token.ADD_ASSIGN, token.SUB_ASSIGN:
+			if depth > 0 {
+				continue
+			}
+			off := file.Offset(pos)
+			path, err := assignPath(src[:off])
+			if err != nil {
+				return action{}, err
+			}
+			value := &Rule{env: s.env}
+			if err = value.SetExpr(src[off+len(tok.String()):]); err != nil {
+				return action{}, err
+			}
+			return action{kind: actAssign, path: path, op: tok, value: value}, nil
+		}
+	}
+
+	expr, err := parseExpr(token.NewFileSet(), src)
+	if err != nil {
+		return action{}, err
+	}
+	var name string
+	var args []ast.Expr
+	switch t := expr.(type) {
+	case *ast.Ident:
+		name = t.Name
+	case *ast.CallExpr:
+		if ident, ok := t.Fun.(*ast.Ident); ok {
+			name, args = ident.Name, t.Args
+		}
+	}
+	switch {
+	case name == "stop" && len(args) == 0:
+		return action{kind: actStop}, nil
+	case name == "retract" && len(args) == 0:
+		return action{kind: actRetract}, nil
+	case name == "retract" && len(args) == 1:
+		if lit, ok := args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			target, err := strconv.Unquote(lit.Value)
+			return action{kind: actRetract, retract: target}, err
+		}
+	}
+	return action{}, fmt.Errorf("%w: expected assignment, stop or retract", ErrUnsupportExpr)
+}
+
+// assignPath 解析赋值目标，如 a、a.b、a["b"]
+func assignPath(src string) ([]string, error) {
+	expr, err := parseExpr(token.NewFileSet(), src)
+	if err != nil {
+		return nil, err
+	}
+	var path []string
+	for {
+		switch t := expr.(type) {
+		case *ast.Ident:
+			return append([]string{t.Name}, path...), nil
+		case *ast.SelectorExpr:
+			path = append([]string{t.Sel.Name}, path...)
+			expr = t.X
+			continue
+		case *ast.IndexExpr:
+			if lit, ok := t.Index.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				key, _ := strconv.Unquote(lit.Value)
+				path = append([]string{key}, path...)
+				expr = t.X
+				continue
+			}
+		case *ast.ParenExpr:
+			expr = t.X
+			continue
+		}
+		return nil, fmt.Errorf("%w: can not assign to %s", ErrUnsupportExpr, strings.TrimSpace(src))
+	}
+}
+
+// rootNames 返回表达式引用的顶层标志符
+func rootNames(expr ast.Expr, names []string) []string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "true", "false", "nil":
+			return names
+		}
+		for _, name := range names {
+			if name == t.Name {
+				return names
+			}
+		}
+		return append(names, t.Name)
+	case *ast.UnaryExpr:
+		return rootNames(t.X, names)
+	case *ast.BinaryExpr:
+		return rootNames(t.Y, rootNames(t.X, names))
+	case *ast.ParenExpr:
+		return rootNames(t.X, names)
+	case *ast.SelectorExpr:
+		return rootNames(t.X, names)
+	case *ast.IndexExpr:
+		return rootNames(t.Index, rootNames(t.X, names))
+	case *ast.CallExpr:
+		for _, arg := range t.Args {
+			names = rootNames(arg, names)
+		}
+	}
+	return names
+}
+
+// Firing 规则的一次执行
+type Firing struct {
+	Rule      string
+	Cycle     int                    // 第几次执行，从 1 开始
+	When      string                 // 条件表达式
+	Facts     map[string]interface{} // 条件引用的事实在执行时的值
+	Changes   []Change               // 动作改变的事实
+	Retracted []string               // 撤回的规则
+	Stop      bool                   // 执行了 stop
+}
+
+// Change 事实的一次改变，Old 为 nil 表示新增
+type Change struct {
+	Path     string
+	Old, New interface{}
+}
+
+// Result 规则集的执行结果
+type Result struct {
+	Facts   map[string]interface{}
+	Fired   []Firing
+	Stopped bool // 因 stop 结束
+}
+
+// Run 对事实执行规则集，动作直接修改 facts
+func (s *RuleSet) Run(facts map[string]interface{}) (*Result, error) {
+	if facts == nil {
+		facts = map[string]interface{}{}
+	}
+	max := s.MaxCycles
+	if max <= 0 {
+		max = DefaultMaxCycles
+	}
+	res := &Result{Facts: facts}
+
+	var (
+		version   int
+		changed   = map[string]int{}   // 事实最后一次改变时的版本
+		lastFired = map[*setRule]int{} // 规则最后一次执行后的版本
+		retracted = map[*setRule]bool{}
+	)
+	eligible := func(r *setRule) bool {
+		if retracted[r] {
+			return false
+		}
+		last, ok := lastFired[r]
+		if !ok {
+			return true
+		}
+		for _, dep := range r.deps {
+			if changed[dep] > last {
+				return true
+			}
+		}
+		return false
+	}
+
+	for {
+		var next *setRule
+		for _, r := range s.rules {
+			if !eligible(r) {
+				continue
+			}
+			ok, err := r.when.Bool(facts)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return res, fmt.Errorf("rule %s: %w", r.Name, err)
+			}
+			if ok {
+				next = r
+				break
+			}
+		}
+		if next == nil {
+			return res, nil
+		}
+		if len(res.Fired) >= max {
+			return res, fmt.Errorf("%w: %d firings, last rule %s", ErrCycleLimit, max, next.Name)
+		}
+
+		f := Firing{Rule: next.Name, Cycle: len(res.Fired) + 1, When: next.When, Facts: map[string]interface{}{}}
+		for _, dep := range next.deps {
+			if v, ok := facts[dep]; ok {
+				f.Facts[dep] = v
+			}
+		}
+		for _, a := range next.actions {
+			switch a.kind {
+			case actStop:
+				f.Stop = true
+			case actRetract:
+				target := next
+				if a.retract != "" {
+					if target = s.names[a.retract]; target == nil {
+						return res, fmt.Errorf("rule %s: retract unknown rule %s", next.Name, a.retract)
+					}
+				}
+				retracted[target] = true
+				f.Retracted = append(f.Retracted, target.Name)
+			case actAssign:
+				c, ok, err := a.assign(facts)
+				if err != nil {
+					return res, fmt.Errorf("rule %s: %w", next.Name, err)
+				}
+				if ok {
+					version++
+					changed[a.path[0]] = version
+					f.Changes = append(f.Changes, c)
+				}
+			}
+			if f.Stop {
+				break
+			}
+		}
+		lastFired[next] = version
+		res.Fired = append(res.Fired, f)
+		if f.Stop {
+			res.Stopped = true
+			return res, nil
+		}
+	}
+}
+
+// assign 执行赋值，ok 表示事实发生了变化
+func (a *action) assign(facts map[string]interface{}) (c Change, ok bool, err error) {
+	v, err := a.value.Eval(facts)
+	if err != nil {
+		return c, false, err
+	}
+
+	m := facts
+	for i, key := range a.path[:len(a.path)-1] {
+		next, exists := m[key]
+		if !exists || next == nil {
+			child := map[string]interface{}{}
+			m[key] = child
+			m = child
+			continue
+		}
+		child, isMap := next.(map[string]interface{})
+		if !isMap {
+			return c, false, fmt.Errorf("%w: can not assign to %s, %s is %T", ErrUnsupportParam,
+				strings.Join(a.path, "."), strings.Join(a.path[:i+1], "."), next)
+		}
+		m = child
+	}
+
+	key := a.path[len(a.path)-1]
+	old, exists := m[key]
+	if a.op != token.ASSIGN {
+		base := old
+		if !exists {
+			base = int64(0)
+		}
+		op := token.ADD
+		if a.op == token.SUB_ASSIGN {
+			op = token.SUB
+		}
+		if v, err = operate(base, v, op); err != nil {
+			return c, false, err
+		}
+	}
+	if exists && equal(old, v) {
+		return c, false, nil
+	}
+	m[key] = v
+	return Change{Path: strings.Join(a.path, "."), Old: old, New: v}, true, nil
+}
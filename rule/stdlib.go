@@ -0,0 +1,264 @@
+package rule
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+// TimeType 和 DurationType 为日期函数使用的类型
+var (
+	TimeType     = &Type{Kind: Time}
+	DurationType = &Type{Kind: Duration}
+)
+
+// 日期函数默认支持的格式
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// registerStdlib 注册标准函数库
+func registerStdlib(e *Env) {
+	str2 := []*Type{StringType, StringType}
+	e.funcs["contains"] = &Func{Params: []*Type{nil, nil}, Result: BoolType, Call: fnContains}
+	e.funcs["startsWith"] = &Func{Params: str2, Result: BoolType, Call: func(args []interface{}) (interface{}, error) {
+		return strings.HasPrefix(toString(args[0]), toString(args[1])), nil
+	}}
+	e.funcs["endsWith"] = &Func{Params: str2, Result: BoolType, Call: func(args []interface{}) (interface{}, error) {
+		return strings.HasSuffix(toString(args[0]), toString(args[1])), nil
+	}}
+	e.funcs["matches"] = &Func{Params: str2, Result: BoolType, Call: fnMatches}
+	e.funcs["len"] = &Func{Params: []*Type{nil}, Result: NumberType, Call: fnLen}
+	e.funcs["lower"] = &Func{Params: []*Type{StringType}, Result: StringType, Call: func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toString(args[0])), nil
+	}}
+	e.funcs["upper"] = &Func{Params: []*Type{StringType}, Result: StringType, Call: func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(args[0])), nil
+	}}
+	e.funcs["in"] = &Func{Params: []*Type{nil, nil, nil}, Variadic: true, Result: BoolType, Call: fnIn}
+	e.funcs["min"] = &Func{Params: []*Type{NumberType, NumberType}, Variadic: true, Result: NumberType, Call: func(args []interface{}) (interface{}, error) {
+		return extreme(args, -1)
+	}}
+	e.funcs["max"] = &Func{Params: []*Type{NumberType, NumberType}, Variadic: true, Result: NumberType, Call: func(args []interface{}) (interface{}, error) {
+		return extreme(args, 1)
+	}}
+	e.funcs["div"] = &Func{Params: []*Type{NumberType, NumberType}, Result: NumberType, Call: func(args []interface{}) (interface{}, error) {
+		return intDiv(args[0], args[1])
+	}}
+	e.funcs["abs"] = &Func{Params: []*Type{NumberType}, Result: NumberType, Call: fnAbs}
+	e.funcs["round"] = &Func{Params: []*Type{NumberType, NumberType}, Optional: 1, Result: NumberType, Call: fnRound}
+	e.funcs["now"] = &Func{Result: TimeType, Call: func([]interface{}) (interface{}, error) {
+		return e.now(), nil
+	}}
+	e.funcs["date"] = &Func{Params: []*Type{StringType, StringType}, Optional: 1, Result: TimeType, Call: fnDate}
+	e.funcs["duration"] = &Func{Params: []*Type{StringType}, Result: DurationType, Call: fnDuration}
+	e.funcs["dateAdd"] = &Func{Params: []*Type{TimeType, DurationType}, Result: TimeType, Call: func(args []interface{}) (interface{}, error) {
+		return args[0].(time.Time).Add(args[1].(time.Duration)), nil
+	}}
+	e.funcs["dateSub"] = &Func{Params: []*Type{TimeType, DurationType}, Result: TimeType, Call: func(args []interface{}) (interface{}, error) {
+		return args[0].(time.Time).Add(-args[1].(time.Duration)), nil
+	}}
+	e.funcs["dateDiff"] = &Func{Params: []*Type{TimeType, TimeType}, Result: DurationType, Call: func(args []interface{}) (interface{}, error) {
+		return args[0].(time.Time).Sub(args[1].(time.Time)), nil
+	}}
+	e.funcs["before"] = &Func{Params: []*Type{TimeType, TimeType}, Result: BoolType, Call: func(args []interface{}) (interface{}, error) {
+		return args[0].(time.Time).Before(args[1].(time.Time)), nil
+	}}
+	e.funcs["after"] = &Func{Params: []*Type{TimeType, TimeType}, Result: BoolType, Call: func(args []interface{}) (interface{}, error) {
+		return args[0].(time.Time).After(args[1].(time.Time)), nil
+	}}
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return reflect.ValueOf(v).String()
+}
+
+// toFloat 将数值转换为 float64
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case decimal.Decimal:
+		return n.InexactFloat64(), nil
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	}
+	return number(reflect.ValueOf(v))
+}
+
+// equal 比较两个值，数值按大小比较
+func equal(a, b interface{}) bool {
+	if toNum(a).kind != notNum {
+		c, ok, err := compareNum(a, b)
+		return err == nil && ok && c == 0
+	}
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !av.IsValid() || !bv.IsValid() {
+		return av.IsValid() == bv.IsValid()
+	}
+	if av.Type().Comparable() && bv.Type().Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// contains(s, sub) 判断字符串包含子串，或 slice 包含元素
+func fnContains(args []interface{}) (interface{}, error) {
+	if list, ok := sliceValues(args[0]); ok {
+		for _, v := range list {
+			if equal(v, args[1]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if reflect.ValueOf(args[0]).Kind() != reflect.String {
+		return nil, fmt.Errorf("contains: %T is not a string or slice", args[0])
+	}
+	return strings.Contains(toString(args[0]), fmt.Sprint(args[1])), nil
+}
+
+var regexps sync.Map // pattern -> *regexp.Regexp
+
+// matches(s, pattern) 正则匹配，编译结果会被缓存
+func fnMatches(args []interface{}) (interface{}, error) {
+	pattern := toString(args[1])
+	re, ok := regexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		re, _ = regexps.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(toString(args[0])), nil
+}
+
+// len(x) 字符串的字符数，slice 或 map 的长度
+func fnLen(args []interface{}) (interface{}, error) {
+	v := reflect.ValueOf(args[0])
+	switch v.Kind() {
+	case reflect.String:
+		return int64(utf8.RuneCountInString(v.String())), nil
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return int64(v.Len()), nil
+	}
+	return nil, fmt.Errorf("len: unsupported type %T", args[0])
+}
+
+// in(x, a, b, ...) 判断 x 是否等于其后某个参数，只有一个 slice 参数时判断是否为其元素
+func fnIn(args []interface{}) (interface{}, error) {
+	values := args[1:]
+	if len(values) == 1 {
+		if list, ok := sliceValues(args[1]); ok {
+			values = list
+		}
+	}
+	for _, v := range values {
+		if equal(args[0], v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// extreme 返回最小（sign<0）或最大（sign>0）的参数
+func extreme(args []interface{}, sign int) (interface{}, error) {
+	best := toNum(args[0])
+	if best.kind == notNum {
+		return nil, ErrNotNumber
+	}
+	for _, v := range args[1:] {
+		c, _, err := compareNum(v, best.value())
+		if err != nil {
+			return nil, err
+		}
+		if c == sign {
+			best = toNum(v)
+		}
+	}
+	return best.value(), nil
+}
+
+func fnAbs(args []interface{}) (interface{}, error) {
+	switch n := toNum(args[0]); n.kind {
+	case intNum:
+		if n.i < 0 {
+			return negate(n.i)
+		}
+		return n.i, nil
+	case floatNum:
+		return math.Abs(n.f), nil
+	case decNum:
+		return n.d.Abs(), nil
+	}
+	return nil, ErrNotNumber
+}
+
+// round(x) 或 round(x, places) 四舍五入
+func fnRound(args []interface{}) (interface{}, error) {
+	places := int64(0)
+	if len(args) == 2 {
+		p, err := toFloat(args[1])
+		if err != nil {
+			return nil, err
+		}
+		places = int64(p)
+	}
+	switch x := args[0].(type) {
+	case decimal.Decimal:
+		return x.Round(int32(places)), nil
+	case int64:
+		// 整数保持为整数，places 为负数时舍入到十位、百位等
+		if places >= 0 {
+			return x, nil
+		}
+		return decimal.NewFromInt(x).Round(int32(places)).IntPart(), nil
+	}
+	f, err := toFloat(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return decimal.NewFromFloat(f).Round(int32(places)).InexactFloat64(), nil
+}
+
+// date(s) 或 date(s, layout) 解析日期
+func fnDate(args []interface{}) (interface{}, error) {
+	s := toString(args[0])
+	if len(args) == 2 {
+		return time.Parse(toString(args[1]), s)
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("date: can not parse %q", s)
+}
+
+// duration(s) 解析时长，除 time.ParseDuration 的单位外还支持天，如 "7d"
+func fnDuration(args []interface{}) (interface{}, error) {
+	s := toString(args[0])
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return nil, fmt.Errorf("duration: invalid %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,170 @@
+package rule
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// 在 Go 表达式语法之外支持：
+//   - x in y、x not in y：解析前替换为等长的 == 和 !=，解析后改写为内置函数 ∈(x, y) 和 !∈(x, y)
+//   - x?.name：解析前替换为 x .name，解析后改写为内置函数 ?.(x, "name")，其后的 .name 也同样改写
+//   - if(cond, a, b)：if 是关键字，解析前替换为等长的标志符，解析后恢复
+// 替换保持字符偏移不变，错误位置与原表达式一致
+
+// 内置函数，名字不是合法的标志符，不会与 Env 中的函数重名
+const (
+	builtinIn       = "∈"
+	builtinNullSafe = "?."
+)
+
+// Expr 返回的语法树中 in、not in 和 ?. 对应的函数名
+const (
+	InFunc       = builtinIn
+	NullSafeFunc = builtinNullSafe
+)
+
+// any、all 的元素变量名
+const elemName = "it"
+
+// marks 需要在解析后改写的位置
+type marks struct {
+	in, notIn, nullSafe, ifs map[int]bool // 字符偏移
+	file                     *token.File
+}
+
+func (m *marks) at(set map[int]bool, pos token.Pos) bool {
+	return len(set) > 0 && pos.IsValid() && set[m.file.Offset(pos)]
+}
+
+// parseExpr 解析规则表达式
+func parseExpr(fset *token.FileSet, expr string) (ast.Expr, error) {
+	src := []byte(expr)
+	m := &marks{in: map[int]bool{}, notIn: map[int]bool{}, nullSafe: map[int]bool{}, ifs: map[int]bool{}}
+
+	type tok struct {
+		off int
+		tok token.Token
+		lit string
+	}
+	var toks []tok
+	var s scanner.Scanner
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	s.Init(file, src, func(token.Position, string) {}, 0)
+	for {
+		pos, t, lit := s.Scan()
+		if t == token.EOF {
+			break
+		}
+		if t == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+		toks = append(toks, tok{file.Offset(pos), t, lit})
+	}
+
+	// operand 判断 toks[i] 是否为操作数的结尾
+	operand := func(i int) bool {
+		if i < 0 {
+			return false
+		}
+		switch toks[i].tok {
+		case token.IDENT, token.INT, token.FLOAT, token.IMAG, token.CHAR, token.STRING, token.RPAREN, token.RBRACK, token.RBRACE:
+			return true
+		}
+		return false
+	}
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		switch {
+		case t.tok == token.IDENT && t.lit == "in" && operand(i-1):
+			copy(src[t.off:], "==")
+			m.in[t.off] = true
+		case t.tok == token.IDENT && t.lit == "not" && operand(i-1) &&
+			i+1 < len(toks) && toks[i+1].tok == token.IDENT && toks[i+1].lit == "in":
+			end := toks[i+1].off + len("in")
+			copy(src[t.off:end], "!="+strings.Repeat(" ", end-t.off-2))
+			m.notIn[t.off] = true
+			i++
+		case t.tok == token.ILLEGAL && t.lit == "?" && i+2 < len(toks) &&
+			toks[i+1].tok == token.PERIOD && toks[i+1].off == t.off+1 && toks[i+2].tok == token.IDENT:
+			src[t.off] = ' '
+			m.nullSafe[toks[i+2].off] = true
+			i += 2
+		case t.tok == token.IF && i+1 < len(toks) && toks[i+1].tok == token.LPAREN:
+			copy(src[t.off:], "If")
+			m.ifs[t.off] = true
+		}
+	}
+
+	exp, err := parser.ParseExprFrom(fset, "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.file = fset.File(exp.Pos())
+	return m.rewrite(exp), nil
+}
+
+// isNullSafe 判断表达式是否为改写后的 ?.
+func isNullSafe(expr ast.Expr) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*ast.Ident)
+	return ok && ident.Name == builtinNullSafe
+}
+
+// rewrite 将标记的节点改写为内置函数调用
+func (m *marks) rewrite(expr ast.Expr) ast.Expr {
+	switch t := expr.(type) {
+	case *ast.UnaryExpr:
+		t.X = m.rewrite(t.X)
+	case *ast.BinaryExpr:
+		t.X, t.Y = m.rewrite(t.X), m.rewrite(t.Y)
+		if m.at(m.in, t.OpPos) || m.at(m.notIn, t.OpPos) {
+			call := &ast.CallExpr{
+				Fun:    &ast.Ident{NamePos: t.OpPos, Name: builtinIn},
+				Lparen: t.OpPos,
+				Args:   []ast.Expr{t.X, t.Y},
+				Rparen: t.Y.End(),
+			}
+			if t.Op == token.NEQ {
+				return &ast.UnaryExpr{OpPos: t.OpPos, Op: token.NOT, X: call}
+			}
+			return call
+		}
+	case *ast.ParenExpr:
+		t.X = m.rewrite(t.X)
+	case *ast.SelectorExpr:
+		t.X = m.rewrite(t.X)
+		// a?.b.c 中 ?. 之后的选择也是空值安全的，a 为 nil 时结果为 nil
+		if explicit := m.at(m.nullSafe, t.Sel.NamePos); explicit || isNullSafe(t.X) {
+			// Fun 的位置为 ?. 或 . 的位置
+			pos := t.Sel.NamePos - 1
+			if explicit {
+				pos--
+			}
+			return &ast.CallExpr{
+				Fun:    &ast.Ident{NamePos: pos, Name: builtinNullSafe},
+				Lparen: t.Sel.NamePos,
+				Args:   []ast.Expr{t.X, &ast.BasicLit{ValuePos: t.Sel.NamePos, Kind: token.STRING, Value: strconv.Quote(t.Sel.Name)}},
+				Rparen: t.Sel.End(),
+			}
+		}
+	case *ast.IndexExpr:
+		t.X, t.Index = m.rewrite(t.X), m.rewrite(t.Index)
+	case *ast.CallExpr:
+		if ident, ok := t.Fun.(*ast.Ident); ok && m.at(m.ifs, ident.NamePos) {
+			ident.Name = "if"
+		} else {
+			t.Fun = m.rewrite(t.Fun)
+		}
+		for i, arg := range t.Args {
+			t.Args[i] = m.rewrite(arg)
+		}
+	}
+	return expr
+}
@@ -1,54 +1,24 @@
 package rule
 
 import (
-	"errors"
 	"go/token"
 	"reflect"
-
-	"github.com/shopspring/decimal"
+	"strings"
 )
 
+// operate 二元运算，/ 使用默认的小数位数和舍入方式
 func operate(x, y interface{}, tk token.Token) (interface{}, error) {
-	xv := reflect.ValueOf(x)
-	yv := reflect.ValueOf(y)
 	switch tk {
-	case token.ADD, token.SUB, token.MUL, token.QUO, token.LSS, token.GTR, token.LEQ, token.GEQ, token.EQL, token.NEQ:
-		var a, b float64
-		var err error
-		if a, err = number(xv); err != nil {
-			return nil, err
-		}
-		if b, err = number(yv); err != nil {
-			return nil, err
-		}
-		switch tk {
-		case token.ADD:
-			return decimal.NewFromFloat(a).Add(decimal.NewFromFloat(b)), nil
-		case token.SUB:
-			return decimal.NewFromFloat(a).Sub(decimal.NewFromFloat(b)), nil
-		case token.MUL:
-			return decimal.NewFromFloat(a).Mul(decimal.NewFromFloat(b)), nil
-		case token.QUO:
-			if b == 0 {
-				return 0, errors.New("x/0 error")
-			}
-			return a / b, nil
-		case token.LSS:
-			return a < b, nil
-		case token.GTR:
-			return a > b, nil
-		case token.LEQ:
-			return a <= b, nil
-		case token.GEQ:
-			return a >= b, nil
-		case token.EQL:
-			return a == b, nil
-		case token.NEQ:
-			return a != b, nil
-		default:
-			return 0, ErrUnsupportToken
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		if s, ok := concat(x, y); ok && tk == token.ADD {
+			return s, nil
 		}
+		return arith(x, y, tk, defaultDivision)
+	case token.LSS, token.GTR, token.LEQ, token.GEQ, token.EQL, token.NEQ:
+		return compareValues(x, y, tk)
 	case token.LAND, token.LOR:
+		xv := reflect.ValueOf(x)
+		yv := reflect.ValueOf(y)
 		if xv.Kind() != reflect.Bool || yv.Kind() != reflect.Bool {
 			return false, ErrNotBool
 		}
@@ -65,17 +35,46 @@ func operate(x, y interface{}, tk token.Token) (interface{}, error) {
 	}
 }
 
-func number(x reflect.Value) (float64, error) {
-	switch x.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return float64(x.Int()), nil
-	case reflect.Float32, reflect.Float64:
-		return x.Float(), nil
-	default:
-		return 0, ErrNotNumber
+// compareValues 比较两个值：数值按大小，字符串按字典序，其他值只能判断是否相等
+func compareValues(x, y interface{}, tk token.Token) (interface{}, error) {
+	if toNum(x).kind != notNum && toNum(y).kind != notNum {
+		return compare(x, y, tk)
+	}
+	if a, ok := str(x); ok {
+		if b, ok := str(y); ok {
+			return compareFloat(float64(strings.Compare(a, b)), 0, tk), nil
+		}
 	}
+	switch tk {
+	case token.EQL:
+		return equal(x, y), nil
+	case token.NEQ:
+		return !equal(x, y), nil
+	}
+	return nil, ErrNotNumber
 }
 
-func evelUnary(x reflect.Value) {
+// concat 连接两个字符串
+func concat(x, y interface{}) (string, bool) {
+	a, ok := str(x)
+	if !ok {
+		return "", false
+	}
+	b, ok := str(y)
+	if !ok {
+		return "", false
+	}
+	return a + b, true
+}
 
+// number 将整数、浮点数和 decimal.Decimal 转换为 float64
+func number(x reflect.Value) (float64, error) {
+	if !x.IsValid() || !x.CanInterface() {
+		return 0, ErrNotNumber
+	}
+	n := toNum(x.Interface())
+	if n.kind == notNum {
+		return 0, ErrNotNumber
+	}
+	return n.float(), nil
 }
@@ -0,0 +1,141 @@
+package rule
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// Trace 求值过程中一个子表达式的结果，String 输出缩进的文本，也可以直接序列化为 JSON
+type Trace struct {
+	Expr     string      `json:"expr"`
+	Start    int         `json:"start"` // 在表达式中的字节偏移
+	End      int         `json:"end"`
+	Value    interface{} `json:"value,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Skipped  bool        `json:"skipped,omitempty"` // 短路或 if 的另一个分支，没有求值
+	Children []*Trace    `json:"children,omitempty"`
+}
+
+// EvalTrace 求值并记录每个子表达式的值，用于解释规则的结果，比 Eval 慢得多，
+// 与 Eval 同样受 Limits 限制
+func (r *Rule) EvalTrace(datasource interface{}) (interface{}, *Trace, error) {
+	if r.expr == nil {
+		return nil, nil, ErrRuleEmpty
+	}
+	if err := r.checkDepth(); err != nil {
+		return nil, nil, err
+	}
+	env := r.env
+	if env == nil {
+		env = defaultEnv
+	}
+	prog, err := (&compiler{env: env, div: env.division(), trace: true, src: r.src, fset: r.fset}).compile(r.expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := root(datasource)
+	if err != nil {
+		return nil, nil, err
+	}
+	top := &Trace{}
+	st := &state{root: data, trace: top}
+	cancel := r.limit(nil, st)
+	defer cancel()
+	v, err := prog(st)
+	return v, top.Children[0], err
+}
+
+// span 返回表达式在源码中的位置，in、not in 和 ?. 改写后的节点按改写前的范围计算
+func span(expr ast.Expr) (pos, end token.Pos) {
+	switch t := expr.(type) {
+	case *ast.UnaryExpr:
+		if p, e := span(t.X); p < t.OpPos {
+			return p, e
+		}
+	case *ast.CallExpr:
+		if ident, ok := t.Fun.(*ast.Ident); ok {
+			switch ident.Name {
+			case builtinIn:
+				return t.Args[0].Pos(), t.Args[1].End()
+			case builtinNullSafe:
+				return t.Args[0].Pos(), t.Rparen
+			}
+		}
+	}
+	return expr.Pos(), expr.End()
+}
+
+// node 返回表达式对应的空节点
+func (c *compiler) node(expr ast.Expr) *Trace {
+	pos, end := span(expr)
+	file := c.fset.File(pos)
+	start, stop := file.Offset(pos), file.Offset(end)
+	return &Trace{Expr: c.src[start:stop], Start: start, End: stop}
+}
+
+// traced 求值时在当前节点下记录表达式的值
+func (c *compiler) traced(expr ast.Expr, fn evalFn) evalFn {
+	tmpl := c.node(expr)
+	return func(st *state) (interface{}, error) {
+		parent, node := st.trace, *tmpl
+		st.trace = &node
+		v, err := fn(st)
+		st.trace = parent
+		node.Value = v
+		if err != nil {
+			node.Error = err.Error()
+		}
+		parent.Children = append(parent.Children, &node)
+		return v, err
+	}
+}
+
+// skip 返回记录未求值的表达式的函数，不在 EvalTrace 中时什么也不做
+func (c *compiler) skip(expr ast.Expr) func(st *state) {
+	if !c.trace {
+		return func(*state) {}
+	}
+	tmpl := c.node(expr)
+	tmpl.Skipped = true
+	return func(st *state) {
+		node := *tmpl
+		st.trace.Children = append(st.trace.Children, &node)
+	}
+}
+
+// String 按缩进的文本输出，每行为表达式及其值
+func (t *Trace) String() string {
+	var b strings.Builder
+	t.write(&b, 0)
+	return b.String()
+}
+
+func (t *Trace) write(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("  ", depth))
+	b.WriteString(t.Expr)
+	switch {
+	case t.Skipped:
+		b.WriteString(" (skipped)")
+	case t.Error != "":
+		b.WriteString(" => error: " + t.Error)
+	default:
+		b.WriteString(" => " + formatValue(t.Value))
+	}
+	b.WriteByte('\n')
+	for _, child := range t.Children {
+		child.write(b, depth+1)
+	}
+}
+
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(t)
+	}
+	return fmt.Sprint(v)
+}
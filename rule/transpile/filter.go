@@ -0,0 +1,260 @@
+package transpile
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/token"
+	"regexp"
+
+	"github.com/carmel/go-util/rule"
+	"github.com/shopspring/decimal"
+)
+
+// ToFilter 将规则转换为 Mongo 风格的过滤文档，结果可直接序列化为 JSON，
+// 字段与常量的比较写作 {col: {$gt: v}}，其他比较写作 {$expr: ...}，小数转换为 json.Number
+func ToFilter(r *rule.Rule, opt Options) (map[string]interface{}, error) {
+	if r.Expr() == nil {
+		return nil, rule.ErrRuleEmpty
+	}
+	f := &filterWriter{translator{rule: r, opt: opt}}
+	return f.cond(r.Expr())
+}
+
+type filterWriter struct {
+	translator
+}
+
+var filterOps = map[token.Token]string{
+	token.LSS: "$lt", token.GTR: "$gt", token.LEQ: "$lte", token.GEQ: "$gte", token.EQL: "$eq", token.NEQ: "$ne",
+	token.ADD: "$add", token.SUB: "$subtract", token.MUL: "$multiply", token.QUO: "$divide", token.REM: "$mod",
+}
+
+// cond 转换条件
+func (f *filterWriter) cond(expr ast.Expr) (map[string]interface{}, error) {
+	switch e := unparen(expr).(type) {
+	case *ast.Ident:
+		switch e.Name {
+		case "true":
+			return map[string]interface{}{}, nil
+		case "false":
+			return map[string]interface{}{"$expr": false}, nil
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND, token.LOR:
+			op := "$and"
+			if e.Op == token.LOR {
+				op = "$or"
+			}
+			var list []interface{}
+			for _, x := range flatten(e, e.Op, nil) {
+				c, err := f.cond(x)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, c)
+			}
+			return map[string]interface{}{op: list}, nil
+		}
+		if isComparison(e.Op) {
+			return f.compare(e)
+		}
+	case *ast.UnaryExpr:
+		if e.Op == token.NOT {
+			x, err := f.cond(e.X)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"$nor": []interface{}{x}}, nil
+		}
+	case *ast.CallExpr:
+		switch name := call(e); name {
+		case rule.InFunc:
+			col, ok, err := f.field(e.Args[1])
+			if err != nil {
+				return nil, err
+			}
+			v, isLit := literal(e.Args[0])
+			if !ok || !isLit {
+				return nil, f.errorf(e, "in expects a constant and a field")
+			}
+			return map[string]interface{}{col: f.constant(v)}, nil
+		case "in":
+			col, ok, err := f.field(e.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			list := make([]interface{}, len(e.Args)-1)
+			for i, arg := range e.Args[1:] {
+				v, ok := literal(arg)
+				if !ok {
+					return nil, f.errorf(arg, "in expects constants")
+				}
+				list[i] = f.constant(v)
+			}
+			return map[string]interface{}{col: map[string]interface{}{"$in": list}}, nil
+		case "contains", "startsWith", "endsWith":
+			col, ok, err := f.field(e.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			v, isLit := literal(e.Args[1])
+			k := f.rule.TypeOf(e.Args[0]).Kind
+			if ok && isLit && name == "contains" && k == rule.Slice {
+				// 列表字段判断是否包含元素
+				return map[string]interface{}{col: f.constant(v)}, nil
+			}
+			str, isStr := v.(string)
+			if !ok || !isStr {
+				return nil, f.errorf(e, "%s expects a field and a string constant", name)
+			}
+			if k != rule.Any && k != rule.String {
+				return nil, f.errorf(e.Args[0], "%s on a %s can not be translated to a filter", name, k)
+			}
+			pattern := regexp.QuoteMeta(str)
+			switch name {
+			case "startsWith":
+				pattern = "^" + pattern
+			case "endsWith":
+				pattern += "$"
+			}
+			return map[string]interface{}{col: map[string]interface{}{"$regex": pattern}}, nil
+		}
+	}
+	col, ok, err := f.field(expr)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// 布尔类型的列
+		return map[string]interface{}{col: true}, nil
+	}
+	v, err := f.value(expr)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"$expr": v}, nil
+}
+
+func (f *filterWriter) compare(e *ast.BinaryExpr) (map[string]interface{}, error) {
+	x, y, op := e.X, e.Y, e.Op
+	if _, ok := literal(x); ok {
+		x, y, op = y, x, flip(op)
+	}
+	col, ok, err := f.field(x)
+	if err != nil {
+		return nil, err
+	}
+	if v, isLit := literal(y); ok && isLit {
+		if op == token.EQL {
+			return map[string]interface{}{col: f.constant(v)}, nil
+		}
+		return map[string]interface{}{col: map[string]interface{}{filterOps[op]: f.constant(v)}}, nil
+	}
+	v, err := f.value(e)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"$expr": v}, nil
+}
+
+// value 转换为聚合表达式
+func (f *filterWriter) value(expr ast.Expr) (interface{}, error) {
+	if v, ok := literal(expr); ok {
+		return f.constant(v), nil
+	}
+	col, ok, err := f.field(expr)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return "$" + col, nil
+	}
+	switch e := unparen(expr).(type) {
+	case *ast.BinaryExpr:
+		var op string
+		switch e.Op {
+		case token.LAND:
+			op = "$and"
+		case token.LOR:
+			op = "$or"
+		case token.ADD:
+			if f.isString(e) {
+				op = "$concat"
+				break
+			}
+			fallthrough
+		default:
+			op = filterOps[e.Op]
+		}
+		if op == "" {
+			break
+		}
+		x, err := f.value(e.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := f.value(e.Y)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{op: []interface{}{x, y}}, nil
+	case *ast.UnaryExpr:
+		x, err := f.value(e.X)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Op {
+		case token.NOT:
+			return map[string]interface{}{"$not": []interface{}{x}}, nil
+		case token.SUB:
+			return map[string]interface{}{"$multiply": []interface{}{-1, x}}, nil
+		}
+	case *ast.CallExpr:
+		switch name := call(e); name {
+		case "lower", "upper":
+			x, err := f.value(e.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			op := "$toLower"
+			if name == "upper" {
+				op = "$toUpper"
+			}
+			return map[string]interface{}{op: x}, nil
+		case "if":
+			args := make([]interface{}, 3)
+			for i, arg := range e.Args {
+				if args[i], err = f.value(arg); err != nil {
+					return nil, err
+				}
+			}
+			return map[string]interface{}{"$cond": args}, nil
+		case "in":
+			x, err := f.value(e.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			list := make([]interface{}, len(e.Args)-1)
+			for i, arg := range e.Args[1:] {
+				if list[i], err = f.value(arg); err != nil {
+					return nil, err
+				}
+			}
+			return map[string]interface{}{"$in": []interface{}{x, list}}, nil
+		}
+		return nil, f.errorf(e, "function %s can not be translated to a filter", displayName(call(e)))
+	}
+	return nil, f.errorf(expr, "can not be translated to a filter")
+}
+
+// constant 转换常量，小数转换为 json.Number 以保留精度
+func (f *filterWriter) constant(v interface{}) interface{} {
+	if d, ok := v.(decimal.Decimal); ok {
+		return json.Number(d.String())
+	}
+	return v
+}
@@ -0,0 +1,314 @@
+package transpile
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/carmel/go-util/rule"
+)
+
+// Dialect SQL 方言
+type Dialect interface {
+	// Placeholder 返回第 n 个参数的占位符，n 从 1 开始
+	Placeholder(n int) string
+	// Quote 返回带引号的标志符
+	Quote(ident string) string
+	// Concat 返回字符串连接的表达式
+	Concat(a, b string) string
+	// Divide 返回按小数相除的表达式，规则中的除法不是整数除法
+	Divide(a, b string) string
+}
+
+// 内置的方言
+var (
+	MySQL     Dialect = mysql{}
+	Postgres  Dialect = postgres{}
+	SQLite    Dialect = sqlite{}
+	SQLServer Dialect = sqlServer{}
+)
+
+type mysql struct{}
+
+func (mysql) Placeholder(int) string    { return "?" }
+func (mysql) Quote(ident string) string { return "`" + strings.ReplaceAll(ident, "`", "``") + "`" }
+func (mysql) Concat(a, b string) string { return "CONCAT(" + a + ", " + b + ")" }
+func (mysql) Divide(a, b string) string { return "(" + a + " / " + b + ")" }
+
+type postgres struct{}
+
+func (postgres) Placeholder(n int) string  { return "$" + strconv.Itoa(n) }
+func (postgres) Quote(ident string) string { return quoteDouble(ident) }
+func (postgres) Concat(a, b string) string { return "(" + a + " || " + b + ")" }
+func (postgres) Divide(a, b string) string { return "(CAST(" + a + " AS NUMERIC) / " + b + ")" }
+
+type sqlite struct{}
+
+func (sqlite) Placeholder(int) string    { return "?" }
+func (sqlite) Quote(ident string) string { return quoteDouble(ident) }
+func (sqlite) Concat(a, b string) string { return "(" + a + " || " + b + ")" }
+func (sqlite) Divide(a, b string) string { return "(CAST(" + a + " AS REAL) / " + b + ")" }
+
+type sqlServer struct{}
+
+func (sqlServer) Placeholder(n int) string  { return "@p" + strconv.Itoa(n) }
+func (sqlServer) Quote(ident string) string { return "[" + strings.ReplaceAll(ident, "]", "]]") + "]" }
+func (sqlServer) Concat(a, b string) string { return "(" + a + " + " + b + ")" }
+func (sqlServer) Divide(a, b string) string {
+	return "(CAST(" + a + " AS DECIMAL(38, 10)) / " + b + ")"
+}
+
+func quoteDouble(ident string) string {
+	return `"` + strings.ReplaceAll(ident, `"`, `""`) + `"`
+}
+
+// SQLOptions SQL 转换选项
+type SQLOptions struct {
+	Options
+	Dialect Dialect // 默认为 Postgres
+	// Offset 第一个占位符的序号减 1，用于拼接到已有参数的语句中
+	Offset int
+}
+
+// ToSQL 将规则转换为 WHERE 子句（不含 WHERE）及其参数，列名按 . 分段加引号
+func ToSQL(r *rule.Rule, opt SQLOptions) (where string, args []interface{}, err error) {
+	if r.Expr() == nil {
+		return "", nil, rule.ErrRuleEmpty
+	}
+	if opt.Dialect == nil {
+		opt.Dialect = Postgres
+	}
+	s := &sqlWriter{translator: translator{rule: r, opt: opt.Options}, dialect: opt.Dialect, offset: opt.Offset}
+	if where, err = s.cond(r.Expr()); err != nil {
+		return "", nil, err
+	}
+	return where, s.args, nil
+}
+
+type sqlWriter struct {
+	translator
+	dialect Dialect
+	offset  int
+	args    []interface{}
+}
+
+func (s *sqlWriter) arg(v interface{}) string {
+	s.args = append(s.args, v)
+	return s.dialect.Placeholder(s.offset + len(s.args))
+}
+
+func (s *sqlWriter) quote(col string) string {
+	parts := strings.Split(col, ".")
+	for i, p := range parts {
+		parts[i] = s.dialect.Quote(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// cond 转换条件
+func (s *sqlWriter) cond(expr ast.Expr) (string, error) {
+	switch e := unparen(expr).(type) {
+	case *ast.Ident:
+		switch e.Name {
+		case "true":
+			return "1 = 1", nil
+		case "false":
+			return "1 = 0", nil
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND, token.LOR:
+			x, err := s.cond(e.X)
+			if err != nil {
+				return "", err
+			}
+			y, err := s.cond(e.Y)
+			if err != nil {
+				return "", err
+			}
+			op := " AND "
+			if e.Op == token.LOR {
+				op = " OR "
+			}
+			return "(" + x + op + y + ")", nil
+		}
+		if isComparison(e.Op) {
+			return s.compare(e)
+		}
+	case *ast.UnaryExpr:
+		if e.Op == token.NOT {
+			x, err := s.cond(e.X)
+			if err != nil {
+				return "", err
+			}
+			return "NOT " + x, nil
+		}
+	case *ast.CallExpr:
+		return s.callCond(e)
+	}
+	// 布尔类型的列
+	return s.value(expr)
+}
+
+func (s *sqlWriter) compare(e *ast.BinaryExpr) (string, error) {
+	x, y, op := e.X, e.Y, e.Op
+	if v, ok := literal(x); ok && v == nil {
+		x, y = y, x
+	}
+	if v, ok := literal(y); ok && v == nil {
+		switch op {
+		case token.EQL:
+			a, err := s.value(x)
+			return a + " IS NULL", err
+		case token.NEQ:
+			a, err := s.value(x)
+			return a + " IS NOT NULL", err
+		}
+		return "", s.errorf(e, "nil can only be compared with == or !=")
+	}
+	a, err := s.value(x)
+	if err != nil {
+		return "", err
+	}
+	b, err := s.value(y)
+	if err != nil {
+		return "", err
+	}
+	sqlOp := map[token.Token]string{
+		token.LSS: "<", token.GTR: ">", token.LEQ: "<=", token.GEQ: ">=", token.EQL: "=", token.NEQ: "<>",
+	}[op]
+	return a + " " + sqlOp + " " + b, nil
+}
+
+// callCond 转换返回布尔值的函数
+func (s *sqlWriter) callCond(e *ast.CallExpr) (string, error) {
+	switch name := call(e); name {
+	case rule.InFunc:
+		return "", s.errorf(e, "x in field can not be translated to SQL, use in(field, a, b) or contains(field, x)")
+	case "in":
+		x, err := s.value(e.Args[0])
+		if err != nil {
+			return "", err
+		}
+		list := make([]string, len(e.Args)-1)
+		for i, arg := range e.Args[1:] {
+			if list[i], err = s.value(arg); err != nil {
+				return "", err
+			}
+		}
+		return x + " IN (" + strings.Join(list, ", ") + ")", nil
+	case "contains", "startsWith", "endsWith":
+		if k := s.rule.TypeOf(e.Args[0]).Kind; k != rule.Any && k != rule.String {
+			return "", s.errorf(e.Args[0], "%s on a %s can not be translated to SQL, only strings are supported", name, k)
+		}
+		x, err := s.value(e.Args[0])
+		if err != nil {
+			return "", err
+		}
+		v, ok := literal(e.Args[1])
+		str, isStr := v.(string)
+		if !ok || !isStr {
+			return "", s.errorf(e.Args[1], "%s expects a string constant", name)
+		}
+		pattern := escapeLike(str)
+		switch name {
+		case "contains":
+			pattern = "%" + pattern + "%"
+		case "startsWith":
+			pattern += "%"
+		default:
+			pattern = "%" + pattern
+		}
+		return x + " LIKE " + s.arg(pattern) + " ESCAPE '!'", nil
+	}
+	return s.value(e)
+}
+
+// value 转换值
+func (s *sqlWriter) value(expr ast.Expr) (string, error) {
+	if v, ok := literal(expr); ok {
+		if v == nil {
+			return "NULL", nil
+		}
+		return s.arg(v), nil
+	}
+	col, ok, err := s.field(expr)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return s.quote(col), nil
+	}
+	switch e := unparen(expr).(type) {
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+			x, err := s.value(e.X)
+			if err != nil {
+				return "", err
+			}
+			y, err := s.value(e.Y)
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case e.Op == token.ADD && s.isString(e):
+				return s.dialect.Concat(x, y), nil
+			case e.Op == token.QUO:
+				return s.dialect.Divide(x, y), nil
+			}
+			return "(" + x + " " + e.Op.String() + " " + y + ")", nil
+		}
+		return s.cond(e)
+	case *ast.UnaryExpr:
+		if e.Op == token.SUB {
+			x, err := s.value(e.X)
+			return "-" + x, err
+		}
+		return s.cond(e)
+	case *ast.CallExpr:
+		switch name := call(e); name {
+		case "lower", "upper":
+			x, err := s.value(e.Args[0])
+			return strings.ToUpper(name) + "(" + x + ")", err
+		case "if":
+			c, err := s.cond(e.Args[0])
+			if err != nil {
+				return "", err
+			}
+			a, err := s.value(e.Args[1])
+			if err != nil {
+				return "", err
+			}
+			b, err := s.value(e.Args[2])
+			if err != nil {
+				return "", err
+			}
+			return "CASE WHEN " + c + " THEN " + a + " ELSE " + b + " END", nil
+		case "in", "contains", "startsWith", "endsWith", rule.InFunc:
+			return s.callCond(e)
+		}
+		return "", s.errorf(e, "function %s can not be translated to SQL", displayName(call(e)))
+	}
+	return "", s.errorf(expr, "can not be translated to SQL")
+}
+
+// escapeLike 转义 LIKE 的通配符，转义字符为 !，不使用 \ 以免 MySQL 中 '\' 为未结束的字符串，
+// [ 在 SQL Server 中也是通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "[", "![").Replace(s)
+}
+
+// displayName 返回函数在表达式中的写法
+func displayName(name string) string {
+	switch name {
+	case "":
+		return "call"
+	case rule.InFunc:
+		return "in"
+	case rule.NullSafeFunc:
+		return "?."
+	}
+	return name
+}
@@ -0,0 +1,222 @@
+// Package transpile 将规则表达式转换为 SQL 的 WHERE 子句或 Mongo 风格的过滤文档，
+// 使内存中求值的条件可以下推到数据库执行。
+//
+// 字段（a、a.b、a["b"]、a[0]、a?.b）按 Options 映射为列名；比较、&&、||、!、算术运算、
+// if、函数 in、contains、startsWith、endsWith、lower、upper 可以转换，
+// any、all 及其他函数返回 *Error。
+//
+// 转换时按规则的 schema 区分字段的类型：+ 只有一边为字符串时才是字符串连接，
+// contains 等字符串函数只支持字符串字段。没有 schema 时两个字段的 + 按数值相加，
+// contains 的第一个参数按字符串字段处理。
+package transpile
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+
+	"github.com/carmel/go-util/rule"
+)
+
+// Options 字段到列名的映射
+type Options struct {
+	// Columns 字段路径（如 user.age）到列名的映射，不为 nil 时其中没有的字段返回错误
+	Columns map[string]string
+	// Column 不为 nil 时代替 Columns
+	Column func(path string) (string, error)
+}
+
+func (o *Options) column(path string) (string, error) {
+	switch {
+	case o.Column != nil:
+		return o.Column(path)
+	case o.Columns != nil:
+		if col, ok := o.Columns[path]; ok {
+			return col, nil
+		}
+		return "", fmt.Errorf("field %s is not mapped to a column", path)
+	}
+	return path, nil
+}
+
+// Error 无法转换的表达式
+type Error struct {
+	Expr string // 表达式原文
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Expr + ": " + e.Msg
+}
+
+// translator 转换的公共部分
+type translator struct {
+	rule *rule.Rule
+	opt  Options
+}
+
+func (t *translator) errorf(node ast.Expr, format string, args ...interface{}) error {
+	return &Error{Expr: t.rule.Source(node), Msg: fmt.Sprintf(format, args...)}
+}
+
+// field 返回字段访问对应的列名，ok 为 false 表示不是字段访问
+func (t *translator) field(expr ast.Expr) (col string, ok bool, err error) {
+	path, ok := fieldPath(expr)
+	if !ok {
+		return "", false, nil
+	}
+	col, err = t.opt.column(path)
+	if err != nil {
+		return "", true, t.errorf(expr, "%v", err)
+	}
+	return col, true, nil
+}
+
+// fieldPath 返回字段访问的路径，索引和 ?. 也写作 .
+func fieldPath(expr ast.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return fieldPath(e.X)
+	case *ast.Ident:
+		switch e.Name {
+		case "true", "false", "nil":
+			return "", false
+		}
+		return e.Name, true
+	case *ast.SelectorExpr:
+		if x, ok := fieldPath(e.X); ok {
+			return x + "." + e.Sel.Name, true
+		}
+	case *ast.IndexExpr:
+		lit, ok := e.Index.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING && lit.Kind != token.INT {
+			return "", false
+		}
+		key := lit.Value
+		if lit.Kind == token.STRING {
+			key, _ = strconv.Unquote(lit.Value)
+		}
+		if x, ok := fieldPath(e.X); ok {
+			return x + "." + key, true
+		}
+	case *ast.CallExpr:
+		if call(e) == rule.NullSafeFunc {
+			name, _ := strconv.Unquote(e.Args[1].(*ast.BasicLit).Value)
+			if x, ok := fieldPath(e.Args[0]); ok {
+				return x + "." + name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// literal 返回常量的值，整数为 int64，小数为 decimal.Decimal
+func literal(expr ast.Expr) (interface{}, bool) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return literal(e.X)
+	case *ast.BasicLit:
+		r := &rule.Rule{}
+		if err := r.SetExpr(e.Value); err != nil {
+			return nil, false
+		}
+		v, err := r.Eval(nil)
+		return v, err == nil
+	case *ast.Ident:
+		switch e.Name {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		case "nil":
+			return nil, true
+		}
+	case *ast.UnaryExpr:
+		if e.Op != token.SUB {
+			return nil, false
+		}
+		if lit, ok := e.X.(*ast.BasicLit); ok {
+			r := &rule.Rule{}
+			if err := r.SetExpr("-" + lit.Value); err != nil {
+				return nil, false
+			}
+			v, err := r.Eval(nil)
+			return v, err == nil
+		}
+	}
+	return nil, false
+}
+
+// isString 判断表达式的值是否为字符串：字符串常量、schema 中的字符串字段、
+// lower、upper 及字符串连接
+func (t *translator) isString(expr ast.Expr) bool {
+	if v, ok := literal(expr); ok {
+		_, ok = v.(string)
+		return ok
+	}
+	switch e := unparen(expr).(type) {
+	case *ast.CallExpr:
+		switch call(e) {
+		case "lower", "upper":
+			return true
+		}
+	case *ast.BinaryExpr:
+		if e.Op == token.ADD {
+			return t.isString(e.X) || t.isString(e.Y)
+		}
+	}
+	return t.rule.TypeOf(expr).Kind == rule.String
+}
+
+// call 返回函数调用的函数名
+func call(expr ast.Expr) string {
+	if c, ok := expr.(*ast.CallExpr); ok {
+		if ident, ok := c.Fun.(*ast.Ident); ok {
+			return ident.Name
+		}
+	}
+	return ""
+}
+
+// unparen 去掉外层的圆括号
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		p, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.X
+	}
+}
+
+// flip 交换比较的两边时对应的运算符
+func flip(op token.Token) token.Token {
+	switch op {
+	case token.LSS:
+		return token.GTR
+	case token.GTR:
+		return token.LSS
+	case token.LEQ:
+		return token.GEQ
+	case token.GEQ:
+		return token.LEQ
+	}
+	return op
+}
+
+func isComparison(op token.Token) bool {
+	switch op {
+	case token.LSS, token.GTR, token.LEQ, token.GEQ, token.EQL, token.NEQ:
+		return true
+	}
+	return false
+}
+
+// flatten 返回 a op b op c 的操作数
+func flatten(expr ast.Expr, op token.Token, operands []ast.Expr) []ast.Expr {
+	if b, ok := unparen(expr).(*ast.BinaryExpr); ok && b.Op == op {
+		return flatten(b.Y, op, flatten(b.X, op, operands))
+	}
+	return append(operands, expr)
+}
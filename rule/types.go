@@ -0,0 +1,303 @@
+package rule
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// Kind 类型种类
+type Kind int
+
+const (
+	Any      Kind = iota // 未知类型，不做检查
+	Bool                 // 布尔
+	Number               // 数值
+	String               // 字符串
+	Map                  // map[string]interface{}
+	Slice                // []interface{}
+	Time                 // time.Time
+	Duration             // time.Duration，可以作为数值比较
+)
+
+var kindNames = [...]string{"any", "bool", "number", "string", "map", "slice", "time", "duration"}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// Type 数据源中值的类型
+type Type struct {
+	Kind   Kind
+	Fields map[string]*Type // Map 的已知字段，为空时所有值的类型为 Elem
+	Elem   *Type            // Slice 的元素类型或 Map 的值类型，nil 表示 Any
+}
+
+// 基本类型
+var (
+	AnyType    = &Type{Kind: Any}
+	BoolType   = &Type{Kind: Bool}
+	NumberType = &Type{Kind: Number}
+	StringType = &Type{Kind: String}
+)
+
+// MapOf 返回具有给定字段的 map 类型
+func MapOf(fields map[string]*Type) *Type {
+	return &Type{Kind: Map, Fields: fields}
+}
+
+// SliceOf 返回元素类型为 elem 的 slice 类型
+func SliceOf(elem *Type) *Type {
+	return &Type{Kind: Slice, Elem: elem}
+}
+
+func (t *Type) String() string {
+	if t == nil {
+		return "any"
+	}
+	switch t.Kind {
+	case Map:
+		if len(t.Fields) == 0 {
+			return "map[string]" + t.Elem.String()
+		}
+		names := make([]string, 0, len(t.Fields))
+		for name := range t.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			names[i] = name + " " + t.Fields[name].String()
+		}
+		return "{" + strings.Join(names, "; ") + "}"
+	case Slice:
+		return "[]" + t.Elem.String()
+	}
+	return t.Kind.String()
+}
+
+func (t *Type) is(k Kind) bool {
+	return k == Any || t == nil || t.Kind == Any || t.Kind == k || (k == Number && t.Kind == Duration)
+}
+
+func (t *Type) elem() *Type {
+	if t == nil || t.Elem == nil {
+		return AnyType
+	}
+	return t.Elem
+}
+
+// Schema 数据源的字段及其类型
+type Schema map[string]*Type
+
+// TypeError 类型检查错误，Pos 为表达式中出错的位置
+type TypeError struct {
+	Pos token.Position
+	Msg string
+	Err error // ErrKeyNotFound、ErrNotNumber、ErrNotBool 等，可用 errors.Is 判断
+}
+
+func (e *TypeError) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// checker 按 schema 推导表达式的类型
+type checker struct {
+	fset   *token.FileSet
+	schema Schema
+	env    *Env
+	scopes []scope // any、all 的元素作用域
+}
+
+func (c *checker) errorf(node ast.Node, err error, format string, args ...interface{}) error {
+	return &TypeError{Pos: c.fset.Position(node.Pos()), Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+func (c *checker) expect(node ast.Expr, t *Type, k Kind) error {
+	if t.is(k) {
+		return nil
+	}
+	return c.errorf(node, kindError(k), "%s is %s, expected %s", types.ExprString(node), t, k)
+}
+
+func (c *checker) check(expr ast.Expr) (*Type, error) {
+	switch t := expr.(type) {
+	case *ast.UnaryExpr: // 一元表达式
+		x, err := c.check(t.X)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Op {
+		case token.NOT:
+			return BoolType, c.expect(t.X, x, Bool)
+		case token.SUB:
+			return NumberType, c.expect(t.X, x, Number)
+		}
+		return nil, c.errorf(t, ErrUnsupportToken, "unsupported operator %s", t.Op)
+	case *ast.BinaryExpr: // 二元表达式
+		x, err := c.check(t.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := c.check(t.Y)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+			if t.Op == token.ADD && bothStrings(x, y) {
+				// 字符串连接
+				return StringType, nil
+			}
+			if err = c.expect(t.X, x, Number); err == nil {
+				err = c.expect(t.Y, y, Number)
+			}
+			return NumberType, err
+		case token.LSS, token.GTR, token.LEQ, token.GEQ:
+			if bothStrings(x, y) {
+				return BoolType, nil
+			}
+			if err = c.expect(t.X, x, Number); err == nil {
+				err = c.expect(t.Y, y, Number)
+			}
+			return BoolType, err
+		case token.EQL, token.NEQ:
+			if x.Kind != Any && y.Kind != Any && !x.is(y.Kind) && !y.is(x.Kind) {
+				return nil, c.errorf(t, ErrUnsupportParam, "mismatched types %s and %s in %s", x, y, types.ExprString(t))
+			}
+			return BoolType, nil
+		case token.LAND, token.LOR:
+			if err = c.expect(t.X, x, Bool); err == nil {
+				err = c.expect(t.Y, y, Bool)
+			}
+			return BoolType, err
+		}
+		return nil, c.errorf(t, ErrUnsupportToken, "unsupported operator %s", t.Op)
+	case *ast.Ident: // 标志符
+		if t.Name == "true" || t.Name == "false" {
+			return BoolType, nil
+		}
+		if t.Name == "nil" {
+			return AnyType, nil
+		}
+		if typ, ok := c.lookup(t.Name); ok {
+			return typ, nil
+		}
+		if typ, ok := c.schema[t.Name]; ok {
+			if typ == nil {
+				return AnyType, nil
+			}
+			return typ, nil
+		}
+		return nil, c.errorf(t, ErrKeyNotFound, "unknown identifier %s", t.Name)
+	case *ast.BasicLit: // 基本类型文字
+		switch t.Kind {
+		case token.STRING:
+			return StringType, nil
+		case token.INT, token.FLOAT:
+			return NumberType, nil
+		}
+		return nil, c.errorf(t, ErrUnsupportParam, "unsupported literal %s", t.Value)
+	case *ast.ParenExpr: // 圆括号内表达式
+		return c.check(t.X)
+	case *ast.SelectorExpr: // 属性选择表达式
+		x, err := c.check(t.X)
+		if err != nil {
+			return nil, err
+		}
+		return c.field(t.Sel, x, t.Sel.Name)
+	case *ast.IndexExpr: // map或slice索引
+		x, err := c.check(t.X)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := c.check(t.Index)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case x.Kind == Map:
+			if err = c.expect(t.Index, idx, String); err != nil {
+				return nil, err
+			}
+			if lit, ok := t.Index.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				name, _ := literal(lit)
+				return c.field(t.Index, x, name.(string))
+			}
+			if len(x.Fields) > 0 {
+				return AnyType, nil
+			}
+			return x.elem(), nil
+		case x.Kind == Slice:
+			if !idx.is(Number) {
+				return nil, c.errorf(t.Index, ErrIndexNotNumber, "index %s is %s, expected number", types.ExprString(t.Index), idx)
+			}
+			return x.elem(), nil
+		case x.Kind == Any:
+			return AnyType, nil
+		}
+		return nil, c.errorf(t.X, ErrUnsupportParam, "%s is %s, can not be indexed", types.ExprString(t.X), x)
+	case *ast.CallExpr: // 方法调用表达式
+		ident, ok := t.Fun.(*ast.Ident)
+		if !ok {
+			return nil, c.errorf(t.Fun, ErrUnsupportExpr, "%s is not a function name", types.ExprString(t.Fun))
+		}
+		if builtins[ident.Name] {
+			return c.checkBuiltin(t, ident.Name)
+		}
+		f, ok := c.env.Lookup(ident.Name)
+		if !ok {
+			return nil, c.errorf(ident, ErrFuncNotFound, "unknown function %s", ident.Name)
+		}
+		if err := f.arity(len(t.Args)); err != nil {
+			return nil, c.errorf(t, ErrUnsupportParam, "%s %v", ident.Name, err)
+		}
+		for i, arg := range t.Args {
+			typ, err := c.check(arg)
+			if err != nil {
+				return nil, err
+			}
+			if err = c.expect(arg, typ, f.param(i).Kind); err != nil {
+				return nil, err
+			}
+		}
+		if f.Result == nil {
+			return AnyType, nil
+		}
+		return f.Result, nil
+	}
+	return nil, c.errorf(expr, ErrUnsupportExpr, "unsupported expression %s", types.ExprString(expr))
+}
+
+// bothStrings 判断 x、y 是否都可能为字符串且至少一个确定为字符串
+func bothStrings(x, y *Type) bool {
+	return x.is(String) && y.is(String) && (x.Kind == String || y.Kind == String)
+}
+
+// field 返回 map 类型 x 的字段 name 的类型
+func (c *checker) field(node ast.Node, x *Type, name string) (*Type, error) {
+	switch {
+	case x.Kind == Any:
+		return AnyType, nil
+	case x.Kind != Map:
+		return nil, c.errorf(node, ErrUnsupportParam, "%s is not a map, has no field %s", x, name)
+	case len(x.Fields) == 0:
+		return x.elem(), nil
+	}
+	if f, ok := x.Fields[name]; ok {
+		if f == nil {
+			return AnyType, nil
+		}
+		return f, nil
+	}
+	return nil, c.errorf(node, ErrKeyNotFound, "unknown field %s", name)
+}
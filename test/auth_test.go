@@ -0,0 +1,118 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+func TestOAuth2(t *testing.T) {
+	var fetches int32
+	tokens := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if id != "client" || secret != "s3cret" || r.PostForm.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&fetches, 1)
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"t%d","token_type":"bearer","expires_in":3600}`, n)
+	}))
+	defer tokens.Close()
+
+	api := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		// the first token is rejected to force a refresh
+		if auth := r.Header.Get("Authorization"); auth != "Bearer t2" {
+			w.WriteHeader(nethttp.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer api.Close()
+
+	auth := &http.OAuth2{TokenURL: tokens.URL, ClientID: "client", ClientSecret: "s3cret"}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.HttpPost(api.URL).SetAuth(auth).Body("ping").ExpectStatus().String()
+			if err != nil || res != "ping" {
+				t.Errorf("request: %q %v", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("expected 2 token fetches, got %d", n)
+	}
+}
+
+func TestOAuth2DefaultAuth(t *testing.T) {
+	tokens := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.Header.Get("Authorization") != "Basic Y2xpZW50OnMzY3JldA==" {
+			w.WriteHeader(nethttp.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token":"t1","expires_in":3600}`))
+	}))
+	defer tokens.Close()
+	api := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer api.Close()
+
+	// the token request must not be authorized by the OAuth2 set as the default Auth
+	auth := &http.OAuth2{TokenURL: tokens.URL, ClientID: "client", ClientSecret: "s3cret"}
+	http.SetDefaultSetting(http.HTTPSettings{UserAgent: "Server", ConnectTimeout: time.Second, ReadWriteTimeout: time.Second, Auth: auth})
+	defer http.SetDefaultSetting(http.HTTPSettings{
+		UserAgent:        "Server",
+		ConnectTimeout:   60 * time.Second,
+		ReadWriteTimeout: 60 * time.Second,
+		Gzip:             true,
+		DumpBody:         true,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := http.HttpGet(api.URL).ExpectStatus().String()
+		if err != nil || res != "Bearer t1" {
+			t.Errorf("request: %q %v", res, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("token request deadlocked on the default Auth")
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer := &http.HMACSigner{KeyID: "key1", Secret: []byte("secret"), SignedHeaders: []string{"Host", "Content-Type"}}
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		auth := r.Header.Get("Authorization")
+		if !strings.HasSuffix(auth, "Signature="+signer.Signature(r, body)) ||
+			!strings.Contains(auth, "SignedHeaders=x-date;content-type;host") {
+			w.WriteHeader(nethttp.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	req, _ := http.HttpPost(srv.URL + "/v1/x?a=1").SetAuth(signer).JSONBody(map[string]int{"a": 1})
+	if res, err := req.ExpectStatus().String(); err != nil || res != "ok" {
+		t.Fatalf("signed request: %q %v", res, err)
+	}
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+func TestServiceBalancer(t *testing.T) {
+	var urls []string
+	var failing atomic.Bool
+	failing.Store(true)
+	for i := 0; i < 3; i++ {
+		i := i
+		srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			if r.URL.Path == "/host" {
+				fmt.Fprint(w, r.Host)
+				return
+			}
+			if i == 2 && failing.Load() {
+				w.WriteHeader(nethttp.StatusBadGateway)
+			}
+			fmt.Fprintf(w, "%d%s", i, r.URL.RequestURI())
+		}))
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+
+	svc, err := http.RegisterService("users", urls, http.ServiceOptions{MaxFails: 2, EjectTime: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer http.RemoveService("users")
+
+	seen := map[string]int{}
+	for i := 0; i < 9; i++ {
+		res, err := http.HttpGet("svc://users/v1/me").Param("a", "1").String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[res]++
+	}
+	if seen["0/v1/me?a=1"] == 0 || seen["1/v1/me?a=1"] == 0 {
+		t.Fatalf("round robin: %v", seen)
+	}
+	if seen["2/v1/me?a=1"] != 2 || len(svc.Endpoints()) != 2 {
+		t.Fatalf("failing endpoint not ejected: %v %v", seen, svc.Endpoints())
+	}
+
+	failing.Store(false)
+	if _, err = http.RegisterService("users", urls, http.ServiceOptions{Strategy: http.ConsistentHash}); err != nil {
+		t.Fatal(err)
+	}
+	hits := map[string]bool{}
+	// the ring depends on the random ports, enough keys reach more than one endpoint
+	for k := 0; k < 50; k++ {
+		key := fmt.Sprintf("user-%d", k)
+		first, err := http.HttpGet("svc://users/x").SetHashKey(key).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits[first] = true
+		for i := 0; i < 5; i++ {
+			if res, _ := http.HttpGet("svc://users/x").SetHashKey(key).String(); res != first {
+				t.Fatalf("consistent hash of %s moved from %q to %q", key, first, res)
+			}
+		}
+	}
+	if len(hits) < 2 {
+		t.Fatalf("consistent hash used a single endpoint: %v", hits)
+	}
+
+	// SetHost is kept when the endpoint replaces the url
+	if res, err := http.HttpGet("svc://users/host").SetHost("api.example.com").String(); err != nil || res != "api.example.com" {
+		t.Fatalf("host override: %q %v", res, err)
+	}
+
+	if _, err = http.HttpGet("svc://unknown/x").String(); !errors.Is(err, http.ErrServiceNotFound) {
+		t.Fatalf("expected ErrServiceNotFound, got %v", err)
+	}
+}
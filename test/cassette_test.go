@@ -0,0 +1,87 @@
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/carmel/go-util/http"
+	"github.com/carmel/go-util/http/cassette"
+)
+
+func TestCassette(t *testing.T) {
+	for _, name := range []string{"api.yml", "api.json"} {
+		t.Run(name, func(t *testing.T) {
+			testCassette(t, filepath.Join(t.TempDir(), name))
+		})
+	}
+}
+
+func testCassette(t *testing.T, path string) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Echo", r.URL.Query().Get("q"))
+		w.Write(append([]byte("echo:"), body...))
+	}))
+
+	rec, err := cassette.New(path, cassette.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.SetMatchers(cassette.MatchMethod, cassette.MatchURL, cassette.MatchBodyHash)
+	res, err := http.HttpPost(srv.URL+"/?q=1").
+		SetTransport(rec).
+		Header("Authorization", "Bearer secret").
+		Body("hello").
+		String()
+	if err != nil || res != "echo:hello" {
+		t.Fatalf("record: %q %v", res, err)
+	}
+	// the caller's request keeps its body
+	req, _ := nethttp.NewRequest("POST", srv.URL+"/raw", strings.NewReader("raw"))
+	reqBody := req.Body
+	resp, err := rec.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "echo:raw" || req.Body != reqBody {
+		t.Fatalf("raw round trip: %q, body replaced %v", body, req.Body != reqBody)
+	}
+	if n := len(rec.Cassette().Interactions); n != 2 {
+		t.Fatalf("recorded %d interactions", n)
+	}
+	if err = rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "secret") {
+		t.Fatalf("authorization header was not redacted:\n%s", data)
+	}
+
+	rec, err = cassette.New(path, cassette.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.SetMatchers(cassette.MatchMethod, cassette.MatchURL, cassette.MatchBodyHash)
+	resp, err = http.HttpPost(srv.URL + "/?q=1").SetTransport(rec).Body("hello").Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != "echo:hello" || resp.Header.Get("X-Echo") != "1" {
+		t.Fatalf("replay: %q %v", body, resp.Header)
+	}
+
+	_, err = http.HttpPost(srv.URL + "/?q=1").SetTransport(rec).Body("other").String()
+	var notFound *cassette.ErrInteractionNotFound
+	if !errors.As(err, &notFound) {
+		t.Fatalf("expected ErrInteractionNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/carmel/go-util/http"
+)
+
+func TestToCurl(t *testing.T) {
+	req := http.HttpPost("https://example.com/api?x=1").
+		Header("Content-Type", "application/json").
+		SetBasicAuth("bob", "pa ss").
+		SetCookie(&nethttp.Cookie{Name: "sid", Value: "abc"}).
+		SetUserAgent("tester").
+		SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
+		SetProxy(func(*nethttp.Request) (*url.URL, error) { return url.Parse("http://127.0.0.1:8118") }).
+		Body(`{"msg":"it's"}`)
+	cmd, err := req.ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `curl -u 'bob:pa ss' -A tester -b sid=abc -H 'Content-Type: application/json' ` +
+		`--data-binary '{"msg":"it'\''s"}' -k -x http://127.0.0.1:8118 'https://example.com/api?x=1'`
+	if cmd != want {
+		t.Fatalf("got  %s\nwant %s", cmd, want)
+	}
+
+	// ToCurl leaves the request as it was
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.URL.RequestURI() + "|" + string(body)))
+	}))
+	defer srv.Close()
+	get := http.HttpGet(srv.URL+"/q").Param("a", "1")
+	if cmd, _ = get.ToCurl(); !strings.HasSuffix(cmd, "/q?a=1'") {
+		t.Fatalf("got %s", cmd)
+	}
+	if res, err := get.Param("b", "2").String(); err != nil || (res != "/q?a=1&b=2|" && res != "/q?b=2&a=1|") {
+		t.Fatalf("after ToCurl: %q %v", res, err)
+	}
+	post := http.HttpPost(srv.URL + "/p")
+	post.GetRequest().Body = ioutil.NopCloser(strings.NewReader("once"))
+	post.ToCurl()
+	if res, err := post.String(); err != nil || res != "/p|once" {
+		t.Fatalf("body after ToCurl: %q %v", res, err)
+	}
+
+	cmd, _ = http.HttpPut("http://example.com/").Body("a\x01\nb").ToCurl()
+	if !strings.Contains(cmd, `-X PUT`) || !strings.Contains(cmd, `--data-binary $'a\x01\nb'`) {
+		t.Fatalf("got %s", cmd)
+	}
+	// a service url is replaced by the endpoint picked for it
+	if _, err = http.RegisterService("curl", []string{"http://10.0.0.1:8080/base", "http://10.0.0.2:8080"}, http.ServiceOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer http.RemoveService("curl")
+	var hosts []string
+	for i := 0; i < 2; i++ {
+		cmd, err = http.HttpGet("svc://curl/v1/me").Param("a", "1").ToCurl()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, cmd[strings.LastIndexByte(cmd, ' ')+1:])
+	}
+	if strings.Join(hosts, " ") != "'http://10.0.0.1:8080/base/v1/me?a=1' 'http://10.0.0.2:8080/v1/me?a=1'" {
+		t.Fatalf("service urls: %v", hosts)
+	}
+	if _, err = http.HttpGet("svc://missing/x").ToCurl(); !errors.Is(err, http.ErrServiceNotFound) {
+		t.Fatalf("missing service: %v", err)
+	}
+}
+
+func TestFromCurl(t *testing.T) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		user, pass, _ := r.BasicAuth()
+		c, _ := r.Cookie("sid")
+		if c == nil {
+			c = &nethttp.Cookie{}
+		}
+		w.Write([]byte(strings.Join([]string{r.Method, r.URL.RequestURI(), r.Header.Get("X-Id"),
+			r.UserAgent(), user + ":" + pass, c.Value, r.Header.Get("Content-Type"), string(body)}, "|")))
+	}))
+	defer srv.Close()
+
+	cases := []struct{ cmd, want string }{
+		{`curl -sSL -XPUT "` + srv.URL + `/a?b=1" \
+			-H 'X-Id: 7' --user-agent=x/1 -u me:pw -b 'sid=s1' --data-raw $'line\none' --compressed`,
+			"PUT|/a?b=1|7|x/1|me:pw|s1|application/x-www-form-urlencoded|line\none"},
+		{`curl ` + srv.URL + ` -d a=1 --data-urlencode 'q=x y' -H "Content-Type: text/plain"`,
+			"POST|/||Server|:||text/plain|a=1&q=x+y"},
+		{`curl -G ` + srv.URL + `/s -d k=v -A agent`,
+			"GET|/s?k=v||agent|:|||"},
+	}
+	for _, c := range cases {
+		req, err := http.FromCurl(c.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.String()
+		if err != nil || res != c.want {
+			t.Fatalf("%s\ngot  %q %v\nwant %q", c.cmd, res, err, c.want)
+		}
+	}
+
+	// a request survives the round trip through curl
+	cmd, _ := http.HttpPost(srv.URL+"/r").Header("X-Id", "9").SetBasicAuth("u", "p").Body("it's \"quoted\"").ToCurl()
+	req, err := http.FromCurl(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := req.String(); res != `POST|/r|9|Server|u:p||application/x-www-form-urlencoded|it's "quoted"` {
+		t.Fatalf("round trip %s: %q", cmd, res)
+	}
+
+	for _, cmd := range []string{"curl -o out " + srv.URL, "curl 'unterminated", "curl -H"} {
+		if _, err := http.FromCurl(cmd); err == nil {
+			t.Fatalf("%s: expected an error", cmd)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package util
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/carmel/go-util/rule/dtable"
+	"github.com/shopspring/decimal"
+)
+
+func TestDecisionTable(t *testing.T) {
+	const pricing = `# 折扣表
+tier,           order.amount, @priority, out:discount, out:note
+"gold, silver", [1000..],     10,        0.15,         vip
+gold,           [100..1000),  5,         0.1,
+-,              [100..1000),  0,         0.05,         = "order " + order.id
+"not(gold)",    [0..100),     0,         0,
+-,              >= 1000,      1,         0.08,
+`
+	order := func(tier string, amount int64) map[string]interface{} {
+		return map[string]interface{}{"tier": tier, "order": map[string]interface{}{"id": "A1", "amount": amount}}
+	}
+
+	first, err := dtable.Parse(strings.NewReader(pricing), dtable.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := first.Rows()[0].Expr; got != `(tier == "gold" || tier == "silver") && order.amount >= 1000` {
+		t.Fatalf("expr %s", got)
+	}
+	cases := []struct {
+		policy   *dtable.Table
+		data     map[string]interface{}
+		discount interface{}
+		note     interface{}
+	}{
+		{first, order("gold", 2000), decimal.RequireFromString("0.15"), "vip"},
+		{first, order("gold", 500), decimal.RequireFromString("0.1"), nil},
+		{first, order("bronze", 500), decimal.RequireFromString("0.05"), "order A1"},
+		{first, order("bronze", 50), int64(0), nil},
+		{first, order("bronze", 5000), decimal.RequireFromString("0.08"), nil},
+	}
+	for i, c := range cases {
+		out, ok, err := c.policy.Lookup(c.data)
+		if err != nil || !ok {
+			t.Fatalf("case %d: %v %v", i, ok, err)
+		}
+		if d, isDec := c.discount.(decimal.Decimal); isDec && !d.Equal(out["discount"].(decimal.Decimal)) || !isDec && out["discount"] != c.discount {
+			t.Fatalf("case %d: discount %v", i, out["discount"])
+		}
+		if out["note"] != c.note {
+			t.Fatalf("case %d: note %v", i, out["note"])
+		}
+	}
+	// gold 在 [0..100) 中没有匹配的行
+	if _, ok, err := first.Lookup(order("gold", 50)); ok || err != nil {
+		t.Fatalf("gold 50: %v %v", ok, err)
+	}
+
+	// FIRST 中重叠的行只作为问题报告
+	var overlaps int
+	for _, issue := range first.Issues() {
+		if issue.Kind == "overlap" {
+			overlaps++
+		}
+	}
+	if overlaps != 2 {
+		t.Fatalf("issues %v", first.Issues())
+	}
+
+	collect, err := dtable.Parse(strings.NewReader(pricing), dtable.Options{HitPolicy: dtable.Collect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms, err := collect.Eval(order("gold", 500)); err != nil || len(ms) != 2 || ms[0].Line != 4 || ms[1].Line != 5 {
+		t.Fatalf("collect %+v %v", ms, err)
+	}
+
+	prio, err := dtable.Parse(strings.NewReader(pricing), dtable.Options{HitPolicy: "priority"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err := prio.Lookup(order("silver", 3000)); err != nil || out["note"] != "vip" {
+		t.Fatalf("priority %v %v", out, err)
+	}
+
+	if _, err := dtable.Parse(strings.NewReader(pricing), dtable.Options{HitPolicy: dtable.Unique}); !errors.Is(err, dtable.ErrOverlap) {
+		t.Fatalf("unique: %v", err)
+	}
+	unique, err := dtable.Parse(strings.NewReader(`age,out:band
+[..18),minor
+[18..65),adult
+[65..],senior
+`), dtable.Options{HitPolicy: dtable.Unique, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err := unique.Lookup(map[string]interface{}{"age": 18}); err != nil || out["band"] != "adult" {
+		t.Fatalf("unique %v %v", out, err)
+	}
+
+	// 按 region 索引
+	tax, err := dtable.Parse(strings.NewReader("region,out:tax\n\"us, ca\",0.1\neu,0.2\n-,0\n"), dtable.Options{HitPolicy: dtable.Collect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for region, lines := range map[string][]int{"eu": {3, 4}, "ca": {2, 4}, "jp": {4}} {
+		ms, err := tax.Eval(map[string]interface{}{"region": region})
+		if err != nil || len(ms) != len(lines) {
+			t.Fatalf("%s: %+v %v", region, ms, err)
+		}
+		for i, m := range ms {
+			if m.Line != lines[i] {
+				t.Fatalf("%s: %+v", region, ms)
+			}
+		}
+	}
+	if ms, err := tax.Eval(map[string]interface{}{}); err != nil || len(ms) != 1 || ms[0].Outputs["tax"] != int64(0) {
+		t.Fatalf("no region: %+v %v", ms, err)
+	}
+
+	// 未覆盖的区间和没有输出的行
+	gappy, err := dtable.Parse(strings.NewReader(`score,out:grade
+[0..60),F
+(60..90),B
+> 90,A
+3,
+`), dtable.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issues []string
+	for _, issue := range gappy.Issues() {
+		issues = append(issues, issue.String())
+	}
+	want := []string{
+		"incomplete at line 5: row has no output",
+		"overlap at line 2, 5: rows can match the same input",
+		"gap column score: not covered (..0), [60..60], [90..90]",
+	}
+	if strings.Join(issues, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("issues:\n%s", strings.Join(issues, "\n"))
+	}
+	// 没有下界的范围也扩展已覆盖的上界
+	open, err := dtable.Parse(strings.NewReader("score,out:grade\n< 10,F\n< 20,C\n>= 20,A\n"), dtable.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range open.Issues() {
+		if issue.Kind == "gap" {
+			t.Fatalf("false gap: %s", issue)
+		}
+	}
+	if _, err := dtable.Parse(strings.NewReader("score,out:grade\n[0..60),F\n(60..90),B\n"), dtable.Options{Strict: true}); !errors.Is(err, dtable.ErrIssues) {
+		t.Fatalf("strict: %v", err)
+	}
+
+	for _, src := range []string{
+		"a,out:x\n[1..0],y\n", // 空区间
+		"a,out:x\n> gold,y\n", // 比较需要数值
+		"a,b\n1,2\n",          // 没有输出列
+		"a,out:x\n1,y,z\n",    // 列数不一致
+		"a +,out:x\n1,y\n",    // 列名不是表达式
+		"a,out:x\n1,= b +\n",  // 输出表达式错误
+		"a,@priority,out:x\n1,high,y\n",
+	} {
+		if _, err := dtable.Parse(strings.NewReader(src), dtable.Options{}); err == nil {
+			t.Fatalf("%q: expected error", src)
+		}
+	}
+	if _, err := dtable.Parse(strings.NewReader(pricing), dtable.Options{HitPolicy: "ANY"}); err == nil {
+		t.Fatal("unknown hit policy")
+	}
+}
@@ -1,14 +1,17 @@
 package util
 
 import (
+	"errors"
 	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/carmel/go-util/http"
 )
 
 func TestHttp(t *testing.T) {
-	res := http.HttpJsonPost(
+	res, err := http.HttpJsonPost(
 		"http://jwxt.shufe-zj.edu.cn/jwglxt/jxdmgl/jsjxdm_cxJxbxxByJxbid.html?gnmkdm=N254350&su=021560",
 		"{jxb_id: 38626,rq: '2020-05-29'}",
 		map[string]string{
@@ -16,5 +19,56 @@ func TestHttp(t *testing.T) {
 			"Origin": "http://jwxt.shufe-zj.edu.cn",
 		},
 	)
-	fmt.Println(string(res))
+	fmt.Println(string(res), err)
+}
+
+func TestHTTPError(t *testing.T) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/ok" {
+			w.Write([]byte(`{"name":"ok"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusInternalServerError)
+		w.Write([]byte(`{"code":42,"message":"boom"}`))
+	}))
+	defer srv.Close()
+
+	// without expectation the error page is a plain body
+	if _, err := http.HttpGet(srv.URL + "/fail").String(); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	var out map[string]interface{}
+	err := http.HttpGet(srv.URL + "/fail").ExpectStatus().ErrorResult(&payload).ToJSON(&out)
+	var he *http.HTTPError
+	if !errors.As(err, &he) {
+		t.Fatalf("expected *HTTPError, got %v", err)
+	}
+	if he.StatusCode != 500 || he.Method != "GET" || he.URL != srv.URL+"/fail" {
+		t.Fatalf("unexpected error fields: %+v", he)
+	}
+	if payload.Code != 42 || payload.Message != "boom" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+	var again struct{ Code int }
+	if err = he.JSON(&again); err != nil || again.Code != 42 {
+		t.Fatalf("decode error payload: %v %+v", err, again)
+	}
+
+	if err = http.HttpGet(srv.URL + "/ok").ExpectStatus(200).ToJSON(&out); err != nil || out["name"] != "ok" {
+		t.Fatalf("unexpected result: %v %v", err, out)
+	}
+
+	if _, err = http.HttpJsonPost(srv.URL+"/fail", "{}", nil); !errors.As(err, &he) {
+		t.Fatalf("expected *HTTPError, got %v", err)
+	}
+	code, body, err := http.HttpPostJson(srv.URL+"/fail", "{}")
+	if err != nil || code != 500 || len(body) == 0 {
+		t.Fatalf("unexpected result: %d %s %v", code, body, err)
+	}
 }
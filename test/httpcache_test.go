@@ -0,0 +1,124 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/cache"
+	"github.com/carmel/go-util/http"
+	"github.com/carmel/go-util/http/httpcache"
+)
+
+func TestHTTPCache(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(nethttp.StatusNotModified)
+				return
+			}
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			fmt.Fprintf(w, "%s ", r.Header.Get("Accept-Language"))
+		case "/stale":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/strict":
+			w.Header().Set("Cache-Control", "max-age=60, must-revalidate")
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	}))
+	defer srv.Close()
+
+	storages := map[string]httpcache.Storage{
+		"memory": httpcache.NewMemoryStorage(cache.New(time.Hour, time.Hour)),
+		"disk":   httpcache.NewDiskStorage(t.TempDir()),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			tr := httpcache.NewTransport(storage)
+			var elapsed time.Duration
+			tr.Now = func() time.Time { return time.Now().Add(elapsed) }
+			get := func(path string, header ...string) (string, httpcache.Status) {
+				req := http.HttpGet(srv.URL + path).SetTransport(tr)
+				for i := 0; i+1 < len(header); i += 2 {
+					req.Header(header[i], header[i+1])
+				}
+				resp, err := req.Response()
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(body), httpcache.CacheStatus(resp)
+			}
+
+			if b, s := get("/fresh"); b != "/fresh 1" || s != httpcache.Miss {
+				t.Fatalf("first: %q %s", b, s)
+			}
+			if b, s := get("/fresh"); b != "/fresh 1" || s != httpcache.Hit {
+				t.Fatalf("second: %q %s", b, s)
+			}
+			if b, s := get("/etag"); b != "/etag 2" || s != httpcache.Miss {
+				t.Fatalf("etag first: %q %s", b, s)
+			}
+			if b, s := get("/etag"); b != "/etag 2" || s != httpcache.Revalidated {
+				t.Fatalf("etag second: %q %s", b, s)
+			}
+			get("/nostore")
+			if b, s := get("/nostore"); b != "/nostore 5" || s != httpcache.Miss {
+				t.Fatalf("no-store: %q %s", b, s)
+			}
+
+			// one response per Accept-Language
+			for _, c := range []struct {
+				lang, body string
+				status     httpcache.Status
+			}{
+				{"en", "en /vary 6", httpcache.Miss},
+				{"fr", "fr /vary 7", httpcache.Miss},
+				{"en", "en /vary 6", httpcache.Hit},
+				{"fr", "fr /vary 7", httpcache.Hit},
+			} {
+				if b, s := get("/vary", "Accept-Language", c.lang); b != c.body || s != c.status {
+					t.Fatalf("vary %s: %q %s", c.lang, b, s)
+				}
+			}
+
+			// max-stale accepts a stale response unless it must be revalidated
+			get("/stale")
+			get("/strict")
+			elapsed = 90 * time.Second
+			if _, s := get("/stale"); s != httpcache.Miss {
+				t.Fatalf("stale: %s", s)
+			}
+			elapsed = 180 * time.Second
+			if _, s := get("/stale", "Cache-Control", "max-stale=60"); s != httpcache.Hit {
+				t.Fatalf("max-stale: %s", s)
+			}
+			if _, s := get("/stale", "Cache-Control", "max-stale=10"); s != httpcache.Miss {
+				t.Fatalf("max-stale exceeded: %s", s)
+			}
+			if _, s := get("/strict", "Cache-Control", "max-stale"); s != httpcache.Miss {
+				t.Fatalf("must-revalidate: %s", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http/mock"
+)
+
+func TestMockServer(t *testing.T) {
+	s := mock.NewServer(t)
+	s.Expect("POST", "/v1/x").
+		WithJSON(map[string]interface{}{"name": "a"}).
+		Reply(201).JSON(map[string]string{"id": "1"}).
+		Times(2)
+	s.Expect("GET", "/flaky").Reset()
+	s.Expect("GET", "/flaky").Body("ok")
+	s.Expect("GET", "/slow").Delay(300 * time.Millisecond).AnyTimes()
+	s.Expect("GET", "/zip").Body("compressed body").Gzip().Chunked(4)
+
+	for i := 0; i < 2; i++ {
+		req, _ := s.NewRequest("/v1/x", "POST").ExpectStatus(201).JSONBody(map[string]interface{}{"name": "a", "extra": true})
+		var out map[string]string
+		if err := req.ToJSON(&out); err != nil || out["id"] != "1" {
+			t.Fatalf("call %d: %v %v", i, err, out)
+		}
+	}
+
+	res, err := s.NewRequest("/flaky", "GET").Retries(1).String()
+	if err != nil || res != "ok" {
+		t.Fatalf("retry: %q %v", res, err)
+	}
+
+	if _, err = s.NewRequest("/slow", "GET").SetTimeout(time.Second, 100*time.Millisecond).String(); err == nil {
+		t.Fatal("expected a timeout")
+	}
+
+	if res, err = s.NewRequest("/zip", "GET").String(); err != nil || res != "compressed body" {
+		t.Fatalf("gzip: %q %v", res, err)
+	}
+
+	if !s.Verify() {
+		t.Fatal("expectations not met")
+	}
+}
+
+type errorsT struct{ errors []string }
+
+func (t *errorsT) Helper() {}
+
+func (t *errorsT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMockResetNotHijacked(t *testing.T) {
+	et := &errorsT{}
+	s := mock.NewServer(et)
+	defer s.Close()
+	s.Expect("GET", "/reset").Reset()
+
+	// a ResponseRecorder can not be hijacked, the failure is reported instead of a panic
+	s.Config.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/reset", nil))
+	if len(et.errors) != 1 {
+		t.Fatalf("errors: %v", et.errors)
+	}
+}
@@ -1,10 +1,20 @@
 package util
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/carmel/go-util/rule"
+	"github.com/shopspring/decimal"
 )
 
 func TestFn(t *testing.T) {
@@ -14,3 +24,1045 @@ func TestFn(t *testing.T) {
 		"a": "123",
 	}))
 }
+
+func TestRuleCompiled(t *testing.T) {
+	r := &rule.Rule{}
+	if err := r.SetExpr(`a > 10 && (b <= 2.5 || !c) && name == name`); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := int64(0); n < 100; n++ {
+				ok, err := r.Bool(map[string]interface{}{"a": n, "b": 1.5, "c": true, "name": int64(i)})
+				if err != nil || ok != (n > 10) {
+					t.Errorf("a=%d: %v %v", n, ok, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 调用注册函数的规则也可以并发求值，出错的求值不影响其他求值
+	env := rule.NewEnv()
+	env.Register("half", &rule.Func{Params: []*rule.Type{rule.NumberType}, Call: func(args []interface{}) (interface{}, error) {
+		n := args[0].(int64)
+		if n%2 != 0 {
+			return nil, fmt.Errorf("odd %d", n)
+		}
+		return n / 2, nil
+	}})
+	fr := &rule.Rule{}
+	fr.SetEnv(env)
+	if err := fr.SetExpr(`half(a) > 10`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := int64(0); n < 200; n++ {
+				ok, err := fr.Bool(map[string]interface{}{"a": n})
+				if (err != nil) != (n%2 != 0) || err == nil && ok != (n > 21) {
+					t.Errorf("a=%d: %v %v", n, ok, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data := map[string]interface{}{"a": int64(20), "b": 3.0, "c": false, "name": int64(1)}
+	allocs := testing.AllocsPerRun(100, func() {
+		if ok, _ := r.Bool(data); !ok {
+			t.Fatal("expected true")
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per evaluation", allocs)
+	}
+
+	for _, expr := range []string{`missing(a)`, `a & b`, `'c' == a`, `func() {}`} {
+		if err := (&rule.Rule{}).SetExpr(expr); err == nil {
+			t.Fatalf("%s: expected a compile error", expr)
+		}
+	}
+	if err := r.SetExpr(`s == "a\"b"`); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Bool(map[string]interface{}{"s": "x"}); ok || err != nil {
+		t.Fatalf("string comparison: %v %v", ok, err)
+	}
+}
+
+func TestRuleSchema(t *testing.T) {
+	schema := rule.Schema{
+		"age":  rule.NumberType,
+		"name": rule.StringType,
+		"vip":  rule.BoolType,
+		"user": rule.MapOf(map[string]*rule.Type{
+			"score": rule.NumberType,
+			"tags":  rule.SliceOf(rule.StringType),
+		}),
+		"prices": rule.SliceOf(rule.NumberType),
+		"extra":  nil,
+	}
+	r := &rule.Rule{}
+	r.SetSchema(schema)
+	for expr, want := range map[string]*rule.Type{
+		`age > 18 && vip`:              rule.BoolType,
+		`user.score * 2`:               rule.NumberType,
+		`user["tags"][0]`:              rule.StringType,
+		`prices[1] - -age`:             rule.NumberType,
+		`extra.a.b`:                    rule.AnyType,
+		`(user.score + prices[0]) / 2`: rule.NumberType,
+		`contains(user.tags, name)`:    rule.BoolType, // 参数类型为 nil 时接受任何值
+	} {
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if got := r.ResultType(); got.String() != want.String() {
+			t.Fatalf("%s: result %s, want %s", expr, got, want)
+		}
+	}
+
+	cases := []struct {
+		expr, pos string
+		err       error
+	}{
+		{`age > 18 && nme == 1`, "1:13", rule.ErrKeyNotFound},
+		{`user.scor > 1`, "1:6", rule.ErrKeyNotFound},
+		{`age + name`, "1:7", rule.ErrNotNumber},
+		{"vip &&\n  age", "2:3", rule.ErrNotBool},
+		{`prices["a"]`, "1:8", rule.ErrIndexNotNumber},
+		{`age > 1 && nope(age)`, "1:12", rule.ErrFuncNotFound},
+	}
+	for _, c := range cases {
+		err := r.SetExpr(c.expr)
+		var te *rule.TypeError
+		if !errors.As(err, &te) || !errors.Is(err, c.err) || te.Pos.String() != c.pos {
+			t.Fatalf("%q: got %v, want %v at %s", c.expr, err, c.err, c.pos)
+		}
+	}
+}
+
+func TestRuleEnv(t *testing.T) {
+	env := rule.NewEnv()
+	env.Now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	err := env.Register("discount", &rule.Func{
+		Params: []*rule.Type{rule.NumberType, rule.StringType},
+		Result: rule.NumberType,
+		Call: func(args []interface{}) (interface{}, error) {
+			if args[1] == "gold" {
+				return 0.2, nil
+			}
+			return 0.0, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]interface{}{
+		"name":    "Alice Smith",
+		"email":   "alice@example.com",
+		"tags":    []interface{}{"a", int64(2)},
+		"level":   "gold",
+		"amount":  int64(-120),
+		"created": "2024-02-20",
+	}
+	cases := map[string]interface{}{
+		`contains(name, "Smith") && startsWith(name, "Al") && endsWith(email, ".com")`: true,
+		`matches(email, "^[a-z]+@[a-z]+\\.com$")`:                                      true,
+		`len(name) == 11 && len(tags) == 2`:                                            true,
+		`in(level, "silver", "gold")`:                                                  true,
+		`in(2, tags) && contains(tags, "a")`:                                           true,
+		`max(1, abs(amount), 3) == 120 && min(4, 2.5) == 2.5`:                          true,
+		`round(2.345, 2) == 2.35 && round(2.5) == 3`:                                   true,
+		`round(amount)`:                  int64(-120),
+		`round(1250, -2)`:                int64(1300),
+		`discount(amount, level) == 0.2`: true,
+		`before(date(created), now()) && after(dateAdd(date(created), duration("12d")), now())`: true,
+		`dateDiff(now(), dateSub(now(), duration("90m"))) == duration("1h30m")`:                 true,
+	}
+	for expr, want := range cases {
+		r := &rule.Rule{}
+		r.SetEnv(env)
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		got, err := r.Eval(data)
+		if err != nil || got != want {
+			t.Fatalf("%s: got %v %v, want %v", expr, got, err, want)
+		}
+	}
+
+	r := &rule.Rule{}
+	for _, expr := range []string{`discount(1, "x")`, `lower()`, `upper("a", "b")`, `in(1)`, `a.b(1)`, `round(1.234, 1, 2)`, `round()`, `date("a", "b", "c")`} {
+		if err := r.SetExpr(expr); err == nil {
+			t.Fatalf("%s: expected a compile error", expr)
+		}
+	}
+	r.SetExpr(`upper(1)`)
+	if _, err := r.Eval(nil); !errors.Is(err, rule.ErrUnsupportParam) {
+		t.Fatalf("argument type: %v", err)
+	}
+
+	r.SetEnv(env)
+	r.SetSchema(rule.Schema{"amount": rule.NumberType, "level": rule.StringType})
+	if err := r.SetExpr(`discount(level, amount)`); !errors.Is(err, rule.ErrNotNumber) {
+		t.Fatalf("schema argument check: %v", err)
+	}
+	if err := r.SetExpr(`discount(amount, level) * 2`); err != nil || r.ResultType() != rule.NumberType {
+		t.Fatalf("result type %v %v", r.ResultType(), err)
+	}
+}
+
+type ruleAddress struct {
+	City string `json:"city"`
+	Zip  int32  `rule:"zip" json:"postcode"`
+}
+
+type ruleAudit struct {
+	Version int
+}
+
+type ruleOrder struct {
+	*ruleAudit
+	ruleAddress `json:"-"`
+	ID          int64              `json:"id"`
+	Amount      float32            `rule:"amount"`
+	Items       []uint16           `json:"items"`
+	Codes       [2]string          `json:"codes"`
+	Limits      map[string]int     `json:"limits"`
+	Ship        *ruleAddress       `json:"ship"`
+	Extra       json.RawMessage    `json:"extra"`
+	Secret      string             `json:"-"`
+	Timeout     time.Duration      `json:"timeout"`
+	Tags        map[string][]int64 `json:"tags"`
+}
+
+func TestRuleDatasource(t *testing.T) {
+	order := &ruleOrder{
+		ID:      7,
+		Amount:  99.5,
+		Items:   []uint16{3, 4},
+		Codes:   [2]string{"A", "B"},
+		Limits:  map[string]int{"daily": 100},
+		Ship:    &ruleAddress{City: "Paris", Zip: 75001},
+		Extra:   json.RawMessage(`{"score": 12, "flags": [1, 2.5]}`),
+		Timeout: time.Minute,
+		Tags:    map[string][]int64{"x": {5}},
+	}
+	cases := []struct {
+		expr string
+		data interface{}
+		want interface{}
+		err  bool
+	}{
+		{`id == 7 && amount > 99`, order, true, false},
+		{`items[1] + codes[0]`, order, nil, true},
+		{`items[1] == 4 && len(codes) == 2 && contains(items, 3)`, order, true, false},
+		{`limits.daily == 100 && limits["daily"] < 101`, order, true, false},
+		{`ship.zip`, order, int64(75001), false},
+		{`extra.score == 12 && extra.flags[1] == 2.5`, order, true, false},
+		{`timeout > duration("30s")`, order, true, false},
+		{`tags.x[0]`, *order, int64(5), false},
+		{`Version`, order, nil, false}, // 嵌入的指针为 nil
+		{`city`, order, nil, true},     // 嵌入的字段被标签忽略
+		{`m.a > 1`, map[string]map[string]int{"m": {"a": 2}}, true, false},
+		{`user.age >= 18 && in(user.role, "admin", "dev")`, []byte(`{"user":{"age":30,"role":"dev"}}`), true, false},
+		{`items[0].price == 1.25`, json.RawMessage(`{"items":[{"price":1.25}]}`), true, false},
+		{`a`, []byte(`{"a":`), nil, true},
+	}
+	for _, c := range cases {
+		r := &rule.Rule{}
+		if err := r.SetExpr(c.expr); err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		got, err := r.Eval(c.data)
+		if (err != nil) != c.err || got != c.want {
+			t.Fatalf("%s: got %v (%T) %v, want %v", c.expr, got, got, err, c.want)
+		}
+	}
+
+	order.ruleAudit = &ruleAudit{Version: 3}
+	r := &rule.Rule{}
+	r.SetExpr(`Version`)
+	if v, err := r.Eval(order); err != nil || v != int64(3) {
+		t.Fatalf("embedded field: %v %v", v, err)
+	}
+	for _, expr := range []string{`Secret`, `Zip`, `ship.nope`} {
+		r.SetExpr(expr)
+		if _, err := r.Eval(order); err == nil {
+			t.Fatalf("%s: expected an error", expr)
+		}
+	}
+
+	schema, err := rule.SchemaOf(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetSchema(schema)
+	if err = r.SetExpr(`ship.zip > 1 && items[0] < 10 && limits.daily > 0 && Version > 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SetExpr(`ship.city > 1`); !errors.Is(err, rule.ErrNotNumber) {
+		t.Fatalf("schema of struct: %v", err)
+	}
+	if err = r.SetExpr(`Secret`); !errors.Is(err, rule.ErrKeyNotFound) {
+		t.Fatalf("schema of struct: %v", err)
+	}
+}
+
+func TestRuleNumeric(t *testing.T) {
+	data := map[string]interface{}{
+		"a":     0.1,
+		"b":     0.2,
+		"c":     0.3,
+		"price": decimal.RequireFromString("19.99"),
+		"qty":   uint8(3),
+		"max":   uint64(math.MaxUint64),
+		"big":   int64(1<<53 + 1),
+		"n":     int64(7),
+	}
+	cases := map[string]string{
+		`a + b`:                          "0.3",
+		`price * qty`:                    "59.97",
+		`price * qty - 0.97 + n`:         "66",
+		`max + 1`:                        "18446744073709551616",
+		`9223372036854775807 + 1`:        "9223372036854775808",
+		`-(-9223372036854775807 - 1)`:    "9223372036854775808",
+		`3037000500 * 3037000500`:        "9223372037000250000",
+		`1 / 3`:                          "0.3333333333333333",
+		`n / 2`:                          "3.5",
+		`7.5 % 2`:                        "1.5",
+		`div(-7, 2)`:                     "-3",
+		`div(price, 3)`:                  "6",
+		`0x10 + 1_000`:                   "1016",
+		`123456789012345678901234567890`: "123456789012345678901234567890",
+	}
+	for expr, want := range cases {
+		r := &rule.Rule{}
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		got, err := r.Decimal(data)
+		if err != nil || got.String() != want {
+			t.Fatalf("%s: got %v %v, want %s", expr, got, err, want)
+		}
+	}
+
+	for _, expr := range []string{
+		`a + b == c && 0.1 + 0.2 == 0.3`,
+		`n * 2 == 14 && n % 3 == 1 && -n % 3 == -1`,
+		`big > 9007199254740992 && big > 9007199254740992.0`,
+		`c > 0.25 && c < 0.35 && c == 0.3 && price > 19.989`,
+		`qty + 1 > a + b && max > price`,
+		`round(price / qty, 2) == 6.66 && min(price, 20, qty) == 3`,
+	} {
+		r := &rule.Rule{}
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if ok, err := r.Bool(data); !ok || err != nil {
+			t.Fatalf("%s: got %v %v", expr, ok, err)
+		}
+	}
+
+	r := &rule.Rule{}
+	r.SetExpr(`n * 3`)
+	if v, err := r.Eval(data); v != int64(21) || err != nil {
+		t.Fatalf("integer product: %v (%T) %v", v, v, err)
+	}
+	r.SetExpr(`n / 2`)
+	if i, err := r.Int(data); i != 3 || err != nil {
+		t.Fatalf("Int: %v %v", i, err)
+	}
+	if f, err := r.Float(data); f != 3.5 || err != nil {
+		t.Fatalf("Float: %v %v", f, err)
+	}
+	for _, expr := range []string{`n / 0`, `n % 0`, `div(n, 0)`, `price / 0.0`} {
+		r.SetExpr(expr)
+		if _, err := r.Eval(data); !errors.Is(err, rule.ErrDivByZero) {
+			t.Fatalf("%s: %v", expr, err)
+		}
+	}
+
+	modes := map[rule.RoundingMode][3]string{
+		rule.RoundHalfUp:   {"0.13", "-0.13", "0.38"},
+		rule.RoundHalfEven: {"0.12", "-0.12", "0.38"},
+		rule.RoundDown:     {"0.12", "-0.12", "0.37"},
+		rule.RoundUp:       {"0.13", "-0.13", "0.38"},
+		rule.RoundCeiling:  {"0.13", "-0.12", "0.38"},
+		rule.RoundFloor:    {"0.12", "-0.13", "0.37"},
+	}
+	for mode, want := range modes {
+		env := rule.NewEnv()
+		env.SetDivision(2, mode)
+		r := &rule.Rule{}
+		r.SetEnv(env)
+		for i, x := range []int64{1, -1, 3} {
+			r.SetExpr(`x / 8`)
+			got, err := r.Decimal(map[string]interface{}{"x": x})
+			if err != nil || got.String() != want[i] {
+				t.Fatalf("mode %d: %d/8 = %v %v, want %s", mode, x, got, err, want[i])
+			}
+		}
+	}
+}
+
+func TestRuleOperators(t *testing.T) {
+	data := map[string]interface{}{
+		"name":   "Alice",
+		"tier":   "gold",
+		"tags":   []interface{}{"vip", "new"},
+		"scores": []int{1, 5, 9},
+		"empty":  []interface{}{},
+		"attrs":  map[string]interface{}{"color": "red"},
+		"user":   map[string]interface{}{"profile": nil},
+		"items": []interface{}{
+			map[string]interface{}{"price": int64(120), "qty": int64(1)},
+			map[string]interface{}{"price": int64(30), "qty": int64(2)},
+		},
+	}
+	for _, expr := range []string{
+		`name == "Alice" && name != "Bob" && name < "Bob" && "b" >= "a"`,
+		`name + " " + tier == "Alice gold"`,
+		`"vip" in tags && "old" not in tags && 5 in scores && 4 not in scores`,
+		`"color" in attrs && "size" not in attrs && "lic" in name`,
+		`any(scores, it > 8) && all(scores, it > 0) && !any(scores, it > 9)`,
+		`any(items, price > 100) && all(items, qty >= 1) && all(attrs, it == "red")`,
+		`any(scores, s, s == 5 && any(items, i, i.qty * s == 10))`,
+		`all(empty, it > 0) && !any(empty, it > 0)`,
+		`if(tier == "gold", 0.2, 0.0) == 0.2 && if(name == "x", missing, 1) == 1`,
+		`user?.profile?.city == nil && missing?.x == nil && attrs?.color == "red"`,
+		`user?.profile.city.zip == nil && missing?.x.y == nil`,
+		`any(scores, x > 8) && all(tags, tag != "") && !any(scores, n > 9)`,
+		`nil == nil && tier != nil && tier != 1`,
+		`in(tier, "gold", "silver")`,
+	} {
+		r := &rule.Rule{}
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if ok, err := r.Bool(data); !ok || err != nil {
+			t.Fatalf("%s: got %v %v", expr, ok, err)
+		}
+	}
+
+	r := &rule.Rule{}
+	for expr, want := range map[string]error{
+		`name < 1`:              rule.ErrNotNumber,
+		`any(name, it)`:         rule.ErrUnsupportParam,
+		`any(scores, it)`:       rule.ErrNotBool,
+		`if(name, 1, 2)`:        rule.ErrNotBool,
+		`1 in 2`:                rule.ErrUnsupportParam,
+		`user.profile.city`:     nil,
+		`missing.x`:             rule.ErrKeyNotFound,
+		`items[0]?.price + 1.5`: nil,
+	} {
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if _, err := r.Eval(data); !errors.Is(err, want) && (want != nil || err == nil) {
+			t.Fatalf("%s: got %v, want %v", expr, err, want)
+		}
+	}
+	// 使用 it 时条件中的其他标志符及数据源中的变量不绑定到元素
+	limit := map[string]interface{}{
+		"tags":   []interface{}{"vip", "new"},
+		"wanted": "old",
+		"scores": []int{1, 2, 50},
+		"limit":  10,
+	}
+	for expr, want := range map[string]bool{
+		`any(tags, it == wanted)`:  false,
+		`any(scores, it > limit)`:  true,
+		`all(scores, it <= limit)`: false,
+		`any(scores, x > limit)`:   true,
+		`all(scores, x > limit)`:   false,
+	} {
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if ok, err := r.Bool(limit); ok != want || err != nil {
+			t.Fatalf("%s: got %v %v, want %v", expr, ok, err, want)
+		}
+	}
+	for _, expr := range []string{`if(a, b)`, `any(scores)`, `any(scores, 1, true)`, `a not b`, `a ? b`} {
+		if err := r.SetExpr(expr); err == nil {
+			t.Fatalf("%s: expected a compile error", expr)
+		}
+	}
+	if err := rule.NewEnv().Register("any", &rule.Func{Call: func([]interface{}) (interface{}, error) { return nil, nil }}); err == nil {
+		t.Fatal("builtin any was replaced")
+	}
+
+	r.SetSchema(rule.Schema{
+		"x":     rule.NumberType,
+		"nums":  rule.SliceOf(rule.NumberType),
+		"tier":  rule.StringType,
+		"items": rule.SliceOf(rule.MapOf(map[string]*rule.Type{"price": rule.NumberType})),
+	})
+	for expr, want := range map[string]string{
+		`tier + "!"`:                     "string",
+		`if(x > 1, tier, "none")`:        "string",
+		`if(x > 1, tier, x)`:             "any",
+		`any(items, price > x)`:          "bool",
+		`any(nums, n > 3)`:               "bool",
+		`all(items, i, i.price > 0)`:     "bool",
+		`any(nums, it > x)`:              "bool",
+		`any(nums, x > 3)`:               "bool",
+		`x in items && tier not in tier`: "bool",
+	} {
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if got := r.ResultType().String(); got != want {
+			t.Fatalf("%s: result %s, want %s", expr, got, want)
+		}
+	}
+	for expr, pos := range map[string]string{
+		`x not in 5`:              "1:10",
+		`any(items, price > "a")`: "1:20",
+		`any(items, cost > 1)`:    "1:12",
+		`tier == x`:               "1:1",
+		`items[0]?.cost`:          "1:11",
+		`any(nums, n > x + y)`:    "1:11",
+	} {
+		var te *rule.TypeError
+		if err := r.SetExpr(expr); !errors.As(err, &te) || te.Pos.String() != pos {
+			t.Fatalf("%s: got %v, want error at %s", expr, err, pos)
+		}
+	}
+}
+
+func TestRuleSet(t *testing.T) {
+	s := rule.NewRuleSet()
+	for _, spec := range []rule.RuleSpec{
+		{Name: "block", When: `risk >= 50`, Then: []string{`blocked = true`, `stop`}, Priority: 100},
+		{Name: "big", When: `amount > 500`, Then: []string{`risk += 30`}, Priority: 10},
+		{Name: "newAccount", When: `age < 30`, Then: []string{`risk += 20`}, Priority: 10, Salience: -1},
+		{Name: "gold", When: `amount > 1000`, Then: []string{`level = "gold"`}},
+		{Name: "discount", When: `level == "gold"`, Then: []string{`discount = amount * 0.1`, `order.status = "priced"`, `order["tags"] = "gold"`}},
+	} {
+		if err := s.Add(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := s.Run(map[string]interface{}{"amount": int64(1200), "age": int64(400)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fired []string
+	for _, f := range res.Fired {
+		fired = append(fired, f.Rule)
+	}
+	if fmt.Sprint(fired) != "[big gold discount]" || res.Stopped {
+		t.Fatalf("fired %v, stopped %v", fired, res.Stopped)
+	}
+	f := res.Fired[2]
+	if f.Cycle != 3 || fmt.Sprint(f.Facts) != "map[level:gold]" || len(f.Changes) != 3 || f.Changes[1].Path != "order.status" {
+		t.Fatalf("trace %+v", f)
+	}
+	if fmt.Sprint(res.Facts["discount"], res.Facts["order"], res.Facts["risk"]) != "120 map[status:priced tags:gold] 30" {
+		t.Fatalf("facts %v", res.Facts)
+	}
+
+	res, err = s.Run(map[string]interface{}{"amount": int64(800), "age": int64(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Fired) != 3 || res.Fired[2].Rule != "block" || !res.Fired[2].Stop || !res.Stopped || res.Facts["risk"] != int64(50) {
+		t.Fatalf("risk scoring: %+v", res)
+	}
+
+	// 并发执行
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := s.Run(map[string]interface{}{"amount": int64(1000 + i), "age": int64(100)})
+			if err != nil || res.Facts["level"] != "gold" && i > 0 {
+				t.Errorf("run %d: %v %v", i, res.Facts, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s = rule.NewRuleSet()
+	s.Add(rule.RuleSpec{Name: "promo", When: `amount > 0`, Then: []string{`bonus = 5`, `retract("fallback")`, `retract`}, Salience: 1})
+	s.Add(rule.RuleSpec{Name: "fallback", When: `amount > 0`, Then: []string{`bonus = 1`}})
+	if res, err = s.Run(map[string]interface{}{"amount": 1}); err != nil || len(res.Fired) != 1 ||
+		fmt.Sprint(res.Fired[0].Retracted) != "[fallback promo]" || res.Facts["bonus"] != int64(5) {
+		t.Fatalf("retract: %+v %v", res, err)
+	}
+
+	s = rule.NewRuleSet()
+	s.MaxCycles = 10
+	s.Add(rule.RuleSpec{Name: "on", When: `x == 0`, Then: []string{`x = 1`}})
+	s.Add(rule.RuleSpec{Name: "off", When: `x == 1`, Then: []string{`x = 0`}})
+	if res, err = s.Run(map[string]interface{}{"x": 0}); !errors.Is(err, rule.ErrCycleLimit) || len(res.Fired) != 10 {
+		t.Fatalf("cycle: %v", err)
+	}
+	s.Add(rule.RuleSpec{Name: "bad", When: `name > 1`, Priority: 1})
+	if _, err = s.Run(map[string]interface{}{"name": "a"}); !errors.Is(err, rule.ErrNotNumber) {
+		t.Fatalf("condition error: %v", err)
+	}
+
+	for _, spec := range []rule.RuleSpec{
+		{Name: "on", When: `true`},
+		{Name: "", When: `true`},
+		{Name: "a", When: `a >`},
+		{Name: "a", When: `true`, Then: []string{`1 = 2`}},
+		{Name: "a", When: `true`, Then: []string{`x = (`}},
+		{Name: "a", When: `true`, Then: []string{`halt`}},
+		{Name: "a", When: `true`, Then: []string{`x[0] = 1`}},
+	} {
+		if err := s.Add(spec); err == nil {
+			t.Fatalf("%+v: expected an error", spec)
+		}
+	}
+}
+
+func TestRuleLoader(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, age time.Duration) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// 保证修改时间变化
+		mtime := time.Now().Add(-age)
+		os.Chtimes(path, mtime, mtime)
+	}
+	write("pricing.yaml", `
+rules:
+  - name: gold
+    expr: amount > 1000
+    then: [level = "gold"]
+    priority: 10
+    metadata:
+      owner: pricing
+  - name: draft
+    expr: amount > 1
+    enabled: false
+`, time.Hour)
+	write("risk.json", `[{"name": "big", "expr": "amount > 500", "then": ["risk += 30"]}]`, time.Hour)
+	write("notes.txt", `not a rule file`, time.Hour)
+
+	l, err := rule.NewLoader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.RuleSet().Len() != 2 || len(l.Definitions()) != 3 {
+		t.Fatalf("loaded %d rules, %d definitions", l.RuleSet().Len(), len(l.Definitions()))
+	}
+	if d, ok := l.Definition("gold"); !ok || d.Metadata["owner"] != "pricing" || !d.IsEnabled() {
+		t.Fatalf("definition %+v", d)
+	}
+	res, err := l.RuleSet().Run(map[string]interface{}{"amount": int64(2000)})
+	if err != nil || res.Facts["level"] != "gold" || res.Facts["risk"] != int64(30) {
+		t.Fatalf("run: %v %v", res.Facts, err)
+	}
+	if r, ok := l.RuleSet().Rule("big"); !ok {
+		t.Fatal("rule big not found")
+	} else if ok, _ := r.Bool(map[string]interface{}{"amount": 600}); !ok {
+		t.Fatal("rule big: expected true")
+	}
+	if reloaded, err := l.Reload(); reloaded || err != nil {
+		t.Fatalf("unchanged reload: %v %v", reloaded, err)
+	}
+
+	// 有错误的规则不会替换原来的规则集
+	old := l.RuleSet()
+	for content, want := range map[string]string{
+		`[{"name": "big", "expr": "amount >"}]`:                   "expected operand",
+		`[{"name": "big", "expr": "amount > 1", "prio": 1}]`:      "unknown field",
+		`[{"name": "gold", "expr": "amount > 1"}]`:                "duplicate",
+		`[{"name": "big", "expr": "true", "then": ["x[0] = 1"]}]`: "can not assign",
+	} {
+		write("risk.json", content, time.Duration(len(content))*time.Minute)
+		reloaded, err := l.Reload()
+		if reloaded || err == nil || !strings.Contains(err.Error(), want) || l.RuleSet() != old {
+			t.Fatalf("%s: %v %v", content, reloaded, err)
+		}
+	}
+	write("risk.json", `[]`, 3*time.Minute)
+	write("pricing.yaml", "- name: gold\n  expr: amount >\n", 2*time.Minute)
+	if _, err := l.Reload(); err == nil || !strings.Contains(err.Error(), "rule gold") || l.RuleSet() != old {
+		t.Fatalf("yaml: %v", err)
+	}
+
+	// 轮询
+	reloads := make(chan *rule.RuleSet, 1)
+	errs := make(chan error, 10)
+	l.OnReload = func(s *rule.RuleSet) { reloads <- s }
+	l.OnError = func(err error) { errs <- err }
+	l.Watch(10 * time.Millisecond)
+	defer l.Stop()
+	write("pricing.yaml", "- name: gold\n  expr: amount > 10\n", time.Minute)
+	write("risk.json", `{"rules": []}`, time.Minute)
+	select {
+	case s := <-reloads:
+		if s.Len() != 1 || l.RuleSet() != s {
+			t.Fatalf("reloaded %d rules", s.Len())
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload")
+	}
+
+	// 文件持续不存在时只报告一次
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error for a missing directory")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(errs); n != 0 {
+		t.Fatalf("missing directory reported %d more times", n)
+	}
+
+	if _, err := rule.NewLoader(filepath.Join(dir, "missing.yaml"), nil); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+	if _, err := rule.ParseDefinitions("rules.toml", nil); err == nil {
+		t.Fatal("expected an error for an unsupported file type")
+	}
+}
+
+func TestRuleTrace(t *testing.T) {
+	data := map[string]interface{}{"age": int64(16), "country": "US", "tags": []string{"new"}, "vip": true}
+	r := &rule.Rule{}
+	if err := r.SetExpr(`age >= 18 && country == "US" || "new" not in tags`); err != nil {
+		t.Fatal(err)
+	}
+	v, tr, err := r.EvalTrace(data)
+	if err != nil || v != false {
+		t.Fatalf("%v %v", v, err)
+	}
+	want := `age >= 18 && country == "US" || "new" not in tags => false
+  age >= 18 && country == "US" => false
+    age >= 18 => false
+      age => 16
+      18 => 18
+    country == "US" (skipped)
+  "new" not in tags => false
+    "new" => "new"
+    tags => [new]
+`
+	if tr.String() != want {
+		t.Fatalf("trace:\n%s", tr)
+	}
+	if tr.Children[1].Start != 32 || tr.Children[1].End != 49 {
+		t.Fatalf("span %d..%d", tr.Children[1].Start, tr.Children[1].End)
+	}
+	js, err := json.Marshal(tr.Children[0])
+	if err != nil || !strings.Contains(string(js), `{"expr":"country == \"US\"","start":13,"end":28,"skipped":true}`) {
+		t.Fatalf("json %s %v", js, err)
+	}
+
+	if err := r.SetExpr(`if(vip, 1, 2) + x?.y`); err != nil {
+		t.Fatal(err)
+	}
+	_, tr, err = r.EvalTrace(data)
+	want = `if(vip, 1, 2) + x?.y => error: not a number
+  if(vip, 1, 2) => 1
+    vip => true
+    1 => 1
+    2 (skipped)
+  x?.y => nil
+    x => error: map key not found
+`
+	if !errors.Is(err, rule.ErrNotNumber) || tr.String() != want {
+		t.Fatalf("trace %v:\n%s", err, tr)
+	}
+
+	// && 和 || 短路求值，右边不会出错
+	for expr, want := range map[string]bool{
+		`age > 18 && missing.field`:   false,
+		`age < 18 || 1 / 0 > 0`:       true,
+		`!(country == "US") && "x"`:   false,
+		`country == "US" && age < 18`: true,
+	} {
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := r.Bool(data); err != nil || got != want {
+			t.Fatalf("%s: %v %v", expr, got, err)
+		}
+	}
+	if err := r.SetExpr(`age < 18 && "x"`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Eval(data); !errors.Is(err, rule.ErrNotBool) {
+		t.Fatalf("non-bool operand: %v", err)
+	}
+}
+
+func TestRuleOptimize(t *testing.T) {
+	data := map[string]interface{}{
+		"age":  int64(30),
+		"vip":  false,
+		"name": "bob",
+		"nan":  math.NaN(),
+		"user": map[string]interface{}{"age": int64(30), "name": "bob"},
+	}
+	schema := rule.Schema{
+		"age":  rule.NumberType,
+		"vip":  rule.BoolType,
+		"name": rule.StringType,
+		"nan":  rule.NumberType,
+		"user": rule.MapOf(map[string]*rule.Type{"age": rule.NumberType, "name": rule.StringType}),
+	}
+	// 优化后的结果及错误与 EvalTrace（不优化）相同
+	for _, expr := range []string{
+		`user.age > 18 && user.age < 65 && user.name == name`,
+		`age + (2 * 3 - 1) > 0 && !(1 > 2)`,
+		`1 / 0 > age || vip`,
+		`vip || 1 / 0 > age`,
+		`true && user.missing > 1`,
+		`user.missing > 1 && false`,
+		`false || user.missing > 1`,
+		`user.age > 100 && user.missing > 1`,
+		`if(1 > 2, user.missing, user.age) + user.age`,
+		`if(2 > 1, age, 1 / 0)`,
+		`nan + 1 > 0 && vip`,
+		`vip && nan + 1 > 0`,
+		`user.name + "!" == "bob!" && age > 1`,
+		`"b" in name && 2 > 1`,
+		`-age < 0 && -(2) < 0`,
+	} {
+		for _, s := range []rule.Schema{nil, schema} {
+			r := &rule.Rule{}
+			r.SetSchema(s)
+			if err := r.SetExpr(expr); err != nil {
+				if s != nil && errors.Is(err, rule.ErrKeyNotFound) {
+					continue
+				}
+				t.Fatalf("%s: %v", expr, err)
+			}
+			got, err := r.Eval(data)
+			want, _, wantErr := r.EvalTrace(data)
+			if fmt.Sprint(got) != fmt.Sprint(want) || fmt.Sprint(err) != fmt.Sprint(wantErr) {
+				t.Errorf("%s (schema %v): got %v %v, want %v %v", expr, s != nil, got, err, want, wantErr)
+			}
+		}
+	}
+
+	// 字段访问的缓存只在一次求值中有效
+	r := &rule.Rule{}
+	if err := r.SetExpr(`user.age > 18 && user.age < 65`); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(age int64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ok, err := r.Bool(map[string]interface{}{"user": map[string]interface{}{"age": age}})
+				if err != nil || ok != (age > 18 && age < 65) {
+					t.Errorf("age %d: %v %v", age, ok, err)
+					return
+				}
+			}
+		}(int64(i * 10))
+	}
+	wg.Wait()
+}
+
+func TestRuleLimits(t *testing.T) {
+	limited := func(limits rule.Limits, env *rule.Env, expr string) *rule.Rule {
+		r := &rule.Rule{}
+		r.SetLimits(limits)
+		r.SetEnv(env)
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		return r
+	}
+	kinds := []error{rule.ErrDepthLimit, rule.ErrStepLimit, rule.ErrTimeLimit, rule.ErrAllocLimit}
+	expect := func(err, kind error, limit int64) {
+		t.Helper()
+		var le *rule.LimitError
+		if !errors.As(err, &le) || le.Limit != limit {
+			t.Fatalf("got %v, want %v", err, kind)
+		}
+		for _, k := range kinds {
+			if errors.Is(err, k) != (k == kind) {
+				t.Fatalf("%v: errors.Is(%v) = %v", err, k, !(k == kind))
+			}
+		}
+	}
+
+	// 深度在 SetExpr 时检查
+	r := &rule.Rule{}
+	r.SetLimits(rule.Limits{MaxDepth: 6})
+	expect(r.SetExpr(`a + (b + (c + (d + e)))`), rule.ErrDepthLimit, 6)
+	if err := r.SetExpr(`a + b > c`); err != nil {
+		t.Fatal(err)
+	}
+
+	items := make([]interface{}, 100)
+	for i := range items {
+		items[i] = int64(i + 1)
+	}
+	data := map[string]interface{}{"items": items, "s": strings.Repeat("x", 40)}
+	r = limited(rule.Limits{MaxSteps: 50}, nil, `all(items, it > 0)`)
+	_, err := r.Eval(data)
+	expect(err, rule.ErrStepLimit, 50)
+	r = limited(rule.Limits{MaxSteps: 500}, nil, `all(items, it > 0)`)
+	if ok, err := r.Bool(data); !ok || err != nil {
+		t.Fatalf("500 steps: %v %v", ok, err)
+	}
+
+	r = limited(rule.Limits{MaxAlloc: 100}, nil, `upper(s) + upper(s) != ""`)
+	_, err = r.Eval(data)
+	expect(err, rule.ErrAllocLimit, 100)
+	if ok, err := r.Bool(map[string]interface{}{"s": "abc"}); !ok || err != nil {
+		t.Fatalf("small alloc: %v %v", ok, err)
+	}
+
+	// 截止时间：CallContext 可以被中断，Call 在下一次调用或迭代前检查
+	env := rule.NewEnv()
+	env.Register("wait", &rule.Func{Result: rule.BoolType, CallContext: func(ctx context.Context, args []interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return true, nil
+		}
+	}})
+	env.Register("nap", &rule.Func{Params: []*rule.Type{nil}, Result: rule.BoolType, Call: func(args []interface{}) (interface{}, error) {
+		time.Sleep(5 * time.Millisecond)
+		return true, nil
+	}})
+	start := time.Now()
+	r = limited(rule.Limits{Timeout: 20 * time.Millisecond}, env, `wait()`)
+	_, err = r.Eval(nil)
+	expect(err, rule.ErrTimeLimit, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cause %v", err)
+	}
+	r = limited(rule.Limits{}, env, `all(items, nap(it))`)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = r.EvalContext(ctx, data)
+	expect(err, rule.ErrTimeLimit, 0)
+	if time.Since(start) > time.Second {
+		t.Fatalf("took %v", time.Since(start))
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = r.EvalContext(ctx, data); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled: %v", err)
+	}
+	// 只有 ctx 时没有函数调用和迭代的表达式也会定期检查
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	env.Register("stop", &rule.Func{Result: rule.BoolType, Call: func(args []interface{}) (interface{}, error) {
+		cancel()
+		return true, nil
+	}})
+	r = limited(rule.Limits{}, env, `stop() && `+strings.Repeat("s + ", 100)+`s != ""`)
+	if _, err = r.EvalContext(ctx, data); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled while evaluating: %v", err)
+	}
+
+	// SetLimits 可在 SetExpr 之后调用
+	r = limited(rule.Limits{}, nil, `a + (b + (c + (d + e)))`)
+	r.SetLimits(rule.Limits{MaxDepth: 6})
+	_, err = r.Eval(nil)
+	expect(err, rule.ErrDepthLimit, 6)
+	r = limited(rule.Limits{}, nil, `all(items, it > 0)`)
+	r.SetLimits(rule.Limits{MaxSteps: 50})
+	_, err = r.Eval(data)
+	expect(err, rule.ErrStepLimit, 50)
+
+	// EvalTrace 同样受限制
+	r = limited(rule.Limits{}, nil, `a > 1 && b`)
+	r.SetLimits(rule.Limits{MaxDepth: 2, MaxSteps: 2})
+	_, _, err = r.EvalTrace(map[string]interface{}{"a": int64(2), "b": true})
+	expect(err, rule.ErrDepthLimit, 2)
+	r = limited(rule.Limits{MaxSteps: 50}, nil, `all(items, it > 0)`)
+	_, tr, err := r.EvalTrace(data)
+	expect(err, rule.ErrStepLimit, 50)
+	if tr == nil || tr.Error == "" {
+		t.Fatalf("trace of an exceeded limit: %v", tr)
+	}
+	r = limited(rule.Limits{MaxAlloc: 100}, nil, `upper(s) + upper(s) != ""`)
+	_, _, err = r.EvalTrace(data)
+	expect(err, rule.ErrAllocLimit, 100)
+
+	// 没有限制时 Eval 不受影响
+	r = limited(rule.Limits{}, env, `nap(1) && len(items) == 100`)
+	if ok, err := r.Bool(data); !ok || err != nil {
+		t.Fatalf("unlimited: %v %v", ok, err)
+	}
+}
+
+func TestRuleFormat(t *testing.T) {
+	for expr, want := range map[string]string{
+		`((age>18))&&(vip)`:                          `age > 18 && vip`,
+		`(a+b)*c  ==  -(d)`:                          `(a + b) * c == -d`,
+		`"x"   not in  tags||user?.name in  (names)`: `"x" not in tags || user?.name in names`,
+		`if( (score>=60) ,"pass",lower( "FAIL" ))`:   `if(score >= 60, "pass", lower("FAIL"))`,
+		`!(a in b) && - -x[0] > items["k"].n`:        `!(a in b) && - -x[0] > items["k"].n`,
+		`a?.b.c  ==  (x?.y)?.z`:                      `a?.b.c == x?.y?.z`,
+		`(a - b) - (c - d) / (e * f)`:                `a - b - (c - d) / (e * f)`,
+		`(a || b) && (c && d) || (e && f)`:           `(a || b) && (c && d) || e && f`,
+	} {
+		got, err := rule.Format(expr)
+		if err != nil || got != want {
+			t.Fatalf("%s: got %s %v", expr, got, err)
+		}
+		// 规范形式再格式化不变
+		if again, err := rule.Format(got); err != nil || again != got {
+			t.Fatalf("%s: not stable %s %v", got, again, err)
+		}
+	}
+	if _, err := rule.Format(`a > `); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
+
+func TestRuleLint(t *testing.T) {
+	warnings, err := rule.Lint(`price == 0.1 && (1 > 2 || vip) && if(true, a, b) && foo(x) != nil && age > 1.5`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, w := range warnings {
+		got = append(got, fmt.Sprintf("%d %s: %s", w.Pos.Column, w.Expr, w.Msg))
+	}
+	want := []string{
+		"1 price == 0.1: == on a fractional number, compare with a tolerance or round() instead",
+		"18 1 > 2: condition is always false",
+		"38 true: condition is always true",
+		"53 foo: unknown function foo",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q", got)
+	}
+
+	env := rule.NewEnv()
+	env.Register("foo", &rule.Func{Call: func(args []interface{}) (interface{}, error) { return nil, nil }})
+	if warnings, err := rule.Lint(`foo(x) && age > 18`, env); err != nil || len(warnings) != 0 {
+		t.Fatalf("registered %v %v", warnings, err)
+	}
+	if _, err := rule.Lint(`age >`, nil); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
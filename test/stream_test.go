@@ -0,0 +1,116 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+func TestEvents(t *testing.T) {
+	var conns int32
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		switch atomic.AddInt32(&conns, 1) {
+		case 1:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, ": hello\r\nretry: 10\r\n\r\nid: 1\nevent: update\ndata: a\ndata: b\n\nid: 2\ndata: c\n\n")
+		case 2:
+			if r.Header.Get("Last-Event-ID") != "2" {
+				w.WriteHeader(nethttp.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: d\n\n")
+		case 3:
+			// the last id is kept across connections
+			if r.Header.Get("Last-Event-ID") != "2" {
+				w.WriteHeader(nethttp.StatusBadRequest)
+				return
+			}
+			fallthrough
+		default:
+			w.WriteHeader(nethttp.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, errc := http.HttpGet(srv.URL).Events(ctx)
+
+	var got []http.Event
+	for ev := range events {
+		got = append(got, ev)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	want := []http.Event{
+		{ID: "1", Event: "update", Data: "a\nb"},
+		{ID: "2", Event: "message", Data: "c"},
+		{ID: "2", Event: "message", Data: "d"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// permanent errors end the stream instead of reconnecting
+	events, errc = http.HttpGet("svc://no-such-service/events").Events(ctx)
+	for range events {
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServiceNotFound) {
+		t.Fatalf("unknown service: %v", err)
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "{\"n\":%d}\n", i)
+			w.(nethttp.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	sum := 0
+	err := http.HttpGet(srv.URL).DecodeStream(context.Background(), func(raw json.RawMessage) error {
+		var rec struct{ N int }
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		sum += rec.N
+		return nil
+	})
+	if err != nil || sum != 6 {
+		t.Fatalf("sum %d, err %v", sum, err)
+	}
+
+	// an error response is not decoded as records
+	failing := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.WriteHeader(nethttp.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"boom"}`)
+	}))
+	defer failing.Close()
+	calls := 0
+	err = http.HttpGet(failing.URL).DecodeStream(context.Background(), func(json.RawMessage) error {
+		calls++
+		return nil
+	})
+	var herr *http.HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != nethttp.StatusInternalServerError || calls != 0 {
+		t.Fatalf("500: %v, %d records", err, calls)
+	}
+}
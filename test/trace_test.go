@@ -0,0 +1,101 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	nethttp "net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	name, parent string
+	attrs        map[string]interface{}
+	start, end   time.Time
+	tracer       *recordingTracer
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) StartSpan(ctx context.Context, name string, start time.Time) (context.Context, http.Span) {
+	s := &recordedSpan{name: name, start: start, attrs: map[string]interface{}{}, tracer: r}
+	if p, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = p.name
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+
+func (s *recordedSpan) End(end time.Time, err error) {
+	s.end = end
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+func TestTimings(t *testing.T) {
+	srv := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("head"))
+		w.(nethttp.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("tail"))
+	}))
+	defer srv.Close()
+
+	tracer := &recordingTracer{}
+	transport := &nethttp.Transport{}
+	defer transport.CloseIdleConnections()
+	// requests with the same settings share the connections of a transport
+	config := &tls.Config{InsecureSkipVerify: true}
+	newRequest := func() *http.HTTPRequest {
+		return http.HttpGet(srv.URL).SetTransport(transport).
+			SetTLSClientConfig(config).SetTracer(tracer)
+	}
+
+	req := newRequest()
+	if res, err := req.String(); err != nil || res != "headtail" {
+		t.Fatalf("got %q %v", res, err)
+	}
+	tm := req.Timings()
+	if tm.Connect <= 0 || tm.TLS <= 0 || tm.ConnReused {
+		t.Fatalf("first request timings %+v", tm)
+	}
+	if tm.TTFB < 20*time.Millisecond || tm.Transfer < 20*time.Millisecond || tm.Total < tm.TTFB+tm.Transfer {
+		t.Fatalf("first request timings %+v", tm)
+	}
+
+	req = newRequest()
+	req.String()
+	if tm = req.Timings(); !tm.ConnReused || tm.TLS != 0 {
+		t.Fatalf("second request timings %+v", tm)
+	}
+
+	names := map[string]int{}
+	for _, s := range tracer.spans {
+		names[s.name]++
+		switch s.name {
+		case "HTTP GET":
+			if s.attrs["http.status_code"] != 200 || s.end.Before(s.start) {
+				t.Fatalf("request span %+v", s)
+			}
+		default:
+			if s.parent != "HTTP GET" {
+				t.Fatalf("span %s parent %q", s.name, s.parent)
+			}
+		}
+	}
+	if names["HTTP GET"] != 2 || names["ttfb"] != 2 || names["tls"] != 1 || names["connect"] != 1 {
+		t.Fatalf("spans %v", names)
+	}
+}
@@ -0,0 +1,117 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/carmel/go-util/rule"
+	"github.com/carmel/go-util/rule/transpile"
+)
+
+func TestTranspile(t *testing.T) {
+	compile := func(expr string) *rule.Rule {
+		r := &rule.Rule{}
+		if err := r.SetExpr(expr); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		return r
+	}
+
+	sqlCases := []struct {
+		expr    string
+		dialect transpile.Dialect
+		where   string
+		args    []interface{}
+	}{
+		{`user.age >= 18 && (tier == "gold" || vip)`, transpile.Postgres,
+			`("user"."age" >= $1 AND ("tier" = $2 OR "vip"))`, []interface{}{int64(18), "gold"}},
+		{`!(score < 1.5) && name != nil`, transpile.MySQL,
+			"(NOT `score` < ? AND `name` IS NOT NULL)", []interface{}{"1.5"}},
+		{`in(status, "a", "b") && startsWith(name, "50%_")`, transpile.SQLite,
+			`("status" IN (?, ?) AND "name" LIKE ? ESCAPE '!')`, []interface{}{"a", "b", `50!%!_%`}},
+		{`contains(name, "x") || endsWith(name, "!")`, transpile.MySQL,
+			"(`name` LIKE ? ESCAPE '!' OR `name` LIKE ? ESCAPE '!')", []interface{}{"%x%", "%!!"}},
+		{`total / qty > 2`, transpile.Postgres,
+			`(CAST("total" AS NUMERIC) / "qty") > $1`, []interface{}{int64(2)}},
+		{`if(vip, price * 0.9, price) - 1 > 100`, transpile.SQLServer,
+			`(CASE WHEN [vip] THEN ([price] * @p1) ELSE [price] END - @p2) > @p3`, []interface{}{"0.9", int64(1), int64(100)}},
+		{`lower(name) + "!" == "bob!"`, transpile.Postgres,
+			`(LOWER("name") || $1) = $2`, []interface{}{"!", "bob!"}},
+	}
+	for _, c := range sqlCases {
+		where, args, err := transpile.ToSQL(compile(c.expr), transpile.SQLOptions{Dialect: c.dialect})
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		for i, a := range args {
+			if s, ok := a.(interface{ String() string }); ok {
+				args[i] = s.String()
+			}
+		}
+		if where != c.where || !reflect.DeepEqual(args, c.args) {
+			t.Fatalf("%s: got %s %v", c.expr, where, args)
+		}
+	}
+
+	// 列名映射
+	opt := transpile.SQLOptions{Options: transpile.Options{Columns: map[string]string{"user.age": "u.age"}}}
+	if where, _, err := transpile.ToSQL(compile(`user.age > 1`), opt); err != nil || where != `"u"."age" > $1` {
+		t.Fatalf("mapped %s %v", where, err)
+	}
+	var terr *transpile.Error
+	if _, _, err := transpile.ToSQL(compile(`user.name == "a"`), opt); !errors.As(err, &terr) || terr.Expr != "user.name" {
+		t.Fatalf("unmapped %v", err)
+	}
+	for _, expr := range []string{`any(items, price > 1)`, `"a" in tags`, `len(name) > 1`} {
+		if _, _, err := transpile.ToSQL(compile(expr), transpile.SQLOptions{}); !errors.As(err, &terr) {
+			t.Fatalf("%s: %v", expr, err)
+		}
+	}
+
+	// 按 schema 区分字符串和列表字段
+	typed := &rule.Rule{}
+	typed.SetSchema(rule.Schema{"first": rule.StringType, "last": rule.StringType, "tags": rule.SliceOf(rule.StringType)})
+	if err := typed.SetExpr(`first + last == "ab" && contains(tags, "vip")`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := transpile.ToSQL(typed, transpile.SQLOptions{}); !errors.As(err, &terr) || terr.Expr != "tags" {
+		t.Fatalf("contains on a list: %v", err)
+	}
+	if f, err := transpile.ToFilter(typed, transpile.Options{}); err != nil {
+		t.Fatal(err)
+	} else if b, _ := json.Marshal(f); string(b) != `{"$and":[{"$expr":{"$eq":[{"$concat":["$first","$last"]},"ab"]}},{"tags":"vip"}]}` {
+		t.Fatalf("typed filter: %s", b)
+	}
+	if err := typed.SetExpr(`first + last == "ab"`); err != nil {
+		t.Fatal(err)
+	}
+	if where, _, err := transpile.ToSQL(typed, transpile.SQLOptions{}); err != nil || where != `("first" || "last") = $1` {
+		t.Fatalf("concat: %s %v", where, err)
+	}
+
+	filterCases := []struct {
+		expr   string
+		filter string
+	}{
+		{`user.age >= 18 && tier == "gold" && vip`, `{"$and":[{"user.age":{"$gte":18}},{"tier":"gold"},{"vip":true}]}`},
+		{`1.5 < score || !in(status, "a", "b")`, `{"$or":[{"score":{"$gt":1.5}},{"$nor":[{"status":{"$in":["a","b"]}}]}]}`},
+		{`"x" in tags && contains(name, "a.b")`, `{"$and":[{"tags":"x"},{"name":{"$regex":"a\\.b"}}]}`},
+		{`price * qty > limit`, `{"$expr":{"$gt":[{"$multiply":["$price","$qty"]},"$limit"]}}`},
+		{`lower(name) == "bob"`, `{"$expr":{"$eq":[{"$toLower":"$name"},"bob"]}}`},
+	}
+	for _, c := range filterCases {
+		f, err := transpile.ToFilter(compile(c.expr), transpile.Options{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		b, _ := json.Marshal(f)
+		if string(b) != c.filter {
+			t.Fatalf("%s: got %s", c.expr, b)
+		}
+	}
+	if _, err := transpile.ToFilter(compile(`all(items, price > 1)`), transpile.Options{}); !errors.As(err, &terr) {
+		t.Fatalf("all %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+func protoHandler() nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte(r.Proto + " " + r.URL.RequestURI()))
+	})
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "x.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	srv := &httptest.Server{Listener: l, Config: &nethttp.Server{Handler: protoHandler()}}
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.HttpGet("unix://" + sock + ":/v1/info?a=1").String()
+	if err != nil || res != "HTTP/1.1 /v1/info?a=1" {
+		t.Fatalf("unix url: %q %v", res, err)
+	}
+	res, err = http.HttpGet("http://daemon/ping").SetUnixSocket(sock).String()
+	if err != nil || res != "HTTP/1.1 /ping" {
+		t.Fatalf("unix socket: %q %v", res, err)
+	}
+
+	// a shared transport is not changed by the request settings
+	shared := &nethttp.Transport{}
+	res, err = http.HttpGet("http://daemon/ping").SetTransport(shared).SetUnixSocket(sock).String()
+	if err != nil || res != "HTTP/1.1 /ping" {
+		t.Fatalf("shared transport: %q %v", res, err)
+	}
+	if shared.DialContext != nil {
+		t.Fatal("shared transport was modified")
+	}
+}
+
+func TestOneOffTransport(t *testing.T) {
+	var open int32
+	srv := httptest.NewUnstartedServer(protoHandler())
+	srv.Config.ConnState = func(_ net.Conn, state nethttp.ConnState) {
+		switch state {
+		case nethttp.StateNew:
+			atomic.AddInt32(&open, 1)
+		case nethttp.StateClosed, nethttp.StateHijacked:
+			atomic.AddInt32(&open, -1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// a shared transport cloned for a Proxy or DialContext does not keep the connections of the clones
+	shared := &nethttp.Transport{}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	for i := 0; i < 5; i++ {
+		res, err := http.HttpGet(srv.URL + "/").SetTransport(shared).SetDialContext(dial).String()
+		if err != nil || res != "HTTP/1.1 /" {
+			t.Fatalf("dial %d: %q %v", i, res, err)
+		}
+		res, err = http.HttpGet(srv.URL + "/").SetTransport(shared).SetProxy(nethttp.ProxyURL(nil)).String()
+		if err != nil || res != "HTTP/1.1 /" {
+			t.Fatalf("proxy %d: %q %v", i, res, err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&open) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&open); n > 0 {
+		t.Fatalf("%d connections left open", n)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(protoHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	tlsConfig := &tls.Config{RootCAs: srv.Client().Transport.(*nethttp.Transport).TLSClientConfig.RootCAs}
+	res, err := http.HttpGet(srv.URL+"/").SetTLSHostConfig(u.Hostname(), tlsConfig).String()
+	if err != nil || res != "HTTP/2.0 /" {
+		t.Fatalf("negotiated: %q %v", res, err)
+	}
+	res, err = http.HttpGet(srv.URL + "/").SetTLSClientConfig(tlsConfig).SetProtocolVersion("HTTP/1.1").String()
+	if err != nil || res != "HTTP/1.1 /" {
+		t.Fatalf("http/1.1: %q %v", res, err)
+	}
+
+	var dialed bool
+	res, err = http.HttpGet(srv.URL + "/").
+		SetTLSClientConfig(tlsConfig).
+		SetProtocolVersion("h2").
+		SetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = true
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}).
+		String()
+	if err != nil || res != "HTTP/2.0 /" || !dialed {
+		t.Fatalf("h2 with dialer: %q %v %v", res, err, dialed)
+	}
+
+	// the tls configuration follows the host of a redirect
+	_, port, _ := net.SplitHostPort(u.Host)
+	redirect := httptest.NewServer(nethttp.RedirectHandler("https://localhost:"+port+"/moved", nethttp.StatusFound))
+	defer redirect.Close()
+	localhost := &tls.Config{RootCAs: tlsConfig.RootCAs, ServerName: "example.com"}
+	res, err = http.HttpGet(redirect.URL).SetTLSHostConfig("localhost", localhost).String()
+	if err != nil || res != "HTTP/2.0 /moved" {
+		t.Fatalf("redirect: %q %v", res, err)
+	}
+	// every request on a shared transport gets its own tls configuration
+	shared := &nethttp.Transport{}
+	for i := 0; i < 2; i++ {
+		res, err = http.HttpGet(srv.URL + "/").SetTransport(shared).SetTLSClientConfig(tlsConfig.Clone()).String()
+		if err != nil || res != "HTTP/1.1 /" {
+			t.Fatalf("shared transport %d: %q %v", i, res, err)
+		}
+	}
+	if _, err = http.HttpGet(srv.URL + "/").SetTransport(shared).String(); err == nil {
+		t.Fatal("shared transport kept the tls configuration of a request")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	srv := httptest.NewUnstartedServer(protoHandler())
+	srv.Config.Protocols = new(nethttp.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.HttpGet(srv.URL + "/").SetProtocolVersion("h2c").String()
+	if err != nil || res != "HTTP/2.0 /" {
+		t.Fatalf("h2c: %q %v", res, err)
+	}
+}
@@ -0,0 +1,204 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carmel/go-util/http"
+)
+
+// wsEchoServer is a minimal websocket server echoing every message. With
+// permessage-deflate it compresses replies keeping the context between messages.
+func wsEchoServer() *httptest.Server {
+	return httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			return
+		}
+		deflate := strings.HasPrefix(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		conn, rw, err := w.(nethttp.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n")
+		rw.WriteString("Sec-WebSocket-Protocol: " + r.Header.Get("Sec-WebSocket-Protocol") + "\r\n")
+		if deflate {
+			rw.WriteString("Sec-WebSocket-Extensions: permessage-deflate; client_no_context_takeover\r\n")
+		}
+		rw.WriteString("\r\n")
+		rw.Flush()
+
+		var out bytes.Buffer
+		zw, _ := flate.NewWriter(&out, flate.BestCompression)
+		var msg []byte
+		var msgOp byte
+		var compressed bool
+		for {
+			op, fin, rsv1, payload, err := wsReadFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch op {
+			case 8:
+				wsWriteFrame(rw.Writer, 0x80|8, payload)
+				return
+			case 9:
+				wsWriteFrame(rw.Writer, 0x80|10, payload)
+				continue
+			case 10:
+				continue
+			case 1, 2:
+				msg, msgOp, compressed = nil, op, rsv1
+			}
+			msg = append(msg, payload...)
+			if !fin {
+				continue
+			}
+			if compressed {
+				zr := flate.NewReader(io.MultiReader(bytes.NewReader(msg), bytes.NewReader([]byte{0, 0, 0xff, 0xff})))
+				msg, _ = ioutil.ReadAll(zr)
+			}
+			if !deflate {
+				wsWriteFrame(rw.Writer, 0x80|msgOp, msg)
+				continue
+			}
+			out.Reset()
+			zw.Write(msg)
+			zw.Flush()
+			wsWriteFrame(rw.Writer, 0x80|0x40|msgOp, bytes.TrimSuffix(out.Bytes(), []byte{0, 0, 0xff, 0xff}))
+		}
+	}))
+}
+
+func wsReadFrame(r *bufio.Reader) (op byte, fin, rsv1 bool, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if head[1]&0x80 == 0 {
+		err = errors.New("unmasked client frame")
+		return
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0f, head[0]&0x80 != 0, head[0]&0x40 != 0, payload, nil
+}
+
+func wsWriteFrame(w *bufio.Writer, b0 byte, payload []byte) {
+	w.WriteByte(b0)
+	switch n := len(payload); {
+	case n <= 125:
+		w.WriteByte(byte(n))
+	case n <= 0xffff:
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(127)
+		binary.Write(w, binary.BigEndian, uint64(n))
+	}
+	w.Write(payload)
+	w.Flush()
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := wsEchoServer()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, compress := range []bool{false, true} {
+		ws, _, err := http.HttpGet("ws"+strings.TrimPrefix(srv.URL, "http")+"/echo").
+			WebSocket(ctx, &http.WSOptions{
+				Subprotocols: []string{"echo"},
+				Compression:  compress,
+				FragmentSize: 7,
+				PingInterval: 10 * time.Millisecond,
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ws.Subprotocol() != "echo" {
+			t.Fatalf("subprotocol %q", ws.Subprotocol())
+		}
+
+		long := strings.Repeat("websocket ", 2000)
+		messages := []struct {
+			typ  int
+			data string
+		}{
+			{http.TextMessage, "hello"},
+			{http.BinaryMessage, "\x00\x01\x02 fragmented binary"},
+			{http.TextMessage, long},
+			{http.TextMessage, long},
+		}
+		for _, m := range messages {
+			if err = ws.WriteMessage(m.typ, []byte(m.data)); err != nil {
+				t.Fatal(err)
+			}
+			typ, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != m.typ || string(data) != m.data {
+				t.Fatalf("compress %v: got %d %.20q", compress, typ, data)
+			}
+		}
+		time.Sleep(30 * time.Millisecond) // let a few pings go out
+
+		if err = ws.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = ws.WriteMessage(http.TextMessage, []byte("late")); err != http.ErrWSClosed {
+			t.Fatalf("write after close: %v", err)
+		}
+	}
+}
+
+func TestWebSocketBadHandshake(t *testing.T) {
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.WriteHeader(nethttp.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, resp, err := http.HttpGet(srv.URL).WebSocket(context.Background(), nil)
+	if !errors.Is(err, http.ErrBadHandshake) || resp == nil || resp.StatusCode != nethttp.StatusForbidden {
+		t.Fatalf("got %v", err)
+	}
+}